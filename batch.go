@@ -0,0 +1,164 @@
+package ezipc
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// RegisterBatch registers a function which processes calls to name in batches.
+// Calls are accumulated in the order they arrive until size calls are pending or window has passed since the first,
+// then fn is invoked once with all of their arguments and each reply and error is returned to its caller.
+// Calls waiting on their batch don't count toward SetMaxConcurrentExecs, so size may exceed it.
+// Batch functions should look like:
+// func name(args []T1) ([]T2, []error)
+func (e *EzIPC) RegisterBatch(name string, fn interface{}, size int, window time.Duration) error {
+	ft := reflect.TypeOf(fn)
+	if ft == nil || ft.Kind() != reflect.Func {
+		return fmt.Errorf("Only functions may be registered, got %v.", ft)
+	}
+	if ft.NumIn() != 1 || ft.In(0).Kind() != reflect.Slice {
+		return fmt.Errorf("Batch function must take a single slice of arguments, got %s.", ft)
+	}
+	if ft.NumOut() != 2 || ft.Out(0).Kind() != reflect.Slice || ft.Out(1) != reflect.SliceOf(errorType) {
+		return fmt.Errorf("Batch function must return a slice of replies and a slice of errors, got %s.", ft)
+	}
+	if size < 1 {
+		return fmt.Errorf("Batch size must be at least 1, got %d.", size)
+	}
+
+	b := &batcher{
+		router: e,
+		fn:     reflect.ValueOf(fn),
+		size:   size,
+		window: window,
+	}
+	return e.registerExec(name, b.exec, schemaOf(ft.In(0).Elem(), ft.Out(0).Elem(), nil))
+}
+
+// Accumulates calls for a batch function.
+type batcher struct {
+	router  *EzIPC
+	fn      reflect.Value
+	size    int
+	window  time.Duration
+	lock    sync.Mutex
+	pending []*batchCall
+	timer   *time.Timer
+}
+
+// Call waiting on its batch to be processed.
+type batchCall struct {
+	req  *msg
+	arg  reflect.Value
+	done chan struct{}
+}
+
+// Queues request for the next batch, returns once the batch has been processed.
+func (b *batcher) exec(req *msg) *msg {
+	req.Blob = nil
+
+	Va1, err := b.router.decodeField(req.Va1)
+	req.Va1 = ""
+	req.Va2 = ""
+	if err != nil {
+		req.Err = err.Error()
+		return req
+	}
+
+	arg := reflect.New(b.fn.Type().In(0).Elem())
+	if err = b.router.codec.Unmarshal(Va1, arg.Interface()); err != nil {
+		req.Err = err.Error()
+		return req
+	}
+
+	call := &batchCall{
+		req:  req,
+		arg:  arg.Elem(),
+		done: make(chan struct{}),
+	}
+
+	b.lock.Lock()
+	b.pending = append(b.pending, call)
+	if len(b.pending) >= b.size {
+		if b.timer != nil {
+			b.timer.Stop()
+			b.timer = nil
+		}
+		batch := b.pending
+		b.pending = nil
+		b.lock.Unlock()
+		b.process(batch)
+	} else {
+		if len(b.pending) == 1 {
+			b.timer = time.AfterFunc(b.window, b.flush)
+		}
+		b.lock.Unlock()
+	}
+
+	// Let the connection run other calls while this one waits, so a batch larger than its limit of handlers can fill.
+	if req.conn != nil {
+		req.conn.suspendExec()
+		defer req.conn.resumeExec()
+	}
+	<-call.done
+	return req
+}
+
+// Processes whatever is pending once the window has passed.
+func (b *batcher) flush() {
+	b.lock.Lock()
+	batch := b.pending
+	b.pending = nil
+	b.timer = nil
+	b.lock.Unlock()
+
+	if len(batch) > 0 {
+		b.process(batch)
+	}
+}
+
+// Invokes batch function and distributes results to each call.
+func (b *batcher) process(batch []*batchCall) {
+	defer func() {
+		// Batches are processed off the caller's goroutine, so a panic is recovered here rather than in execute.
+		if r := recover(); r != nil {
+			reqs := make([]*msg, len(batch))
+			for i, call := range batch {
+				reqs[i] = call.req
+			}
+			b.router.panicked(r, debug.Stack(), reqs...)
+		}
+		for _, call := range batch {
+			close(call.done)
+		}
+	}()
+
+	args := reflect.MakeSlice(b.fn.Type().In(0), len(batch), len(batch))
+	for i, call := range batch {
+		args.Index(i).Set(call.arg)
+	}
+
+	out := b.fn.Call([]reflect.Value{args})
+	replies, errs := out[0], out[1]
+
+	for i, call := range batch {
+		if i >= replies.Len() || i >= errs.Len() {
+			call.req.Err = fmt.Sprintf("Batch function returned %d replies and %d errors for %d calls.", replies.Len(), errs.Len(), len(batch))
+			continue
+		}
+		if err, _ := errs.Index(i).Interface().(error); err != nil {
+			setErr(call.req, err)
+			continue
+		}
+		data, err := b.router.codec.Marshal(replies.Index(i).Interface())
+		if err != nil {
+			call.req.Err = err.Error()
+			continue
+		}
+		call.req.Va2 = base64.StdEncoding.EncodeToString(data)
+	}
+}
@@ -0,0 +1,124 @@
+package ezipc
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// Calls to a batch function are processed together once size calls are pending, or once the window passes.
+func TestBatch(t *testing.T) {
+	const size = 4
+	b, sock := newBroker(t)
+	p := newRouter(t)
+	var batches []int
+	var lock sync.Mutex
+	err := p.RegisterBatch("Double", func(args []int) ([]int, []error) {
+		lock.Lock()
+		batches = append(batches, len(args))
+		lock.Unlock()
+		out := make([]int, len(args))
+		for i, arg := range args {
+			out[i] = arg * 2
+		}
+		return out, make([]error, len(args))
+	}, size, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Dial(sock); err != nil {
+		t.Fatal(err)
+	}
+	waitRoute(t, b, "Double")
+	c := newClient(t, sock, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < size+1; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var reply int
+			if err := c.Call("Double", i, &reply); err != nil || reply != i*2 {
+				t.Errorf("Double(%d) = %d, %v", i, reply, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(batches) != 2 || batches[0] != size || batches[1] != 1 {
+		t.Errorf("Batches processed %v, want [%d 1].", batches, size)
+	}
+}
+
+// RegisterBatch refuses functions not taking and returning slices, and sizes under 1.
+func TestRegisterBatchInvalid(t *testing.T) {
+	e := newRouter(t)
+	ok := func(args []int) ([]int, []error) { return nil, nil }
+	for _, tc := range []struct {
+		fn   interface{}
+		size int
+	}{
+		{nil, 1},
+		{func(arg int) ([]int, []error) { return nil, nil }, 1},
+		{func(args []int) []int { return nil }, 1},
+		{func(args []int) ([]int, []string) { return nil, nil }, 1},
+		{ok, 0},
+	} {
+		if err := e.RegisterBatch("Bad", tc.fn, tc.size, time.Second); err == nil {
+			t.Errorf("RegisterBatch(%T, %d) accepted.", tc.fn, tc.size)
+		}
+	}
+	if err := e.RegisterBatch("Good", ok, 1, time.Second); err != nil {
+		t.Errorf("RegisterBatch = %v", err)
+	}
+}
+
+// Batches fill from calls over a single connection even when larger than its limit of executing handlers.
+func TestBatchOverExecLimit(t *testing.T) {
+	const size = 8
+	b, sock := newBroker(t)
+	p := newRouter(t)
+	p.SetMaxConcurrentExecs(2)
+	var batches []int
+	var lock sync.Mutex
+	err := p.RegisterBatch("Double", func(args []int) ([]int, []error) {
+		lock.Lock()
+		batches = append(batches, len(args))
+		lock.Unlock()
+		out := make([]int, len(args))
+		for i, arg := range args {
+			out[i] = arg * 2
+		}
+		return out, make([]error, len(args))
+	}, size, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Dial(sock); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	waitRoute(t, b, "Double")
+	c := newClient(t, sock, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < size; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var reply int
+			if err := c.CallTimeout("Double", i, &reply, 5*time.Second); err != nil || reply != i*2 {
+				t.Errorf("Double(%d) = %d, %v", i, reply, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(batches) != 1 || batches[0] != size {
+		t.Errorf("Batches processed %v, want one of %d.", batches, size)
+	}
+}
@@ -0,0 +1,86 @@
+package ezipc
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"reflect"
+)
+
+// Codec encodes arguments and replies of calls.
+// A Codec may optionally implement Name() string, which identifies it to peers during the handshake.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// ErrCodecMismatch is returned when a call is relayed between connections using different codecs.
+var ErrCodecMismatch = errors.New("Codec mismatch between caller and provider.")
+
+// Default codec.
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                               { return "json" }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// GobCodec encodes arguments and replies with encoding/gob, suited to Go types JSON handles poorly such as maps with integer keys.
+// Each value is encoded with its own encoder, so it is safe for concurrent use.
+type GobCodec struct{}
+
+func (GobCodec) Name() string { return "gob" }
+
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	// gob cannot encode nil, which is sent as no data.
+	if rv := reflect.ValueOf(v); !rv.IsValid() || rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// Returns name identifying codec to peers.
+func codecName(c Codec) string {
+	if n, ok := c.(interface {
+		Name() string
+	}); ok {
+		return n.Name()
+	}
+	return reflect.TypeOf(c).String()
+}
+
+// WithCodec sets the codec used for arguments and replies, both by registered functions and by calls, JSON is used by default.
+func WithCodec(c Codec) Option {
+	return func(e *EzIPC) {
+		e.SetCodec(c)
+	}
+}
+
+// SetCodec sets the codec used for arguments and replies, JSON is used by default.
+// Peers exchange codec names on connect, calls between peers using different codecs fail with ErrCodecMismatch.
+func (e *EzIPC) SetCodec(c Codec) {
+	e.codec = c
+}
+
+// Returns codec name used by peer on c, peers which don't declare one use JSON.
+// Local functions use the router's codec.
+func (c *connection) codecName() string {
+	if c.exec != nil {
+		return codecName(c.router.codec)
+	}
+	if c.codec == "" {
+		return "json"
+	}
+	return c.codec
+}
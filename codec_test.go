@@ -0,0 +1,136 @@
+package ezipc
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// Peers sharing a codec call each other through a broker using another, peers which don't are refused.
+func TestCodecMismatch(t *testing.T) {
+	b, sock := newBroker(t)
+	double := func(arg int, reply *int) error { *reply = arg * 2; return nil }
+	newClient(t, sock, map[string]interface{}{"GobDouble": double}, WithCodec(GobCodec{}))
+	newClient(t, sock, map[string]interface{}{"JSONDouble": double})
+	waitRoute(t, b, "GobDouble")
+	waitRoute(t, b, "JSONDouble")
+
+	c := newClient(t, sock, nil, WithCodec(GobCodec{}))
+	var reply int
+	if err := c.Call("GobDouble", 21, &reply); err != nil || reply != 42 {
+		t.Errorf("Call between gob peers = %d, %v, want 42", reply, err)
+	}
+	if err := c.Call("JSONDouble", 21, &reply); err != ErrCodecMismatch {
+		t.Errorf("Call from gob to JSON peer = %v, want ErrCodecMismatch", err)
+	}
+
+	// Locally registered functions share the router's codec.
+	if err := b.RegisterName("BrokerDouble", double); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Call("BrokerDouble", 21, &reply); err != ErrCodecMismatch {
+		t.Errorf("Call from gob peer to JSON broker = %v, want ErrCodecMismatch", err)
+	}
+}
+
+// A codec set with WithCodec carries types JSON can't, both to registered functions and back to the caller.
+func TestWithCodec(t *testing.T) {
+	b, sock := newBroker(t)
+	newClient(t, sock, map[string]interface{}{
+		"Swap": func(arg map[Pair]int, reply *map[Pair]int) error {
+			*reply = make(map[Pair]int)
+			for k, v := range arg {
+				(*reply)[Pair{A: k.B, B: k.A}] = v
+			}
+			return nil
+		},
+	}, WithCodec(GobCodec{}))
+	waitRoute(t, b, "Swap")
+	c := newClient(t, sock, nil, WithCodec(GobCodec{}))
+
+	var reply map[Pair]int
+	if err := c.Call("Swap", map[Pair]int{{A: 1, B: 2}: 3}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply) != 1 || reply[Pair{A: 2, B: 1}] != 3 {
+		t.Errorf("Swap over gob = %v, want map[{2 1}:3]", reply)
+	}
+}
+
+type gobRecord struct {
+	Name    string
+	Values  []float64
+	Counts  map[int]int
+	Nested  *gobRecord
+	private int
+}
+
+// Round trips structs, slices and maps with integer keys through GobCodec, unexported fields are left out.
+func TestGobRoundTrip(t *testing.T) {
+	values := []interface{}{
+		gobRecord{Name: "a", Values: []float64{1.5, -2}, Counts: map[int]int{-1: 1, 7: 49}, Nested: &gobRecord{Name: "b"}},
+		[]string{"x", "", "z"},
+		[]gobRecord{{Name: "1"}, {Name: "2", Counts: map[int]int{0: 0}}},
+		map[int]int{1: 1, 2: 4, -3: 9},
+		map[int]string{},
+		42,
+	}
+
+	var codec GobCodec
+	for _, want := range values {
+		data, err := codec.Marshal(want)
+		if err != nil {
+			t.Fatalf("Marshal(%T): %s", want, err)
+		}
+		got := reflect.New(reflect.TypeOf(want))
+		if err := codec.Unmarshal(data, got.Interface()); err != nil {
+			t.Fatalf("Unmarshal(%T): %s", want, err)
+		}
+		if !reflect.DeepEqual(got.Elem().Interface(), want) {
+			t.Errorf("%T did not round trip:\n got %#v\nwant %#v", want, got.Elem().Interface(), want)
+		}
+	}
+
+	data, err := codec.Marshal(gobRecord{Name: "p", private: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got gobRecord
+	if err := codec.Unmarshal(data, &got); err != nil || got.Name != "p" || got.private != 0 {
+		t.Errorf("Struct with unexported field = %#v, %v", got, err)
+	}
+
+	// Nil is sent as no data, leaving the reply as it was.
+	if data, err := codec.Marshal((*gobRecord)(nil)); err != nil || len(data) != 0 {
+		t.Errorf("Marshal(nil) = %x, %v", data, err)
+	}
+}
+
+// GobCodec is safe for concurrent use, and carries maps with integer keys between peers.
+func TestGobCalls(t *testing.T) {
+	b, sock := newBroker(t, WithCodec(GobCodec{}))
+	newClient(t, sock, map[string]interface{}{
+		"Square": func(arg map[int]int, reply *map[int]int) error {
+			*reply = make(map[int]int, len(arg))
+			for k, v := range arg {
+				(*reply)[k] = v * v
+			}
+			return nil
+		},
+	}, WithCodec(GobCodec{}))
+	waitRoute(t, b, "Square")
+	c := newClient(t, sock, nil, WithCodec(GobCodec{}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var reply map[int]int
+			if err := c.Call("Square", map[int]int{i: i, -i - 1: 2}, &reply); err != nil || reply[i] != i*i || reply[-i-1] != 4 {
+				t.Errorf("Square(%d) = %v, %v", i, reply, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,126 @@
+package ezipc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// SetCompression compresses the argument and reply of messages we send, each independently and only when its encoded size exceeds threshold bytes, 0 disables.
+// A small query with a large result has only the result compressed. Compressed messages are understood by peers regardless of their own setting.
+func (e *EzIPC) SetCompression(threshold int) {
+	e.compress_at = threshold
+}
+
+// WithCompression compresses arguments and replies whose encoded size exceeds threshold bytes, as SetCompression.
+func WithCompression(threshold int) Option {
+	return func(e *EzIPC) {
+		e.SetCompression(threshold)
+	}
+}
+
+// WithCompressionHook calls hook for each argument or reply over the compression threshold with its size before and after compression, to help tune the threshold.
+// The hook is called whether or not the compressed field was smaller and used, from the goroutine sending the message before it takes
+// the connection's send lock. Relayed messages are compressed while routing them, so the hook should return quickly without calling the router.
+func WithCompressionHook(hook func(name string, size, compressed int)) Option {
+	return func(e *EzIPC) {
+		e.compress_hook = hook
+	}
+}
+
+// Returns the argument, reply and header of req for the wire, compressing the argument and reply separately when over threshold.
+func (e *EzIPC) compressFields(req *msg) (va1, va2 string, hdr map[string]string) {
+	threshold := e.compress_at
+	va1, va2, hdr = req.Va1, req.Va2, req.Hdr
+	if threshold <= 0 {
+		return
+	}
+
+	flag := func(key string) {
+		if len(hdr) == len(req.Hdr) {
+			hdr = make(map[string]string, len(req.Hdr)+2)
+			for k, v := range req.Hdr {
+				hdr[k] = v
+			}
+		}
+		hdr[key] = "1"
+	}
+
+	if z, ok := e.compressField(req.Dst, va1, threshold); ok {
+		va1 = z
+		flag(hdrZipVa1)
+	}
+	if z, ok := e.compressField(req.Dst, va2, threshold); ok {
+		va2 = z
+		flag(hdrZipVa2)
+	}
+	return
+}
+
+// Compresses base64 encoded field with gzip when over threshold, reporting if the compressed field is used.
+func (e *EzIPC) compressField(name, field string, threshold int) (string, bool) {
+	if len(field) <= threshold {
+		return field, false
+	}
+	data, err := base64.StdEncoding.DecodeString(field)
+	if err != nil {
+		return field, false
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+
+	if e.compress_hook != nil {
+		e.compress_hook(name, len(data), buf.Len())
+	}
+
+	z := base64.StdEncoding.EncodeToString(buf.Bytes())
+	if len(z) >= len(field) {
+		return field, false
+	}
+	return z, true
+}
+
+// Decompresses the argument and reply of a recieved message, as flagged in its header.
+// Each field may decompress to at most max bytes, so a small frame cannot inflate past the frame and field limits.
+func (m *msg) decompress(max int) (err error) {
+	if m.hdr(hdrZipVa1) != "" {
+		if m.Va1, err = decompressField(m.Va1, max); err != nil {
+			return
+		}
+		delete(m.Hdr, hdrZipVa1)
+	}
+	if m.hdr(hdrZipVa2) != "" {
+		if m.Va2, err = decompressField(m.Va2, max); err != nil {
+			return
+		}
+		delete(m.Hdr, hdrZipVa2)
+	}
+	return
+}
+
+// Decompresses a base64 encoded field, failing with ErrTooLarge once it exceeds max bytes.
+func decompressField(field string, max int) (string, error) {
+	z, err := base64.StdEncoding.DecodeString(field)
+	if err != nil {
+		return "", err
+	}
+	r, err := gzip.NewReader(bytes.NewReader(z))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > max {
+		return "", fmt.Errorf("Decompressed field exceeds maximum size of %d bytes: %w", max, ErrTooLarge)
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
@@ -0,0 +1,70 @@
+package ezipc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Large arguments and replies are gzipped in either direction and restored by the peer,
+// with the hook told of each outside the connection's send lock.
+func TestCompression(t *testing.T) {
+	b, sock := newBroker(t)
+	newClient(t, sock, map[string]interface{}{
+		"Echo": func(arg string, reply *string) error { *reply = arg; return nil },
+	}, WithCompression(64))
+	waitRoute(t, b, "Echo")
+
+	var lock sync.Mutex
+	var sizes [][2]int
+	var c *EzIPC
+	c = newClient(t, sock, nil, WithCompression(64), WithCompressionHook(func(name string, size, compressed int) {
+		if up := c.getUplink(); !up.sendLock.TryLock() {
+			t.Errorf("Compression hook called with the send lock held.")
+		} else {
+			up.sendLock.Unlock()
+		}
+		lock.Lock()
+		sizes = append(sizes, [2]int{size, compressed})
+		lock.Unlock()
+	}))
+
+	arg := strings.Repeat("compressible ", 1000)
+	var reply string
+	if err := c.Call("Echo", arg, &reply); err != nil || reply != arg {
+		t.Fatalf("Echo of %d bytes = %d bytes, %v", len(arg), len(reply), err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(sizes) == 0 || sizes[0][1] >= sizes[0][0] {
+		t.Errorf("Compression hook reported %v, want the argument compressed.", sizes)
+	}
+}
+
+// Fields are compressed with gzip only when over the threshold, and inflating past the limit fails with ErrTooLarge.
+func TestCompressField(t *testing.T) {
+	e := newRouter(t)
+	data := bytes.Repeat([]byte{'a'}, 1<<16)
+	field := base64.StdEncoding.EncodeToString(data)
+	if _, ok := e.compressField("", field, len(field)); ok {
+		t.Error("Field at the threshold compressed.")
+	}
+	z, ok := e.compressField("", field, 64)
+	if !ok {
+		t.Fatal("Compressible field not compressed.")
+	}
+	raw, _ := base64.StdEncoding.DecodeString(z)
+	if len(raw) < 2 || raw[0] != 0x1f || raw[1] != 0x8b {
+		t.Errorf("Compressed field is not gzip, starts %x.", raw[:2])
+	}
+
+	if out, err := decompressField(z, len(data)); err != nil || out != field {
+		t.Errorf("decompressField at limit failed: %v", err)
+	}
+	if _, err := decompressField(z, len(data)-1); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("decompressField past limit = %v, want ErrTooLarge.", err)
+	}
+}
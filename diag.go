@@ -0,0 +1,133 @@
+package ezipc
+
+import (
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// DiagnosticSnapshot describes the internal state of the router, for diagnosing hangs and leaks.
+type DiagnosticSnapshot struct {
+	// When the snapshot was taken.
+	Taken time.Time
+	// Goroutines in the process.
+	Goroutines int
+	// Calls and relays waiting on replies.
+	Buckets []BucketInfo
+	// Connection IDs providing each name, in order of registration.
+	Routes map[string][]string
+	// State of each network connection.
+	Conns []ConnState
+	// Connections accepted in the current connect rate window, and peers in cooldown.
+	Accepted   int
+	CoolingOff []string
+}
+
+// BucketInfo describes a call or relay waiting on a reply.
+type BucketInfo struct {
+	Tag int32
+	// "request", "relay" or "exec".
+	Kind string
+	Age  time.Duration
+	// IDs of the connection the reply is expected from, and of the caller for relays.
+	Dst string
+	Src string
+}
+
+// ConnState describes a network connection and its limits.
+type ConnState struct {
+	ConnInfo
+	// Calls executing on the connection.
+	Inflight int64
+	// Calls from the connection being relayed.
+	Relays int
+	// Flow control credit available and frames waiting on credit, when flow control is in use.
+	Credits int
+	Queued  int
+}
+
+// Dump returns a snapshot of the router's internal state.
+// Routes and connections are copied under connMapLock and buckets under tagMapLock, never holding both,
+// as route takes connMapLock while holding tagMapLock. Each table is consistent, though they may be moments apart.
+// Also available to peers as the builtin "ezipc.Dump".
+func (e *EzIPC) Dump() (d DiagnosticSnapshot) {
+	d.Taken = time.Now()
+	d.Goroutines = runtime.NumGoroutine()
+
+	e.connMapLock.RLock()
+	d.Routes = make(map[string][]string, len(e.connMap))
+	for name, conns := range e.connMap {
+		for _, c := range conns {
+			d.Routes[name] = append(d.Routes[name], c.id)
+		}
+	}
+	conns := make([]*connection, 0, len(e.conns))
+	for c := range e.conns {
+		conns = append(conns, c)
+		d.Conns = append(d.Conns, ConnState{
+			ConnInfo: ConnInfo{
+				ID:     c.id,
+				Addr:   c.addr,
+				Routes: append([]string(nil), c.routes...),
+				Labels: c.labels,
+				Peer:   c.peer,
+			},
+			Inflight: atomic.LoadInt64(&c.inflight),
+		})
+	}
+	e.connMapLock.RUnlock()
+
+	kinds := map[int]string{t_REQUEST: "request", t_RELAY: "relay", t_EXEC: "exec"}
+	e.tagMapLock.Lock()
+	for tag, b := range e.tagMap {
+		info := BucketInfo{
+			Tag:  tag,
+			Kind: kinds[b.flag],
+			Age:  d.Taken.Sub(b.created),
+		}
+		if b.dst != nil {
+			info.Dst = b.dst.id
+		}
+		if b.src != nil {
+			info.Src = b.src.id
+		}
+		d.Buckets = append(d.Buckets, info)
+	}
+	for i, c := range conns {
+		d.Conns[i].Relays = c.relays
+	}
+	e.tagMapLock.Unlock()
+	sort.Slice(d.Buckets, func(i, j int) bool { return d.Buckets[i].Age > d.Buckets[j].Age })
+
+	for i, c := range conns {
+		if f := c.getFlow(); f != nil {
+			f.lock.Lock()
+			d.Conns[i].Credits = f.credits
+			d.Conns[i].Queued = len(f.queue)
+			f.lock.Unlock()
+		}
+	}
+	sort.Slice(d.Conns, func(i, j int) bool {
+		a, b := d.Conns[i].ID, d.Conns[j].ID
+		return len(a) < len(b) || len(a) == len(b) && a < b
+	})
+
+	e.admit.lock.Lock()
+	d.Accepted = e.admit.accepted
+	for addr, until := range e.admit.until {
+		if d.Taken.Before(until) {
+			d.CoolingOff = append(d.CoolingOff, addr)
+		}
+	}
+	e.admit.lock.Unlock()
+	sort.Strings(d.CoolingOff)
+
+	return
+}
+
+// Builtin providing Dump to peers.
+func (e *EzIPC) dump(_ string, reply *DiagnosticSnapshot) error {
+	*reply = e.Dump()
+	return nil
+}
@@ -0,0 +1,48 @@
+package ezipc
+
+import (
+	"testing"
+)
+
+// Dump shows routes, connections and calls waiting on replies, also to peers through the builtin.
+func TestDump(t *testing.T) {
+	release := make(chan struct{})
+	b, sock := newBroker(t)
+	newClient(t, sock, map[string]interface{}{
+		"Slow": func(arg int, reply *int) error { <-release; return nil },
+	})
+	waitRoute(t, b, "Slow")
+	c := newClient(t, sock, nil)
+
+	done := make(chan error, 1)
+	go func() {
+		var reply int
+		done <- c.Call("Slow", 1, &reply)
+	}()
+	relaying := func(d DiagnosticSnapshot) bool {
+		for _, bucket := range d.Buckets {
+			if bucket.Kind == "relay" {
+				return true
+			}
+		}
+		return false
+	}
+	waitFor(t, "relayed call", func() bool { return relaying(b.Dump()) })
+
+	d := b.Dump()
+	if len(d.Routes["Slow"]) != 1 || len(d.Conns) != 2 {
+		t.Errorf("Dump has routes %v over %d connections, want Slow over 2.", d.Routes, len(d.Conns))
+	}
+	var remote DiagnosticSnapshot
+	if err := c.Call("ezipc.Dump", "", &remote); err != nil {
+		t.Fatal(err)
+	}
+	if !relaying(remote) || len(remote.Routes["Slow"]) != 1 {
+		t.Errorf("Dump to peer = %+v", remote)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
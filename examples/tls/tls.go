@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"github.com/cmcoffee/go-ezipc"
+	"math/big"
+	"net"
+	"time"
+)
+
+// Creates a self-signed certificate authority.
+func newCA() (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ezipc example CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	return cert, key
+}
+
+// Issues a certificate signed by the CA, for either a server or a client.
+func issue(ca *x509.Certificate, ca_key *ecdsa.PrivateKey, serial int64, name string, usage x509.ExtKeyUsage) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, ca_key)
+	if err != nil {
+		panic(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func Hello(name string, greeting *string) error {
+	*greeting = "Hello, " + name + "!"
+	return nil
+}
+
+func main() {
+	ca, ca_key := newCA()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	// The broker only accepts clients presenting a certificate signed by the CA.
+	server_cfg := &tls.Config{
+		Certificates: []tls.Certificate{issue(ca, ca_key, 2, "broker", x509.ExtKeyUsageServerAuth)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	client_cfg := &tls.Config{
+		Certificates: []tls.Certificate{issue(ca, ca_key, 3, "client", x509.ExtKeyUsageClientAuth)},
+		RootCAs:      pool,
+	}
+
+	broker := ezipc.New()
+	go broker.ListenTLS("127.0.0.1:4443", server_cfg)
+	<-broker.Started()
+
+	producer := ezipc.New()
+	if err := producer.DialTLS("127.0.0.1:4443", client_cfg); err != nil {
+		fmt.Printf("Producer: %s\n", err)
+		return
+	}
+	producer.RegisterAndWait(Hello, time.Second)
+
+	consumer := ezipc.New()
+	if err := consumer.DialTLS("127.0.0.1:4443", client_cfg); err != nil {
+		fmt.Printf("Consumer: %s\n", err)
+		return
+	}
+
+	var greeting string
+	if err := consumer.Call("Hello", "TLS", &greeting); err != nil {
+		fmt.Printf("Call failed: %s\n", err)
+		return
+	}
+	fmt.Println(greeting)
+
+	// Clients without a certificate are turned away by the broker.
+	stranger := ezipc.New()
+	err := stranger.DialTLS("127.0.0.1:4443", &tls.Config{RootCAs: pool})
+	if err == nil {
+		err = stranger.Call("Hello", "stranger", &greeting)
+	}
+	fmt.Printf("Without a client certificate: %s\n", err)
+}
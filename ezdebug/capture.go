@@ -0,0 +1,122 @@
+// Package ezdebug provides debugging aids for ezipc, capturing the raw frame stream of connections and replaying it against a test broker.
+package ezdebug
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/cmcoffee/go-ezipc"
+)
+
+// Direction of captured bytes, relative to the captured side.
+type Direction byte
+
+const (
+	Read    Direction = '<'
+	Written Direction = '>'
+)
+
+// Capture records bytes read and written on connections to w.
+// Each record holds the direction, the connection number, the length and the bytes themselves.
+type Capture struct {
+	lock  sync.Mutex
+	w     io.Writer
+	err   error
+	conns uint32
+}
+
+// NewCapture creates a Capture writing records to w.
+func NewCapture(w io.Writer) *Capture {
+	return &Capture{w: w}
+}
+
+// Err returns the first error encountered writing records, once an error occurs capture stops.
+func (c *Capture) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// Conn wraps conn, capturing all bytes read from and written to it.
+func (c *Capture) Conn(conn net.Conn) net.Conn {
+	c.lock.Lock()
+	c.conns++
+	id := c.conns
+	c.lock.Unlock()
+	return &capturedConn{Conn: conn, capture: c, id: id}
+}
+
+// Dialer wraps dial for use with SetDialer, capturing connections it establishes, net.Dial is used if dial is nil.
+func (c *Capture) Dialer(dial ezipc.Dialer) ezipc.Dialer {
+	if dial == nil {
+		dial = net.Dial
+	}
+	return func(network, addr string) (net.Conn, error) {
+		conn, err := dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return c.Conn(conn), nil
+	}
+}
+
+// Listener wraps l for use with ListenWith, capturing connections it accepts.
+func (c *Capture) Listener(l net.Listener) net.Listener {
+	return &capturedListener{Listener: l, capture: c}
+}
+
+// Writes a single record.
+func (c *Capture) record(dir Direction, id uint32, p []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return
+	}
+	var hdr [9]byte
+	hdr[0] = byte(dir)
+	binary.BigEndian.PutUint32(hdr[1:5], id)
+	binary.BigEndian.PutUint32(hdr[5:9], uint32(len(p)))
+	if _, c.err = c.w.Write(hdr[:]); c.err != nil {
+		return
+	}
+	_, c.err = c.w.Write(p)
+}
+
+// Connection with its traffic captured.
+type capturedConn struct {
+	net.Conn
+	capture *Capture
+	id      uint32
+}
+
+func (c *capturedConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	if n > 0 {
+		c.capture.record(Read, c.id, p[:n])
+	}
+	return
+}
+
+func (c *capturedConn) Write(p []byte) (n int, err error) {
+	n, err = c.Conn.Write(p)
+	if n > 0 {
+		c.capture.record(Written, c.id, p[:n])
+	}
+	return
+}
+
+// Listener with accepted connections captured.
+type capturedListener struct {
+	net.Listener
+	capture *Capture
+}
+
+func (l *capturedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.capture.Conn(conn), nil
+}
@@ -0,0 +1,87 @@
+package ezdebug
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cmcoffee/go-ezipc"
+)
+
+// Buffer safe to snapshot while a capture is writing to it.
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) snapshot() []byte {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+// Waits up to 5 seconds for e to have a connection routing name.
+func waitRoute(t *testing.T, e *ezipc.EzIPC, name string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		for _, info := range e.Connections() {
+			for _, route := range info.Routes {
+				if route == name {
+					return
+				}
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for route %s.", name)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// A client's captured traffic, replayed against a fresh broker, registers the same names with it.
+func TestCaptureReplay(t *testing.T) {
+	dir, err := os.MkdirTemp("", "ezdebug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "s.sock")
+
+	b := ezipc.New()
+	go b.Listen(sock)
+	select {
+	case <-b.Started():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Broker did not start.")
+	}
+	var buf syncBuffer
+	capture := NewCapture(&buf)
+	c := ezipc.New()
+	c.SetDialer(capture.Dialer(nil))
+	c.RegisterName("Echo", func(arg int, reply *int) error { *reply = arg; return nil })
+	if err := c.Dial(sock); err != nil {
+		t.Fatal(err)
+	}
+	waitRoute(t, b, "Echo")
+	if err := capture.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed := ezipc.New()
+	done, err := Replay(bytes.NewReader(buf.snapshot()), Written, replayed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	waitRoute(t, replayed, "Echo")
+}
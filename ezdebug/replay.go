@@ -0,0 +1,112 @@
+package ezdebug
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"github.com/cmcoffee/go-ezipc"
+)
+
+// Replay feeds the bytes captured in direction dir from r to broker, each captured connection over its own in-memory connection.
+// Use Read for captures taken with Capture.Listener on a broker, or Written for captures taken with Capture.Dialer on a client.
+// Replies from broker are discarded, Replay returns once all captured bytes have been delivered,
+// leaving the connections open for broker to be inspected until the returned func is called.
+func Replay(r io.Reader, dir Direction, broker *ezipc.EzIPC) (func(), error) {
+	l := newPipeListener()
+	go broker.ListenWith(l)
+
+	peers := make(map[uint32]net.Conn)
+	closer := func() {
+		l.Close()
+		for _, p := range peers {
+			p.Close()
+		}
+	}
+
+	var hdr [9]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF {
+				return closer, nil
+			}
+			closer()
+			return nil, err
+		}
+		id := binary.BigEndian.Uint32(hdr[1:5])
+		data := make([]byte, binary.BigEndian.Uint32(hdr[5:9]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			closer()
+			return nil, err
+		}
+		if Direction(hdr[0]) != dir {
+			continue
+		}
+
+		p, ok := peers[id]
+		if !ok {
+			var err error
+			if p, err = l.dial(); err != nil {
+				closer()
+				return nil, err
+			}
+			peers[id] = p
+			go io.Copy(ioutil.Discard, p)
+		}
+		if _, err := p.Write(data); err != nil {
+			closer()
+			return nil, err
+		}
+	}
+}
+
+var errListenerClosed = errors.New("Listener closed.")
+
+// In-memory listener handing out one end of a net.Pipe per dial.
+type pipeListener struct {
+	accept chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		accept: make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Connects to the listener, returning our end of the connection.
+func (l *pipeListener) dial() (net.Conn, error) {
+	server, client := net.Pipe()
+	select {
+	case l.accept <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accept:
+		return conn, nil
+	case <-l.closed:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr{} }
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
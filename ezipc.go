@@ -21,30 +21,59 @@ Exported functions & methods should be made thread safe.
 package ezipc
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
-	"os"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// Option configures a router created with New.
+type Option func(*EzIPC)
+
 // Creates a new ezipc router.
-func New() *EzIPC {
+func New(opts ...Option) *EzIPC {
 	r := &EzIPC{
-		uplink:  nil,
-		tagMap:  make(map[int32]*bucket),
-		connMap: make(map[string]*connection),
+		uplink:   nil,
+		tagMap:   make(map[int32]*bucket),
+		connMap:  make(map[string][]*connection),
+		conns:    make(map[*connection]struct{}),
+		codec:    jsonCodec{},
+		started:  make(chan struct{}),
+		instance: newInstanceID(),
+		limiter:  make(chan struct{}, defaultLimit),
+	}
+	r.builtins = map[string]*connection{
+		"ezipc.Providers": r.builtin(r.providers),
+		"ezipc.Schema":    r.builtin(r.schema),
+		"ezipc.Dump":      r.builtin(r.dump),
+		"ezipc.Submit":    r.builtin(r.submit),
+		"ezipc.Result":    r.builtin(r.result),
+	}
+	r.SetCallTraceSize(defaultTraceSize)
+	for _, opt := range opts {
+		opt(r)
 	}
 	return r
 }
 
 // EzIPC is common to both IPC clients and servers.
 type EzIPC struct {
+	// counters are kept first for 64-bit alignment of atomics.
+	counters counters
+	// Debug logs each frame sent and recieved, and each route announced, to the logger set with SetLogger.
+	Debug bool
 	// the socket file.
 	socketf string
 	// uplink is used to designate our dispatcher.
@@ -52,72 +81,703 @@ type EzIPC struct {
 	// tagMap is for keeping track of requests.
 	tagMap     map[int32]*bucket
 	tagMapLock sync.Mutex
+	// How tags are generated, and the last counter tag, protected by tagMapLock.
+	tag_source  TagSource
+	tag_counter uint32
 	// connMap keeps track of all routes that we can send from, if not matched here, send to uplink if avaialble, send Err if not.
-	connMap     map[string]*connection
+	// Multiple connections may register the same name, resolved by the duplicate route policy and version routing.
+	connMap     map[string][]*connection
 	connMapLock sync.RWMutex
+	// conns holds all open network connections, protected by connMapLock.
+	conns map[*connection]struct{}
+	// Functions provided by the router itself, used when no connection provides the name.
+	builtins map[string]*connection
+	// Maximum time Scatter waits on providers, 0 waits indefinitely.
+	scatter_timeout time.Duration
+	// Codec for arguments and replies.
+	codec Codec
+	// Accepted connections are closed after max_conn_age, 0 disables.
+	max_conn_age time.Duration
+	// Establishes connections for Dial, net.Dial if nil.
+	dialer Dialer
+	// Client configuration of TLS connections dialed with DialTLS.
+	tls_config *tls.Config
+	// Frames a peer may send before being granted credit, 0 disables flow control.
+	flow_window int
+	// Runs work spawned by the router.
+	sched scheduler
+	// Labels sent to the broker in our handshake.
+	labels map[string]string
+	// Decides if peers connecting to Listen may connect, by their credentials.
+	peer_auth func(uid, gid, pid int) bool
+	// Random identifier of this router, sent in our handshake.
+	instance string
+	// Throttling of accepted connections.
+	admit admission
+	// Registrations acknowledged by our uplink.
+	acks acknowledgements
+	// Version aware routing among multiple providers.
+	versions versioning
+	// Resolution of names registered by multiple providers, protected by connMapLock.
+	dup_policy DuplicateRoutePolicy
+	// Round-robin positions among multiple providers.
+	rr rotation
+	// Listener accepting connections when we are the broker, protected by recv_lock.
+	listener net.Listener
+	// Set once Drain has been called.
+	draining uint32
+	// Set once Close has been called.
+	closed uint32
+	// Set once Dial or Listen has established a connection or listener.
+	connected uint32
+	// Closed once Listen is serving.
+	started      chan struct{}
+	started_once sync.Once
 	// Determines if we are a client or a server.
 	is_client bool
+	// logger recieves diagnostic output, nil disables logging.
+	logger Logger
+	// Calls taking longer than slow_call are logged, 0 disables.
+	slow_call time.Duration
+	// Maximum size of a blob carried with a message, 0 is unlimited.
+	max_msg_size int
+	// Frames routed from a single read before yielding, 0 is unlimited.
+	max_frames int
+	// Rewrites incoming call names before destination lookup.
+	rewriter func(string) string
+	// Socket files to fail over to when the uplink drops.
+	standby []string
+	// Backoff redialing the uplink once it drops, 0 disables reconnecting.
+	reconnect_min time.Duration
+	reconnect_max time.Duration
+	// busyChecks sent per call before we stop pinging, 0 is unlimited.
+	max_busy_checks int
+	// Set to leave a stale socket file in place in Listen.
+	no_cleanup bool
+	// Relays a single source connection may have pending, 0 is unlimited.
+	max_relays int
+	// Largest frame accepted from a peer, 0 is defaultMaxFrameSize.
+	max_frame int
+	// Largest decoded argument or reply passed to a handler, 0 is unlimited.
+	max_field int
+	// Include stack traces of panicking handlers in errors returned to callers.
+	panic_trace bool
+	// Calls we may have outstanding on a single connection, 0 is unlimited.
+	max_inflight int
+	// Calls submitted to us with Submit.
+	jobs jobTable
+	// Holds a slot for each accepted connection, Listen blocks once full.
+	limiter chan struct{}
+	// Resolves names nothing is registered under.
+	method_provider providerTable
+	// Handlers a single connection may have executing at once, 0 is defaultMaxExecs.
+	max_execs int
+	// Key derived from the pre-shared key, nil when not in use.
+	psk []byte
+	// Counters of calls by name.
+	methods methodTable
+	// Reciever goroutines running, waited on by Close and Drain, and closed once none are left while they wait.
+	// Guards starting recievers against closed and draining being set, so none start once Close or Drain waits.
+	recv_lock  sync.Mutex
+	recv_count int
+	recv_idle  chan struct{}
+	// Set to fail calls for names we don't provide rather than forwarding them to our uplink.
+	no_fallback bool
+	// Request binary framing on connections we dial.
+	binary_framing bool
+	// Bytes of pending payloads at which new calls are shed, 0 is unlimited.
+	mem_limit int
+	// Ring buffer of recent calls, a *traceRing.
+	traces atomic.Value
+	// Default deadlines for calls over the uplink, and for all calls, 0 waits indefinitely.
+	uplink_timeout time.Duration
+	call_timeout   time.Duration
+	// Arguments and replies larger than compress_at are compressed, 0 disables.
+	compress_at int
+	// Called with the sizes of each field compressed.
+	compress_hook func(name string, size, compressed int)
+	// Called as connections open and close.
+	connect_hook    func(c ConnInfo)
+	disconnect_hook func(c ConnInfo)
+}
+
+// Caller is the interface of EzIPC used by applications, allowing a mock to be substituted in tests.
+type Caller interface {
+	Call(name string, arg interface{}, reply interface{}) error
+	Register(fptr interface{}) error
+	RegisterName(name string, fptr interface{}) error
+	Notify(name string, arg interface{}) error
+	Close() error
+}
+
+var _ Caller = (*EzIPC)(nil)
+
+// Logger is the hook EzIPC uses for diagnostic output, *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// SetLogger sets the logger for diagnostic output, nil disables logging.
+func (e *EzIPC) SetLogger(l Logger) {
+	e.logger = l
+}
+
+// WithLogger sends diagnostic output, including Debug output, to l, by default nothing is logged.
+func WithLogger(l Logger) Option {
+	return func(e *EzIPC) {
+		e.SetLogger(l)
+	}
+}
+
+// SetSlowCallThreshold logs any call or local execution taking longer than d, 0 disables.
+func (e *EzIPC) SetSlowCallThreshold(d time.Duration) {
+	e.slow_call = d
+}
+
+// SetMaxMessageSize limits the size of blobs sent or recieved with CallWithBlob, 0 is unlimited.
+func (e *EzIPC) SetMaxMessageSize(n int) {
+	e.max_msg_size = n
+}
+
+// SetMaxFramesPerRead yields to other connections after routing n frames from a single read, 0 is unlimited.
+func (e *EzIPC) SetMaxFramesPerRead(n int) {
+	e.max_frames = n
+}
+
+// SetNameRewriter sets a function to rewrite incoming call names before routing, allowing deprecated names to be aliased.
+// Rewritten names are logged so remaining users of old names can be found.
+func (e *EzIPC) SetNameRewriter(rewriter func(incoming string) string) {
+	e.rewriter = rewriter
+}
+
+// SetMaxBusyChecks limits the busyCheck pings a Call sends while waiting, after which it waits on the reply without pinging, 0 is unlimited.
+func (e *EzIPC) SetMaxBusyChecks(n int) {
+	e.max_busy_checks = n
+}
+
+// SetMaxRelaysPerConn limits the calls a single connection may have relayed through us at once, further calls fail with ErrBusy, 0 is unlimited.
+// Keeps one consumer from starving others on a shared broker.
+func (e *EzIPC) SetMaxRelaysPerConn(n int) {
+	e.tagMapLock.Lock()
+	defer e.tagMapLock.Unlock()
+	e.max_relays = n
+}
+
+// SetUplinkFallback determines if calls for names no connection has registered with us are forwarded to our uplink, enabled by default.
+// Allows brokers in multi-tier topologies to resolve names provided further up, when disabled such calls fail with ErrFail.
+func (e *EzIPC) SetUplinkFallback(enabled bool) {
+	e.no_fallback = !enabled
+}
+
+// SetSocketCleanup determines if Listen removes a stale socket file at the socket path before listening, enabled by default.
+// Only the socket file itself is removed, disable when the socket path is managed externally.
+func (e *EzIPC) SetSocketCleanup(enabled bool) {
+	e.no_cleanup = !enabled
+}
+
+// Writes to logger if one is set.
+func (e *EzIPC) logf(format string, v ...interface{}) {
+	if e.logger != nil {
+		e.logger.Printf(format, v...)
+	}
+}
+
+// Logs frame sent or recieved on c when debugging.
+func (c *connection) debugFrame(dir string, req *msg) {
+	if c.router.Debug {
+		c.router.logf("%s connection %s: tag=%d dst=%s err=%q hdr=%v", dir, c.id, req.Tag, req.Dst, req.Err, req.Hdr)
+	}
+}
+
+// Logs calls which exceed the slow call threshold.
+func (e *EzIPC) logSlow(kind string, name string, d time.Duration) {
+	if e.slow_call > 0 && d > e.slow_call {
+		e.logf("Slow %s: %s took %v.", kind, name, d)
+	}
 }
 
 // EzIPC Connection.
 type connection struct {
+	// Calls executing on a local function, first for 64-bit alignment.
+	inflight int64
+	id       string
 	conn     net.Conn
+	addr     string
 	router   *EzIPC
 	routes   []string
-	err      error
+	codec    string
+	schema   []byte
+	// Error the reciever exited with, a connErr set through setRecvErr and read through recvErr.
+	err atomic.Value
+	// Whether a local function is draining.
+	draining uint32
+	// Calls from this connection being relayed, protected by tagMapLock.
+	relays int
+	// Flow control state, a *flow set by the handshake, read through getFlow.
+	flow atomic.Value
+	// Labels declared by the peer in its handshake.
+	labels map[string]string
+	// Credentials of the peer, for accepted Unix socket connections on Linux.
+	peer *PeerCred
+	// Instance of the peer's router, identifying it across reconnects.
+	instance string
+	// Protocol version agreed with the peer, 0 for peers predating protocol versions.
+	version int
+	// Slots of calls in flight over the connection, nil when unlimited.
+	slots chan struct{}
+	// Recieves the outcome of our handshake, for connections we dial.
+	handshake chan error
+	// Set to 1 once the peer settles our handshake, or 2 should Dial give up waiting on it.
+	settled uint32
+	// Set when either end refused the other's protocol version.
+	refused error
+	// Set once frames written to the connection use binary framing.
+	binary uint32
+	// Set once either end has said goodbye.
+	goodbye uint32
+	// Set once the peer has proven it holds our pre-shared key.
+	authed uint32
+	// Seals payloads with the key of this connection, our challenge to a dialer,
+	// and the proof the listener sends or we expect in the acknowledgement of the handshake.
+	aead      cipher.AEAD
+	psk_nonce []byte
+	psk_proof string
+	// Reader of the connection, when created before the reciever starts.
+	rd *bufio.Reader
+	// Set once the disconnect hook has been called.
+	disconnected uint32
+	// Handlers executing for calls from this connection, and calls waiting on one to finish.
+	exec_lock    sync.Mutex
+	exec_running int
+	exec_queue   []func()
+	// When the connection was opened, and whether it was accepted by Listen.
+	opened   time.Time
+	accepted bool
 	sendLock sync.Mutex
 	exec     func(*msg) *msg
 }
 
+// ConnInfo describes a connection to another EzIPC process.
+type ConnInfo struct {
+	// ID assigned to the connection by this router.
+	ID string
+	// Address of the remote end of the connection.
+	Addr string
+	// Names the remote end has registered with us.
+	Routes []string
+	// Labels the remote end declared when connecting.
+	Labels map[string]string
+	// Credentials of the remote end, nil unless it connected to us over a Unix socket on Linux.
+	Peer *PeerCred
+}
+
+// Wraps the error of a connection's reciever, so it may be stored in an atomic.Value.
+type connErr struct{ err error }
+
+// Records err as the error the reciever of c exited with.
+func (c *connection) setRecvErr(err error) {
+	c.err.Store(connErr{err})
+}
+
+// Returns the error the reciever of c exited with, nil while it is running.
+func (c *connection) recvErr() error {
+	err, _ := c.err.Load().(connErr)
+	return err.err
+}
+
+// Returns description of connection.
+func (c *connection) info() ConnInfo {
+	c.router.connMapLock.RLock()
+	defer c.router.connMapLock.RUnlock()
+	return ConnInfo{
+		ID:     c.id,
+		Addr:   c.addr,
+		Routes: append([]string(nil), c.routes...),
+		Labels: c.labels,
+		Peer:   c.peer,
+	}
+}
+
+// Connections describes all connections open to this router.
+func (e *EzIPC) Connections() []ConnInfo {
+	e.connMapLock.RLock()
+	conns := make([]*connection, 0, len(e.conns))
+	for c := range e.conns {
+		conns = append(conns, c)
+	}
+	e.connMapLock.RUnlock()
+
+	infos := make([]ConnInfo, 0, len(conns))
+	for _, c := range conns {
+		infos = append(infos, c.info())
+	}
+	// IDs are numeric, order by length first.
+	sort.Slice(infos, func(i, j int) bool {
+		a, b := infos[i].ID, infos[j].ID
+		return len(a) < len(b) || len(a) == len(b) && a < b
+	})
+	return infos
+}
+
+// Uplink describes the connection currently used to reach the broker, Addr is empty when there is no uplink.
+func (e *EzIPC) Uplink() ConnInfo {
+	if c := e.getUplink(); c != nil {
+		return c.info()
+	}
+	return ConnInfo{}
+}
+
+// SetStandby sets socket files of standby brokers, tried in order when the uplink drops.
+func (e *EzIPC) SetStandby(socketf ...string) {
+	e.standby = socketf
+}
+
+// Returns the uplink and the socket file it was dialed on.
+// The reciever replaces them while a dropped uplink fails over, so both are guarded by connMapLock.
+func (e *EzIPC) currentUplink() (*connection, string) {
+	e.connMapLock.RLock()
+	defer e.connMapLock.RUnlock()
+	return e.uplink, e.socketf
+}
+
+// Returns the uplink, nil when there is none.
+func (e *EzIPC) getUplink() *connection {
+	c, _ := e.currentUplink()
+	return c
+}
+
+// Restores old as the uplink should c, which replaced it, fail before it is used.
+func (e *EzIPC) restoreUplink(c, old *connection) {
+	e.connMapLock.Lock()
+	if e.uplink == c {
+		e.uplink = old
+	}
+	e.connMapLock.Unlock()
+}
+
+// Fails over or reconnects each time uplink c drops with err, recieving from each new uplink in turn,
+// so a single goroutine keeps the uplink however often it drops. Returns once no broker can be reached, or we have closed.
+func (e *EzIPC) keepUplink(c *connection, err error) error {
+	for {
+		if c, err = e.failover(c, err); c == nil {
+			return err
+		}
+		if !e.startReciever() {
+			c.close()
+			return ErrClosed
+		}
+		atomic.StoreUint32(&c.settled, 1)
+		err = c.recieve()
+		c.setRecvErr(err)
+	}
+}
+
+// Re-points uplink to the first available standby broker after c has dropped, returning the new uplink.
+// Returns a nil connection if none could be reached, or the uplink was replaced by Dial in the meantime.
+func (e *EzIPC) failover(c *connection, err error) (*connection, error) {
+	if atomic.LoadUint32(&e.closed) == 1 {
+		return nil, ErrClosed
+	}
+	uplink, failed := e.currentUplink()
+	if uplink != c {
+		return nil, err
+	}
+	for _, socketf := range e.standby {
+		if socketf == failed {
+			continue
+		}
+		if c.closing() {
+			e.logf("Uplink %s shut down, failing over to %s.", failed, socketf)
+		} else {
+			e.logf("Uplink %s dropped (%s), failing over to %s.", failed, err, socketf)
+		}
+		if next, ferr := e.open(socketf); ferr == nil {
+			return next, nil
+		} else if uplink, _ = e.currentUplink(); uplink != c {
+			return nil, ferr
+		}
+	}
+	// Standby brokers may speak our version, but reconnecting to the same broker won't help.
+	if c.refused != nil {
+		return nil, c.refused
+	}
+	if e.reconnect_min > 0 {
+		return e.reconnect(c, failed, err)
+	}
+	return nil, err
+}
+
+// Dialer establishes a connection to addr, such as through a proxy or tunnel.
+type Dialer func(network, addr string) (net.Conn, error)
+
+// SetDialer sets the function used to connect in Dial and Listen, in place of net.Dial.
+func (e *EzIPC) SetDialer(d Dialer) {
+	e.dialer = d
+}
+
+// Prefix of addresses reached over TCP rather than a socket file.
+const tcpScheme = "tcp://"
+
+// Returns the network and address to dial or listen on, addr is a socket file unless prefixed with tcp://.
+func splitAddr(addr string) (network, address string) {
+	if strings.HasPrefix(addr, tcpScheme) {
+		return "tcp", strings.TrimPrefix(addr, tcpScheme)
+	}
+	return "unix", addr
+}
+
 // Creates socket connection to file(socketf) and communicates with othe processes, blocks for listeners, runs go routine for clients.
-func (e *EzIPC) open(socketf string) error {
-	conn, err := net.Dial("unix", socketf)
+// Dial and Listen wait on the broker to settle the handshake, the reciever then keeps the uplink should it drop.
+func (e *EzIPC) connect(socketf string) (err error) {
+	old, _ := e.currentUplink()
+	c, err := e.open(socketf)
 	if err != nil {
 		return err
 	}
+	if !e.startReciever() {
+		c.close()
+		e.restoreUplink(c, old)
+		return ErrClosed
+	}
+
+	// If this is a service, we'll block on the uplink once the handshake settles, if not push to background.
+	client := e.is_client
+	lost := make(chan error, 1)
+	go func() {
+		err := c.recieve()
+		c.setRecvErr(err)
+		// Connections closing before the handshake settles are reported by Dial or Listen.
+		if atomic.LoadUint32(&c.settled) != 1 {
+			c.handshakeDone(fmt.Errorf("Connection closed during handshake: %w", err))
+			lost <- nil
+			return
+		}
+		if client {
+			e.keepUplink(c, err)
+		}
+		lost <- err
+	}()
+	// Restore the previous uplink once the reciever is done with this one, so failover and reconnects carry on from it.
+	if err = c.awaitHandshake(); err != nil {
+		<-lost
+		e.restoreUplink(c, old)
+		return err
+	}
+	if client {
+		return nil
+	}
+	e.start()
+	return e.keepUplink(c, <-lost)
+}
+
+// Dials socketf and sends our handshake, making the connection our uplink without starting its reciever.
+func (e *EzIPC) open(socketf string) (*connection, error) {
+	conn, err := e.dial(socketf)
+	if err != nil {
+		return nil, err
+	}
 	c := e.addconnection(conn)
+	c.handshake = make(chan error, 1)
+	e.onConnect(c)
+
+	// Answer the listener's challenge, proving we hold the pre-shared key.
+	var answer string
+	if e.psk != nil {
+		if answer, err = c.pskAnswer(); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
 
+	e.acks.reset()
+	e.connMapLock.Lock()
+	old := e.uplink
 	e.socketf = socketf
 	e.uplink = c
+	e.connMapLock.Unlock()
+	atomic.StoreUint32(&e.connected, 1)
 
-	var done uint32
-	atomic.StoreUint32(&done, 1)
+	// Declare our codec to the peer.
+	c.codec = codecName(e.codec)
+	hs := &msg{Tag: 0, Dst: probeName}
+	hs.setHdr(hdrHandshake, "1")
+	hs.setHdr(hdrCodec, c.codec)
+	hs.setHdr(hdrInstance, e.instance)
+	declare(hs)
+	if e.psk != nil {
+		hs.setHdr(hdrPSK, answer)
+	}
+	if e.binary_framing {
+		hs.setHdr(hdrFraming, "binary")
+	}
+	if e.flow_window > 0 {
+		hs.setHdr(hdrWindow, strconv.Itoa(e.flow_window))
+	}
+	for k, v := range e.labels {
+		hs.setHdr(hdrLabel+k, v)
+	}
+	if err = c.send(hs); err == nil {
+		err = c.write(&msg{Tag: probeTag, Dst: probeName})
+	}
+	if err != nil {
+		c.close()
+		e.restoreUplink(c, old)
+		return nil, err
+	}
 
-	// If this is a service, we'll return the actual listener, if not push to background.
-	if !e.is_client {
-		return c.reciever()
-	} else {
-		go func() {
-			c.err = c.reciever()
-		}()
-		return nil
+	// Move calls pending on the previous uplink over.
+	if old != nil && old != c {
+		e.handoff(old, c)
 	}
+	return c, nil
 }
 
 // Closes connection
 func (c *connection) close() (err error) {
+	c.router.onDisconnect(c)
+
 	c.router.connMapLock.Lock()
 	for _, name := range c.routes {
-		delete(c.router.connMap, name)
+		c.router.removeRoute(name, c)
+	}
+	_, open := c.router.conns[c]
+	delete(c.router.conns, c)
+	if open {
+		atomic.AddInt64(&c.router.counters.connections, -1)
 	}
 	c.router.connMapLock.Unlock()
 
+	// Calls waiting on credit can no longer be sent.
+	if f := c.getFlow(); f != nil {
+		f.shut()
+	}
+
+	// Streams over the connection can no longer be read or written, and calls from it are abandoned.
+	// Calls to it fail right away, other than those which will be re-sent once the uplink fails over,
+	// and relays through it are dropped, so their buckets don't outlive either end.
+	e := c.router
+	resend := c == e.getUplink() && (len(e.standby) > 0 || e.reconnect_min > 0)
+	e.tagMapLock.Lock()
+	for tag, b := range e.tagMap {
+		if b.stream != nil && (b.src == c || b.dst == c) {
+			b.stream.finish(ErrClosed)
+		}
+		if b.cancel != nil && b.src == c {
+			b.cancel()
+		}
+		// Nobody is left to relay the reply to, let the handler know.
+		if b.flag == t_RELAY && b.src == c {
+			cancel := &msg{Tag: -tag}
+			cancel.setHdr(hdrCancel, "1")
+			b.dst.send(cancel)
+			e.useMem(-b.size)
+			e.dropTag(tag)
+			continue
+		}
+		if b.dst != c {
+			continue
+		}
+		switch b.flag {
+		case t_REQUEST:
+			if resend && b.req != nil {
+				continue
+			}
+			b.data = &msg{Tag: tag, Err: ErrClosed.Error()}
+			b.done <- struct{}{}
+			e.dropTag(tag)
+		case t_RELAY:
+			fail := &msg{Tag: tag, Err: ErrClosed.Error()}
+			fail.setHdr(hdrReply, "1")
+			b.src.send(fail)
+			b.src.relays--
+			e.useMem(-b.size)
+			e.dropTag(tag)
+		}
+	}
+	e.tagMapLock.Unlock()
+
+	if open && c.accepted {
+		c.router.connClosed(c)
+	}
+
 	err = c.conn.Close()
 	return
 }
 
-// Sends *msg to specific connection.
+// Time allowed for frames waiting on flow control credit to be flushed when closing gracefully.
+const flushTimeout = time.Second
+
+// Determines if the connection is being closed intentionally.
+func (c *connection) closing() bool {
+	return atomic.LoadUint32(&c.goodbye) == 1
+}
+
+// Flushes frames waiting on credit and says goodbye to the peer before closing, for intentional shutdowns.
+// Error paths use close, which closes immediately.
+func (c *connection) closeGraceful() error {
+	if f := c.getFlow(); f != nil {
+		deadline := time.Now().Add(flushTimeout)
+		for time.Now().Before(deadline) {
+			f.lock.Lock()
+			queued := len(f.queue)
+			avail := f.avail
+			f.lock.Unlock()
+			if queued == 0 {
+				break
+			}
+			select {
+			case <-avail:
+			case <-time.After(time.Until(deadline)):
+			}
+		}
+	}
+
+	atomic.StoreUint32(&c.goodbye, 1)
+	// A peer which stopped reading can't hold up closing, writes still blocked on it fail once the deadline passes.
+	c.conn.SetWriteDeadline(time.Now().Add(flushTimeout))
+	bye := &msg{Tag: 0, Dst: probeName}
+	bye.setHdr(hdrGoodbye, "1")
+	c.write(bye)
+	return c.close()
+}
+
+// Sends *msg to specific connection, frames other than tag 0 wait on credit when flow control is in use.
 func (c *connection) send(req *msg) (err error) {
+	if f := c.getFlow(); f != nil && req.Tag != 0 && f.hold(req) {
+		return nil
+	}
+	return c.write(req)
+}
+
+// Writes *msg to connection.
+func (c *connection) write(req *msg) (err error) {
+	// Compressed before taking the send lock, so writes to the connection aren't held up behind it.
+	va1, va2, hdr := c.router.compressFields(req)
 	c.sendLock.Lock()
 	defer c.sendLock.Unlock()
-	_, err = c.conn.Write([]byte(
-		fmt.Sprintf("%d\x1f%s\x1f%s\x1f%s\x1f%s\x04",
-			req.Tag, req.Dst, req.Err, req.Va1, req.Va2)))
+	c.debugFrame("Sent to", req)
+	blob := req.Blob
+	// Payloads are encrypted after being compressed.
+	if c.router.psk != nil && req.Tag != 0 {
+		va1, va2, blob, hdr, err = c.sealFields(req, va1, va2, hdr)
+	}
+	if err == nil && c.isBinary() {
+		var frame []byte
+		if frame, err = encodeBinary(req, va1, va2, blob, hdr); err == nil {
+			_, err = c.conn.Write(frame)
+		}
+	} else if err == nil {
+		err = c.writeText(req, va1, va2, blob, hdr)
+	}
+	if err != nil {
+		atomic.AddUint64(&c.router.counters.send_errors, 1)
+	}
 	if err != nil && req.Err != "" {
 		return
 	}
 	if err != nil {
-		if req.conn == nil {
+		// Local functions have no connection to send the error back over.
+		if req.conn == nil || req.conn.conn == nil {
 			return ErrClosed
 		}
 		send_err(req, ErrClosed)
@@ -125,16 +785,47 @@ func (c *connection) send(req *msg) (err error) {
 	return
 }
 
+// Writes req using delimited text framing.
+func (c *connection) writeText(req *msg, va1, va2 string, blob []byte, hdr map[string]string) (err error) {
+	var ext []byte
+	if len(blob) > 0 || len(hdr) > 0 {
+		ext = append([]byte("\x1f"), escape(blob)...)
+	}
+	if len(hdr) > 0 {
+		ext = append(append(ext, '\x1f'), encodeHdr(hdr)...)
+	}
+	// Names and errors are escaped, error text from handlers may contain delimiters.
+	_, err = c.conn.Write([]byte(
+		fmt.Sprintf("%d\x1f%s\x1f%s\x1f%s\x1f%s%s\x04",
+			req.Tag, escape([]byte(req.Dst)), escape([]byte(req.Err)), va1, va2, ext)))
+	return
+}
+
+// Runs the reciever of c, which must have been counted by startReciever.
+func (c *connection) recieve() error {
+	defer c.router.recieverDone()
+	return c.reciever()
+}
+
 // Listens to *connection, decodes msg's and passes them to switchboard.
 func (c *connection) reciever() (err error) {
-	inbuf := make([]byte, 1024)
-	input := inbuf[0:]
+	r := c.rd
+	if r == nil {
+		r = bufio.NewReader(c.conn)
+	}
 
-	var sz int
-	var pbuf []byte
+	max_frame := c.router.max_frame
+	if max_frame <= 0 {
+		max_frame = defaultMaxFrameSize
+	}
+	// Compressed fields inflate to at most the field limit, or the frame limit when there is none.
+	max_inflate := c.router.max_field
+	if max_inflate <= 0 {
+		max_inflate = max_frame
+	}
 
-	// Register Names
-	if c.router.uplink != nil {
+	// Announce every name registered with us to a new uplink, so registrations survive a reconnect by Dial.
+	if c == c.router.getUplink() {
 		c.router.connMapLock.RLock()
 		for name, _ := range c.router.connMap {
 			c.send(&msg{
@@ -145,80 +836,151 @@ func (c *connection) reciever() (err error) {
 		c.router.connMapLock.RUnlock()
 	}
 
-	// Finds field delimeters in byte stream.
-	findSplit := func(in []byte) (n int) {
-		for _, ch := range in {
-			if ch == '\x04' {
-				return n
-			}
-			n++
-		}
-		return n
-	}
-
-	// Decodes bytes to message.
-	decMessage := func(in []byte) (out *msg, err error) {
-		msgPart := strings.Split(string(in), "\x1f")
-
-		if len(msgPart) < 5 {
-			return nil, fmt.Errorf("Incomplete or corrupted message: %s", string(in))
-		}
-
-		tag, err := strconv.ParseInt(msgPart[0], 0, 32)
-		if err != nil {
-			return
-		}
-		out = &msg{
-			Tag: int32(tag),
-			Dst: msgPart[1],
-			Err: msgPart[2],
-			Va1: msgPart[3],
-			Va2: msgPart[4],
-		}
-		return
-	}
+	var frames int
 
 	// Reciever loop for incoming messages.
 	for {
-		for n, _ := range input {
-			input[n] = 0
+		// Yield so a flood of frames already read doesn't monopolize the scheduler.
+		if r.Buffered() == 0 {
+			frames = 0
+		} else if c.router.max_frames > 0 && frames >= c.router.max_frames {
+			runtime.Gosched()
+			frames = 0
 		}
-		input = inbuf[0:]
+		frames++
 
-		sz, err = c.conn.Read(input)
+		var request *msg
+		var corrupt bool
+
+		// Peers may use either framing, binary frames are marked by their lead byte.
+		var lead []byte
+		if lead, err = r.Peek(1); err == nil && lead[0] == binaryFrame {
+			request, corrupt, err = readBinary(r, max_frame)
+		} else if err == nil {
+			var frame []byte
+			if frame, err = c.readFrame(r, max_frame); err == nil {
+				request, err = decodeText(frame)
+				corrupt = err != nil
+			}
+		}
+		// Payloads are decrypted before being decompressed.
+		if err == nil {
+			if err = c.unseal(request); err == nil {
+				err = request.decompress(max_inflate)
+			}
+			corrupt = err != nil
+		}
 		if err != nil {
 			c.close()
-			if err == io.EOF {
+			switch {
+			case err == io.EOF:
+				err = ErrClosed
+			case c.closing():
+				// Peer said goodbye, errors closing are expected.
 				err = ErrClosed
+			case errors.Is(err, ErrPSKMismatch):
+				c.router.logf("Closing connection %s: %s", c.id, err)
+			case errors.Is(err, ErrTooLarge):
+				atomic.AddUint64(&c.router.counters.decode_errors, 1)
+				c.router.logf("Closing connection %s: %s", c.id, err)
+			case corrupt:
+				atomic.AddUint64(&c.router.counters.decode_errors, 1)
+			default:
+				atomic.AddUint64(&c.router.counters.conn_resets, 1)
 			}
 			return
 		}
 
-		pbuf = append(pbuf, input[0:sz]...)
+		request.conn = c
+		c.debugFrame("Recieved from", request)
 
-		// \x1f used as a delimeter between messages.
-		for bytes.Contains(pbuf, []byte("\x04")) {
-			s := findSplit(pbuf)
+		// Credit is handled here rather than route, so it is never held up behind router locks.
+		if request.Tag == 0 && request.hdr(hdrCredit) != "" {
+			if c.getFlow() != nil {
+				n, _ := strconv.Atoi(request.hdr(hdrCredit))
+				c.grant(n)
+			}
+		} else {
+			c.router.route(request)
+			// Stop reading from the peer while calls relayed to a destination slow to grant credit back up,
+			// so the peer feels backpressure rather than us queueing its calls without bound.
+			if request.relay != nil {
+				if f := request.relay.getFlow(); f != nil {
+					f.backlog()
+				}
+			}
+			if c.getFlow() != nil && request.Tag != 0 && request.Tag != probeTag {
+				c.consumed()
+			}
+		}
+	}
+	return
+}
 
-			var request *msg
+// Decodes a frame of delimited text framing to message.
+func decodeText(in []byte) (out *msg, err error) {
+	msgPart := strings.Split(string(in), "\x1f")
 
-			request, err = decMessage(pbuf[0:s])
-			if err != nil {
-				c.close()
-				return
-			}
+	if len(msgPart) < 5 {
+		return nil, fmt.Errorf("Incomplete or corrupted message: %s", string(in))
+	}
 
-			request.conn = c
-			c.router.route(request)
+	tag, err := strconv.ParseInt(msgPart[0], 0, 32)
+	if err != nil {
+		return
+	}
+	out = &msg{
+		Tag: int32(tag),
+		Dst: string(unescape([]byte(msgPart[1]))),
+		Err: string(unescape([]byte(msgPart[2]))),
+		Va1: msgPart[3],
+		Va2: msgPart[4],
+	}
+	if len(msgPart) > 5 {
+		out.Blob = unescape([]byte(msgPart[5]))
+	}
+	if len(msgPart) > 6 {
+		out.Hdr = decodeHdr([]byte(msgPart[6]))
+	}
+	return
+}
 
-			if len(pbuf)-s > 1 {
-				pbuf = pbuf[s+1:]
-				continue
+// Maximum size of a frame unless changed with SetMaxFrameSize.
+const defaultMaxFrameSize = 4 << 20
+
+// SetMaxFrameSize closes connections sending a frame larger than n bytes, 0 restores the default of 4MB.
+// Keeps a peer which never terminates a frame from exhausting memory.
+func (e *EzIPC) SetMaxFrameSize(n int) {
+	e.max_frame = n
+}
+
+// Reads a frame terminated by \x04, failing once it exceeds max bytes.
+// Frames larger than the read buffer count toward the memory limit while being read.
+func (c *connection) readFrame(r *bufio.Reader, max int) (frame []byte, err error) {
+	var held int
+	defer func() { c.router.useMem(-held) }()
+
+	for {
+		var chunk []byte
+		chunk, err = r.ReadSlice('\x04')
+		if len(frame)+len(chunk) > max+1 {
+			return nil, fmt.Errorf("Frame exceeds maximum size of %d bytes: %w", max, ErrTooLarge)
+		}
+		switch err {
+		case nil:
+			if frame == nil {
+				return chunk[:len(chunk)-1], nil
 			}
-			pbuf = nil
+			frame = append(frame, chunk...)
+			return frame[:len(frame)-1], nil
+		case bufio.ErrBufferFull:
+			frame = append(frame, chunk...)
+			c.router.useMem(len(chunk))
+			held += len(chunk)
+		default:
+			return nil, err
 		}
 	}
-	return
 }
 
 // Message Packet.
@@ -228,19 +990,269 @@ type msg struct {
 	Err  string
 	Va1  string
 	Va2  string
+	Blob []byte
+	Hdr  map[string]string
 	conn *connection
+	// Call may be safely re-sent, not sent over the wire.
+	idempotent bool
+	// Base64 decoded Va2, once decoded.
+	va2 []byte
+	// Recieves log output of the handler, not sent over the wire.
+	log func([]byte)
+	// Handler's end of a stream opened by the message, not sent over the wire.
+	stream *stream
+	// Done once the caller gives up, passed to handlers taking a context, not sent over the wire.
+	ctx context.Context
+	// Connection a call or notification was relayed to, not sent over the wire.
+	relay *connection
+}
+
+// Header keys.
+const (
+	// Connection ID a call is directed to, bypassing name lookup.
+	hdrTo = "to"
+	// Marks message as a reply, so late replies are never mistaken for requests.
+	hdrReply = "re"
+	// Marks tag 0 message as the handshake sent by the dialing side.
+	hdrHandshake = "hs"
+	// Codec used by the sender of the handshake.
+	hdrCodec = "codec"
+	// Marks tag 0 message as the acknowledgement of a handshake.
+	hdrHandshakeAck = "hsack"
+	// Flow control window of the sender of the handshake or acknowledgement.
+	hdrWindow = "window"
+	// Flow control credit granted by the sender.
+	hdrCredit = "credit"
+	// Status code of a StatusError returned by a handler.
+	hdrStatus = "status"
+	// Prefix of labels declared in the handshake.
+	hdrLabel = "label."
+	// Name whose registration is acknowledged by the broker.
+	hdrRegAck = "regack"
+	// Flags a compressed argument or reply.
+	hdrZipVa1 = "z1"
+	hdrZipVa2 = "z2"
+	// Marks a busyCheck as cancelling the call.
+	hdrCancel = "cancel"
+	// Marks log output of a handler, carried in the blob.
+	hdrLog = "log"
+	// Instance of the router sending a handshake.
+	hdrInstance = "inst"
+	// Framing requested in the handshake, and agreed to in its acknowledgement.
+	hdrFraming = "framing"
+	// Tells the peer the connection is being closed intentionally.
+	hdrGoodbye = "bye"
+	// Withdraws a registration.
+	hdrUnregister = "unreg"
+	// Challenge and proofs exchanged in the handshake to show each end holds the pre-shared key, and the flag of payloads encrypted with it.
+	hdrPSK    = "psk"
+	hdrSealed = "sealed"
+	// Marks an error as the argument being rejected by a validator.
+	hdrInvalid = "invalid"
+	// Marks an error as a panic recovered from the handler.
+	hdrPanic = "panic"
+	// Marks an error as returned by the handler, and names the method it was returned by when it isn't the one called.
+	hdrRemote = "remote"
+	hdrMethod = "method"
+	// Newest and oldest protocol versions spoken by the sender of the handshake or acknowledgement.
+	hdrProto    = "proto"
+	hdrProtoMin = "proto-min"
+	// Kind of stream frame, the opening of a stream or its data, acknowledgement or end.
+	hdrStream = "stream"
+)
+
+// Returns header value for key.
+func (m *msg) hdr(key string) string {
+	return m.Hdr[key]
+}
+
+// Sets header key to value.
+func (m *msg) setHdr(key, value string) {
+	if m.Hdr == nil {
+		m.Hdr = make(map[string]string)
+	}
+	m.Hdr[key] = value
+}
+
+// Bytes that collide with frame delimiters are escaped with \x1b followed by the byte xor 0x20.
+const escByte = '\x1b'
+
+// Escapes delimiters in data so it can be carried raw in a frame.
+func escape(in []byte) (out []byte) {
+	out = make([]byte, 0, len(in))
+	for _, ch := range in {
+		switch ch {
+		case '\x04', '\x1d', '\x1e', '\x1f', escByte:
+			out = append(out, escByte, ch^0x20)
+		default:
+			out = append(out, ch)
+		}
+	}
+	return
+}
+
+// Reverses escape.
+func unescape(in []byte) (out []byte) {
+	out = make([]byte, 0, len(in))
+	for i := 0; i < len(in); i++ {
+		if in[i] == escByte && i+1 < len(in) {
+			i++
+			out = append(out, in[i]^0x20)
+			continue
+		}
+		out = append(out, in[i])
+	}
+	return
+}
+
+// Encodes header as escaped key\x1dvalue pairs seperated by \x1e.
+func encodeHdr(hdr map[string]string) (out []byte) {
+	for k, v := range hdr {
+		if len(out) > 0 {
+			out = append(out, '\x1e')
+		}
+		out = append(out, escape([]byte(k))...)
+		out = append(out, '\x1d')
+		out = append(out, escape([]byte(v))...)
+	}
+	return
+}
+
+// Reverses encodeHdr.
+func decodeHdr(in []byte) map[string]string {
+	hdr := make(map[string]string)
+	for _, pair := range bytes.Split(in, []byte("\x1e")) {
+		kv := bytes.SplitN(pair, []byte("\x1d"), 2)
+		if len(kv) != 2 {
+			continue
+		}
+		hdr[string(unescape(kv[0]))] = string(unescape(kv[1]))
+	}
+	return hdr
 }
 
 // Sends error message to switchboard.
 func send_err(req *msg, err error) {
 	req.Va1 = ""
 	req.Va2 = ""
+	req.Blob = nil
 	req.Err = err.Error()
+	// Errors answering a stream's open are its reply, not a frame of the stream.
+	delete(req.Hdr, hdrStream)
+	req.setHdr(hdrReply, "1")
 	if req.conn != nil {
 		req.conn.send(req)
 	}
 }
 
+// Handles registrations and other frames on tag 0, returning the writes to peers they call for, if any.
+// Must be called with connMapLock held, the writes are made once it is released.
+func (e *EzIPC) control(req *msg) (after func()) {
+	c := req.conn
+	if req.hdr(hdrHandshake) != "" {
+		c.codec = req.hdr(hdrCodec)
+		c.instance = req.hdr(hdrInstance)
+		c.setFlow(req.hdr(hdrWindow))
+		for k, v := range req.Hdr {
+			if strings.HasPrefix(k, hdrLabel) {
+				if c.labels == nil {
+					c.labels = make(map[string]string)
+				}
+				c.labels[strings.TrimPrefix(k, hdrLabel)] = v
+			}
+		}
+		// Refuse peers with no protocol version in common with us.
+		version, err := negotiate(declared(req))
+		if err != nil {
+			e.logf("Connection %s refused: %s", c.id, err)
+			ack := &msg{Tag: 0, Err: err.Error()}
+			ack.setHdr(hdrHandshakeAck, "1")
+			declare(ack)
+			if c.psk_proof != "" {
+				ack.setHdr(hdrPSK, c.psk_proof)
+			}
+			return func() {
+				c.write(ack)
+				atomic.StoreUint32(&c.goodbye, 1)
+				c.conn.Close()
+			}
+		}
+		c.version = version
+		// Acknowledge handshake with our protocol version to peers declaring theirs, with our window when flow control is in use,
+		// and agree to binary framing if requested.
+		binary := req.hdr(hdrFraming) == "binary"
+		if req.hdr(hdrProto) == "" && c.getFlow() == nil && !binary {
+			return nil
+		}
+		ack := &msg{Tag: 0}
+		ack.setHdr(hdrHandshakeAck, "1")
+		declare(ack)
+		if c.psk_proof != "" {
+			ack.setHdr(hdrPSK, c.psk_proof)
+		}
+		if c.getFlow() != nil {
+			ack.setHdr(hdrWindow, strconv.Itoa(e.flow_window))
+		}
+		if binary {
+			ack.setHdr(hdrFraming, "binary")
+		}
+		return func() {
+			c.write(ack)
+			if binary {
+				c.useBinary()
+			}
+		}
+	}
+	if req.hdr(hdrGoodbye) != "" {
+		atomic.StoreUint32(&c.goodbye, 1)
+		e.logf("Connection %s closing at peer's request.", c.id)
+		return nil
+	}
+	if req.hdr(hdrHandshakeAck) != "" {
+		return func() {
+			c.setFlow(req.hdr(hdrWindow))
+			if req.hdr(hdrFraming) == "binary" && e.binary_framing {
+				c.useBinary()
+			}
+			c.handshakeAcked(req)
+		}
+	}
+	if req.hdr(hdrUnregister) != "" {
+		return e.unroute(req.Dst, c)
+	}
+	if name := req.hdr(hdrRegAck); name != "" {
+		if c == e.uplink {
+			e.acks.ack(name, req.Err)
+		}
+		return nil
+	}
+	// Frames naming no function, or the probe, are control frames we don't understand, which register nothing.
+	if req.Dst == "" || req.Dst == probeName {
+		return nil
+	}
+	err := e.addRoute(req.Dst, c)
+	if err != nil {
+		e.logf("Registration of %s by connection %s refused: %s", req.Dst, c.id, err)
+	} else if e.Debug {
+		e.logf("Route %s announced by connection %s.", req.Dst, c.id)
+	}
+	up := e.uplink
+	return func() {
+		// Acknowledge registrations recieved from peers.
+		if c.conn != nil {
+			ack := &msg{Tag: 0}
+			ack.setHdr(hdrRegAck, req.Dst)
+			if err != nil {
+				ack.Err = err.Error()
+			}
+			c.write(ack)
+		}
+		if err == nil && up != nil && c != up {
+			up.send(req)
+		}
+	}
+}
+
 // Reads each incoming message, records tag, process and sends to appropriate destination.
 func (e *EzIPC) route(req *msg) {
 	var tag int32
@@ -252,17 +1264,30 @@ func (e *EzIPC) route(req *msg) {
 		tag = tag * -1
 	}
 
-	// Register functions with reserved tag=0.
+	// Register functions with reserved tag=0, writing to peers once connMapLock is released.
 	if tag == 0 {
 		e.connMapLock.Lock()
-		defer e.connMapLock.Unlock()
-		e.connMap[req.Dst] = req.conn
-		req.conn.routes = append(req.conn.routes, req.Dst)
-		if e.uplink != nil && req.conn != e.uplink {
-			e.uplink.send(req)
+		after := e.control(req)
+		e.connMapLock.Unlock()
+		if after != nil {
+			after()
+		}
+		return
+	} else if tag == probeTag {
+		// Answer to the probe following our handshake, from a broker predating protocol versions.
+		if !req.conn.accepted {
+			req.conn.probed()
 		}
 		return
+	} else if req.Tag == notifyTag {
+		// Notifications expect no reply, so are never tracked.
+		e.routeNotify(req)
+		return
 	} else {
+		// Registering a name from the provider takes connMapLock, so is done before taking tagMapLock.
+		if tag > 0 && req.hdr(hdrReply) == "" && req.hdr(hdrTo) == "" && !e.routable(req.Dst) {
+			e.provide(req.Dst)
+		}
 		e.tagMapLock.Lock()
 		defer e.tagMapLock.Unlock()
 		target = e.tagMap[tag]
@@ -272,12 +1297,30 @@ func (e *EzIPC) route(req *msg) {
 	if target != nil {
 		switch target.flag {
 		case t_REQUEST:
+			// Stream frames from the handler, the reply is still to come.
+			if kind := req.hdr(hdrStream); kind != "" {
+				if req.conn == target.dst && target.stream != nil {
+					target.stream.recv(kind, req.Blob)
+				}
+				return
+			}
+			// Log output from the handler, the reply is still to come.
+			if req.hdr(hdrLog) != "" {
+				if req.conn == target.dst && target.log != nil {
+					target.logs = append(target.logs, req.Blob)
+					select {
+					case target.logged <- struct{}{}:
+					default:
+					}
+				}
+				return
+			}
 			// If this a return message handle it.
 			if req.conn == target.dst || req.conn == nil {
 				if bucket, ok := e.tagMap[req.Tag]; ok {
 					bucket.data = req
 					bucket.done <- struct{}{}
-					delete(e.tagMap, req.Tag)
+					e.dropTag(req.Tag)
 					return
 				}
 			} else {
@@ -288,31 +1331,115 @@ func (e *EzIPC) route(req *msg) {
 			// Relay message to end point.
 			if req.conn == target.src {
 				target.dst.send(req)
+				// Caller gave up, stop relaying.
+				if req.Tag < 0 && req.hdr(hdrCancel) != "" {
+					target.src.relays--
+					e.useMem(-target.size)
+					e.dropTag(tag)
+				}
+			} else if req.conn == target.dst && (req.hdr(hdrLog) != "" || req.hdr(hdrStream) != "") {
+				target.src.send(req)
 			} else if req.conn == target.dst {
+				// Handler asked to be relieved of this call, try another provider.
+				if req.Tag > 0 && req.Err == ErrTryAgain.Error() && target.req != nil && len(target.tried) < maxTryAgain {
+					if next := e.lookup(req.Dst, target.tried...); next != nil {
+						target.dst = next
+						target.tried = append(target.tried, next)
+						retry := *target.req
+						next.send(&retry)
+						return
+					}
+				}
 				target.src.send(req)
-				delete(e.tagMap, tag)
+				target.src.relays--
+				e.useMem(-target.size)
+				e.trace("relay", req.Dst, tag, target.created, req.Err, target.src)
+				e.dropTag(tag)
 			} else {
 				send_err(req, errBadTag)
 			}
 		default:
 			if req.conn == target.src {
+				// Caller gave up, let the handler know.
+				if req.Tag < 0 && req.hdr(hdrCancel) != "" && target.cancel != nil {
+					target.cancel()
+				}
+				// Stream frames from the caller, for the handler's end of the stream.
+				if kind := req.hdr(hdrStream); kind != "" && target.stream != nil {
+					target.stream.recv(kind, req.Blob)
+				}
 				return
 			} else {
 				send_err(req, errBadTag)
 			}
 		}
 	} else {
+		// busyCheck or reply for a call that is no longer pending, nothing to do.
+		if req.Tag < 0 || req.hdr(hdrReply) != "" {
+			return
+		}
+		// Stream frames for a stream that has ended.
+		if kind := req.hdr(hdrStream); kind != "" && kind != streamOpen {
+			return
+		}
+
+		// Oversized blobs are refused before anything is created for the call, so they are neither executed nor relayed.
+		if e.max_msg_size > 0 && len(req.Blob) > e.max_msg_size {
+			send_err(req, ErrTooLarge)
+			return
+		}
+
+		// Rewrite deprecated names.
+		if e.rewriter != nil {
+			if name := e.rewriter(req.Dst); name != req.Dst {
+				e.logf("Deprecated name %s called, routing to %s.", req.Dst, name)
+				req.Dst = name
+			}
+		}
+
 		// Create local tag after looking up destination.
-		e.connMapLock.RLock()
-		dest := e.connMap[req.Dst]
-		e.connMapLock.RUnlock()
+		var dest *connection
+		to := req.hdr(hdrTo)
+		if to != "" {
+			dest = e.connByID(to, req.Dst)
+			delete(req.Hdr, hdrTo)
+		} else {
+			dest = e.lookup(req.Dst)
+			// Let a higher tier broker resolve names we don't provide.
+			if up := e.getUplink(); dest == nil && !e.no_fallback && up != nil && req.conn != up {
+				dest = up
+			}
+		}
 		if dest == nil {
-			send_err(req, ErrFail)
+			if to != "" {
+				send_err(req, ErrUnknownConn)
+			} else {
+				send_err(req, ErrFail)
+			}
+			return
+		}
+
+		// Both ends of the call must use the same codec.
+		if req.conn != nil && req.conn.codecName() != dest.codecName() {
+			send_err(req, ErrCodecMismatch)
+			return
+		}
+
+		// Keep a single source from flooding us with relays.
+		if dest.exec == nil && e.max_relays > 0 && req.conn.relays >= e.max_relays {
+			send_err(req, ErrBusy)
+			return
+		}
+
+		// Shed load once pending payloads reach the memory limit.
+		size := req.size()
+		if !e.reserveMem(size) {
+			send_err(req, ErrBusy)
 			return
 		}
 
 		// Create bucket for handling end point or relay.
-		nb := new(bucket)
+		nb := &bucket{created: time.Now(), size: size}
 		if dest.exec != nil {
 			nb.flag = t_EXEC
 			nb.src = req.conn
@@ -320,19 +1447,55 @@ func (e *EzIPC) route(req *msg) {
 			nb.flag = t_RELAY
 			nb.src = req.conn
 			nb.dst = dest
+			req.conn.relays++
+			// Retain request in case the call must be rerouted.
+			if to == "" {
+				nb.req = &msg{
+					Tag:  req.Tag,
+					Dst:  req.Dst,
+					Va1:  req.Va1,
+					Va2:  req.Va2,
+					Blob: req.Blob,
+					Hdr:  req.Hdr,
+				}
+				nb.tried = []*connection{dest}
+			}
 		}
 
-		e.tagMap[tag] = nb
+		e.setTag(tag, nb)
 
 		// Execute local function as go routine if possible.
 		if dest.exec != nil {
-			go func(tag int32, req *msg, e *EzIPC) {
-				req.conn.send(dest.exec(req))
+			ctx, cancel := context.WithCancel(context.Background())
+			nb.cancel = cancel
+			req.ctx = ctx
+			if req.hdr(hdrStream) == streamOpen {
+				nb.stream = newHandlerStream(req, req.conn)
+				req.stream = nb.stream
+			}
+			atomic.AddInt64(&dest.inflight, 1)
+			req.conn.runExec(func() {
+				defer atomic.AddInt64(&dest.inflight, -1)
+				defer cancel()
+				name := req.Dst
+				src := req.conn
+				start := time.Now()
+				resp := e.execute(dest, req)
+				resp.setHdr(hdrReply, "1")
+				e.logSlow("exec", name, time.Since(start))
+				if e.max_msg_size > 0 && len(resp.Blob) > e.max_msg_size {
+					send_err(resp, ErrTooLarge)
+				} else {
+					req.conn.send(resp)
+				}
+				e.trace("exec", name, tag, start, resp.Err, src)
 				e.tagMapLock.Lock()
 				defer e.tagMapLock.Unlock()
-				delete(e.tagMap, tag)
-			}(tag, req, e)
+				e.dropTag(tag)
+				e.useMem(-size)
+			})
 		} else {
+			req.relay = dest
 			dest.send(req)
 		}
 	}
@@ -340,58 +1503,287 @@ func (e *EzIPC) route(req *msg) {
 
 }
 
+// Re-sends idempotent calls pending on old over c, failing the rest with ErrClosed.
+func (e *EzIPC) handoff(old *connection, c *connection) {
+	e.tagMapLock.Lock()
+	defer e.tagMapLock.Unlock()
+
+	for tag, b := range e.tagMap {
+		if b.flag != t_REQUEST || b.dst != old {
+			continue
+		}
+		if b.req != nil {
+			b.dst = c
+			c.send(b.req)
+			continue
+		}
+		b.data = &msg{Tag: tag, Err: ErrClosed.Error()}
+		b.done <- struct{}{}
+		e.dropTag(tag)
+	}
+}
+
+// Returns the preferred connection for name, skipping any connections in skip.
+// Builtin functions are returned only when no connection provides name.
+func (e *EzIPC) lookup(name string, skip ...*connection) *connection {
+	e.connMapLock.RLock()
+	defer e.connMapLock.RUnlock()
+
+	conns := e.connMap[name]
+	if len(conns) == 0 && len(skip) == 0 {
+		return e.builtins[name]
+	}
+	var candidates []*connection
+	for i := len(conns) - 1; i >= 0; i-- {
+		var skipped bool
+		for _, c := range skip {
+			if conns[i] == c {
+				skipped = true
+				break
+			}
+		}
+		if !skipped && atomic.LoadUint32(&conns[i].draining) == 0 {
+			candidates = append(candidates, conns[i])
+		}
+	}
+	if c := e.versions.pick(name, candidates, &e.rr); c != nil {
+		return c
+	}
+	if e.dup_policy == RouteRoundRobin {
+		return e.rr.next(name, candidates)
+	}
+	if len(candidates) > 0 {
+		return candidates[0]
+	}
+	return nil
+}
+
+// Reports if anything is registered under name, without picking a connection as lookup does.
+func (e *EzIPC) routable(name string) bool {
+	e.connMapLock.RLock()
+	defer e.connMapLock.RUnlock()
+	return len(e.connMap[name]) > 0 || e.builtins[name] != nil
+}
+
+// Returns connection with id to direct a call of name to, whether a network connection or a locally registered function.
+// Builtin names directed at a locally registered function are answered by the router itself.
+func (e *EzIPC) connByID(id string, name string) *connection {
+	if b := e.builtins[name]; b != nil {
+		if c := e.connByID(id, ""); c != nil && c.exec != nil {
+			return b
+		}
+	}
+
+	e.connMapLock.RLock()
+	defer e.connMapLock.RUnlock()
+
+	for c := range e.conns {
+		if c.id == id {
+			return c
+		}
+	}
+	for _, conns := range e.connMap {
+		for _, c := range conns {
+			if c.id == id {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// Removes c as a provider of name, connMapLock must be held.
+func (e *EzIPC) removeRoute(name string, c *connection) {
+	conns := e.connMap[name]
+	for i := range conns {
+		if conns[i] == c {
+			conns = append(conns[:i:i], conns[i+1:]...)
+			e.countLocal(c, -1)
+			break
+		}
+	}
+	if len(conns) == 0 {
+		delete(e.connMap, name)
+	} else {
+		e.connMap[name] = conns
+	}
+	atomic.StoreInt64(&e.counters.routes, int64(len(e.connMap)))
+}
+
 // Dial is the client function of EzIPC, it opens a connection to the socket file.
 func (e *EzIPC) Dial(socketf string) error {
 	e.is_client = true
-	return e.open(socketf)
+	return e.connect(socketf)
+}
+
+// DialTCP operates as Dial, connecting to a broker listening on TCP address addr, such as "host:port".
+// Addresses passed to Dial, Listen or SetStandby may also be given as "tcp://host:port".
+func (e *EzIPC) DialTCP(addr string) error {
+	return e.Dial(tcpScheme + addr)
+}
+
+// DialWithLabels operates as Dial, declaring labels to the broker such as region or version.
+// The labels are kept and declared again should the connection fail over.
+func (e *EzIPC) DialWithLabels(labels map[string]string, socketf string) error {
+	e.labels = labels
+	return e.Dial(socketf)
+}
+
+// DialWithCallTimeout operates as Dial, with calls sent over the connection timing out after d unless the call sets its own deadline.
+// Deadlines take precedence in the order: per call, per connection, then the global default of SetCallTimeout.
+func (e *EzIPC) DialWithCallTimeout(socketf string, d time.Duration) error {
+	e.uplink_timeout = d
+	return e.Dial(socketf)
+}
+
+// SetCallTimeout sets the global default deadline for calls, which do not otherwise have one, 0 waits indefinitely.
+func (e *EzIPC) SetCallTimeout(d time.Duration) {
+	e.call_timeout = d
+}
+
+// Started returns a channel closed once Listen is serving, whether accepting connections or connected to an existing broker.
+func (e *EzIPC) Started() <-chan struct{} {
+	return e.started
+}
+
+// Signals Started.
+func (e *EzIPC) start() {
+	e.started_once.Do(func() { close(e.started) })
 }
 
 // Listens is the server function of EzIPC, it opens a connection and blocks while listening for requests.
+// On Linux, a socketf such as "@myservice" names an abstract socket, which has no file to clean up or set permissions on.
+// An abstract socket vanishes once the last listener and connection using it close, so clients cannot reach a broker that has exited.
 func (e *EzIPC) Listen(socketf string) (err error) {
 	e.is_client = false
 
 	// Attempt to open socket file, if this works, stop here and serve.
-	err = e.open(socketf)
-	if err == nil || !strings.Contains(err.Error(), "connection refused") && !strings.Contains(err.Error(), "no such file or directory") {
+	err = e.connect(socketf)
+	if err == nil || !strings.Contains(err.Error(), "connection refused") && !unservedLocal(err) {
 		return err
 	}
 
+	e.connMapLock.Lock()
 	e.socketf = socketf
+	e.connMapLock.Unlock()
 
-	// Clean out old socket files.
-	s_split := strings.Split(socketf, "/")
-	if len(s_split) == 0 {
-		return fmt.Errorf("%s: incomplete path to socket file.", socketf)
-	}
-	sfile_name := s_split[len(s_split)-1]
-	path := strings.Join(s_split[0:len(s_split)-1], "/")
-
-	files, err := ioutil.ReadDir(path)
-	if err != nil {
-		return
-	}
-	for _, file := range files {
-		fname := file.Name()
-		if strings.Contains(fname, sfile_name) {
-			os.Remove(path + "/" + fname)
+	var l net.Listener
+	if network, addr := splitAddr(socketf); network == "unix" {
+		// Clean out a stale socket file left behind by a previous broker.
+		if !e.no_cleanup {
+			cleanupLocal(addr)
 		}
+		l, err = listenLocal(addr)
+	} else {
+		l, err = net.Listen(network, addr)
 	}
-
-	l, err := net.Listen("unix", socketf)
 	if err != nil {
 		return err
 	}
 
+	return e.ListenWith(l)
+}
+
+// ListenTCP operates as Listen, serving on TCP address addr, such as ":4100".
+func (e *EzIPC) ListenTCP(addr string) error {
+	return e.Listen(tcpScheme + addr)
+}
+
+// ListenWith serves requests on an existing listener, blocking until the listener is closed.
+func (e *EzIPC) ListenWith(l net.Listener) error {
+	e.is_client = false
+	// A listener arriving once Close or Drain has run would never be closed.
+	e.recv_lock.Lock()
+	if atomic.LoadUint32(&e.closed) == 1 || atomic.LoadUint32(&e.draining) == 1 {
+		e.recv_lock.Unlock()
+		l.Close()
+		return ErrClosed
+	}
+	e.listener = l
+	e.recv_lock.Unlock()
+	atomic.StoreUint32(&e.connected, 1)
+	e.start()
+
+	limiter := e.limiter
+
 	for {
+		// Wait on a connection to free a slot.
+		limiter <- struct{}{}
 		conn, err := l.Accept()
 		if err != nil {
+			<-limiter
+			if atomic.LoadUint32(&e.draining) == 1 || atomic.LoadUint32(&e.closed) == 1 {
+				return ErrClosed
+			}
 			return err
 		}
-		c := e.addconnection(conn)
+		var addr string
+		if ra := conn.RemoteAddr(); ra != nil {
+			addr = ra.String()
+		}
+		peer := peerCred(conn)
+		if !e.admitConn(peerKey(addr, peer)) {
+			conn.Close()
+			<-limiter
+			continue
+		}
+
+		// Unauthorized peers are turned away before anything is routed.
+		if !e.authPeer(conn, peer) {
+			if peer != nil {
+				e.logf("Peer uid=%d gid=%d pid=%d refused.", peer.UID, peer.GID, peer.PID)
+			} else {
+				e.logf("Peer %s refused, its credentials could not be read.", addr)
+			}
+			conn.Close()
+			<-limiter
+			continue
+		}
 
-		// Spin connection off to go thread.
-		go func() {
-			c.err = c.reciever()
-		}()
+		// TLS handshakes complete before the connection is served, without holding up the accept loop.
+		if tc, ok := conn.(*tls.Conn); ok {
+			go func() {
+				if err := handshake(tc); err != nil {
+					e.logf("TLS handshake with %s failed: %s", addr, err)
+					tc.Close()
+					<-limiter
+					return
+				}
+				e.serve(tc, peer, limiter)
+			}()
+			continue
+		}
+		e.serve(conn, peer, limiter)
+	}
+}
+
+// Serves an accepted connection from peer, releasing its slot in limiter once it closes.
+func (e *EzIPC) serve(conn net.Conn, peer *PeerCred, limiter chan struct{}) {
+	c := e.addconnection(conn)
+	c.accepted = true
+	// Dump may already be reading the connection's description.
+	e.connMapLock.Lock()
+	c.peer = peer
+	e.connMapLock.Unlock()
+	e.onConnect(c)
+
+	// Challenge the dialer to prove it holds the pre-shared key.
+	if e.psk != nil {
+		c.pskChallenge()
+	}
+
+	if e.max_conn_age > 0 {
+		time.AfterFunc(e.max_conn_age, func() { e.retire(c) })
+	}
+
+	// Spin connection off to go thread.
+	if !e.startReciever() {
+		c.close()
+		<-limiter
+		return
 	}
+	go func() {
+		c.setRecvErr(c.recieve())
+		<-limiter
+	}()
 }
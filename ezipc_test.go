@@ -0,0 +1,794 @@
+package ezipc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Returns a socket path in a directory removed once the test ends.
+// Kept short, as socket paths are limited to around 100 bytes.
+func tempSocket(t testing.TB) string {
+	dir, err := os.MkdirTemp("", "ezipc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "s.sock")
+}
+
+// Returns a loopback TCP address free to listen on.
+func freeAddr(t testing.TB) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// Returns a new router, running the work it spawns freely until the test ends.
+func newRouter(t testing.TB, opts ...Option) *EzIPC {
+	e := New(opts...)
+	freeRun(t, e)
+	return e
+}
+
+// Starts a broker listening on a temporary socket, returning it with the socket path.
+func newBroker(t testing.TB, opts ...Option) (*EzIPC, string) {
+	sock := tempSocket(t)
+	b := newRouter(t, opts...)
+	return b, listen(t, b, sock)
+}
+
+// Starts b listening on sock, waiting until it is serving, closing it once the test ends.
+func listen(t testing.TB, b *EzIPC, sock string) string {
+	errs := make(chan error, 1)
+	go func() { errs <- b.Listen(sock) }()
+	select {
+	case <-b.Started():
+	case err := <-errs:
+		t.Fatalf("Listen: %s", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Listen did not start.")
+	}
+	t.Cleanup(func() { b.Close() })
+	return sock
+}
+
+// Dials sock with a new router, after registering funcs on it by name, closing it once the test ends.
+func newClient(t testing.TB, sock string, funcs map[string]interface{}, opts ...Option) *EzIPC {
+	c := newRouter(t, opts...)
+	for name, f := range funcs {
+		if err := c.RegisterName(name, f); err != nil {
+			t.Fatalf("RegisterName %s: %s", name, err)
+		}
+	}
+	if err := c.Dial(sock); err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// Waits up to 5 seconds for cond to hold, failing the test with what if it doesn't.
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s.", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Logger keeping what is logged for tests to inspect.
+type testLogger struct {
+	lock  sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+// Returns whether a line containing s was logged.
+func (l *testLogger) logged(s string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, line := range l.lines {
+		if strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Executions and round trips slower than the threshold are logged with the method name, faster ones aren't.
+func TestSlowCallLogged(t *testing.T) {
+	blog, clog := new(testLogger), new(testLogger)
+	b := newRouter(t)
+	b.SetLogger(blog)
+	b.SetSlowCallThreshold(5 * time.Millisecond)
+	b.RegisterName("Slow", func(arg int, reply *int) error { time.Sleep(20 * time.Millisecond); return nil })
+	b.RegisterName("Fast", func(arg int, reply *int) error { return nil })
+	sock := listen(t, b, tempSocket(t))
+
+	c := newClient(t, sock, nil)
+	c.SetLogger(clog)
+	c.SetSlowCallThreshold(5 * time.Millisecond)
+	var reply int
+	for _, name := range []string{"Slow", "Fast"} {
+		if err := c.Call(name, 1, &reply); err != nil {
+			t.Fatalf("Call %s: %s", name, err)
+		}
+	}
+
+	waitFor(t, "slow execution to be logged", func() bool { return blog.logged("Slow exec: Slow took") })
+	if !clog.logged("Slow call: Slow took") {
+		t.Errorf("Slow round trip not logged, logged %q.", clog.lines)
+	}
+	if blog.logged("Fast") || clog.logged("Fast") {
+		t.Errorf("Fast call logged, logged %q and %q.", blog.lines, clog.lines)
+	}
+}
+
+// Waits for the broker to route name.
+func waitRoute(t testing.TB, b *EzIPC, name string) {
+	t.Helper()
+	waitFor(t, "route "+name, func() bool { return b.CanRoute(name) })
+}
+
+// An uplink which stops reading the registrations forwarded to it doesn't hold up routing for everyone else.
+func TestRegisterForwardBlocked(t *testing.T) {
+	// Uplink acknowledging the broker's handshake but never reading from it after.
+	stop := make(chan struct{})
+	defer close(stop)
+	top := rawListener(t, func(p *rawPeer) {
+		p.ackHandshake(t)
+		<-stop
+	})
+
+	b := newRouter(t)
+	if err := b.Dial(top); err != nil {
+		t.Fatal(err)
+	}
+	sock := listen(t, b, tempSocket(t))
+	newClient(t, sock, map[string]interface{}{
+		"Echo": func(arg int, reply *int) error { *reply = arg; return nil },
+	})
+	waitRoute(t, b, "Echo")
+
+	// Registrations forwarded to the uplink fill the socket buffer, leaving the broker blocked writing to it.
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	name := strings.Repeat("n", 4096)
+	go func() {
+		for i := 0; i < 1024; i++ {
+			if _, err := fmt.Fprintf(conn, "0\x1f%s%d\x1f\x1f\x1f\x04", name, i); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	c := newClient(t, sock, nil)
+	done := make(chan error, 1)
+	go func() {
+		var reply int
+		done <- c.Call("Echo", 1, &reply)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Call = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Routing held up by an uplink not reading registrations.")
+	}
+}
+
+// A peer which stops reading its registration acknowledgements doesn't hold up routing for everyone else.
+func TestRegisterAckBlocked(t *testing.T) {
+	b, sock := newBroker(t)
+	newClient(t, sock, map[string]interface{}{
+		"Echo": func(arg int, reply *int) error { *reply = arg; return nil },
+	})
+	waitRoute(t, b, "Echo")
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	p := newRawPeer(conn)
+	p.c.write(rawHandshake("1", "0"))
+	name := strings.Repeat("n", 4096)
+	go func() {
+		for i := 0; i < 1024; i++ {
+			if p.c.write(&msg{Tag: 0, Dst: name + strconv.Itoa(i)}) != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	c := newClient(t, sock, nil)
+	done := make(chan error, 1)
+	go func() {
+		var reply int
+		done <- c.Call("Echo", 1, &reply)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Call = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Routing held up by a peer not reading its acknowledgements.")
+	}
+}
+
+// Frames arriving in a single read are all routed when the reciever yields between them.
+func TestMaxFramesPerRead(t *testing.T) {
+	b := newRouter(t)
+	b.SetMaxFramesPerRead(1)
+	sock := listen(t, b, tempSocket(t))
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var burst strings.Builder
+	for i := 0; i < 16; i++ {
+		fmt.Fprintf(&burst, "0\x1fName%d\x1f\x1f\x1f\x04", i)
+	}
+	if _, err := conn.Write([]byte(burst.String())); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 16; i++ {
+		waitRoute(t, b, fmt.Sprintf("Name%d", i))
+	}
+}
+
+// Calls to a deprecated name are routed to the name it was rewritten to, and logged.
+func TestNameRewriter(t *testing.T) {
+	log := new(testLogger)
+	b := newRouter(t)
+	b.SetLogger(log)
+	b.SetNameRewriter(func(name string) string {
+		if name == "Old" {
+			return "New"
+		}
+		return name
+	})
+	sock := listen(t, b, tempSocket(t))
+	newClient(t, sock, map[string]interface{}{
+		"New": func(arg int, reply *int) error { *reply = arg * 2; return nil },
+	})
+	waitRoute(t, b, "New")
+	c := newClient(t, sock, nil)
+
+	var reply int
+	if err := c.Call("Old", 21, &reply); err != nil || reply != 42 {
+		t.Fatalf("Call of deprecated name = %d, %v", reply, err)
+	}
+	if !log.logged("Deprecated name Old called, routing to New.") {
+		t.Errorf("Rewrite not logged, logged %q.", log.lines)
+	}
+}
+
+// Once the uplink drops, calls are made through the first standby broker that can be reached.
+func TestStandbyFailover(t *testing.T) {
+	standby, ssock := newBroker(t)
+	standby.RegisterName("Where", func(arg int, reply *string) error { *reply = "standby"; return nil })
+
+	// Primary dropping the client once it has connected.
+	drop := make(chan struct{})
+	primary := rawListener(t, func(p *rawPeer) {
+		p.ackHandshake(t)
+		<-drop
+	})
+
+	c := newRouter(t)
+	c.SetStandby(primary, ssock)
+	if err := c.Dial(primary); err != nil {
+		t.Fatal(err)
+	}
+	if addr := c.Uplink().Addr; addr != primary {
+		t.Errorf("Uplink before failover = %q, want %q", addr, primary)
+	}
+	close(drop)
+	waitFor(t, "failover", func() bool { return c.Uplink().Addr == ssock })
+
+	var reply string
+	if err := c.Call("Where", 0, &reply); err != nil || reply != "standby" {
+		t.Errorf("Call after failover = %q, %v", reply, err)
+	}
+}
+
+// Dial connects through the dialer set with SetDialer.
+func TestSetDialer(t *testing.T) {
+	b, sock := newBroker(t)
+	newClient(t, sock, map[string]interface{}{
+		"Echo": func(arg int, reply *int) error { *reply = arg; return nil },
+	})
+	waitRoute(t, b, "Echo")
+
+	var dialed []string
+	c := newRouter(t)
+	c.SetDialer(func(network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return net.Dial(network, sock)
+	})
+	if err := c.Dial("elsewhere"); err != nil {
+		t.Fatal(err)
+	}
+	if len(dialed) != 1 || dialed[0] != "elsewhere" {
+		t.Errorf("Dialer called with %v, want [elsewhere]", dialed)
+	}
+	var reply int
+	if err := c.Call("Echo", 7, &reply); err != nil || reply != 7 {
+		t.Errorf("Call through dialer = %d, %v", reply, err)
+	}
+
+	c = newRouter(t)
+	c.SetDialer(func(network, addr string) (net.Conn, error) { return nil, ErrFail })
+	if err := c.Dial(sock); err != ErrFail {
+		t.Errorf("Dial with a failing dialer = %v, want its error", err)
+	}
+}
+
+// Mock Caller answering calls from a map of replies.
+type mockCaller map[string]int
+
+func (m mockCaller) Call(name string, arg interface{}, reply interface{}) error {
+	r, ok := m[name]
+	if !ok {
+		return ErrFail
+	}
+	*reply.(*int) = r
+	return nil
+}
+
+func (m mockCaller) Register(fptr interface{}) error                  { return nil }
+func (m mockCaller) RegisterName(name string, fptr interface{}) error { return nil }
+func (m mockCaller) Notify(name string, arg interface{}) error        { return nil }
+func (m mockCaller) Close() error                                     { return nil }
+
+// Application code written against Caller runs against a real router or a mock alike.
+func TestCaller(t *testing.T) {
+	sum := func(c Caller) (int, error) {
+		var a, b int
+		if err := c.Call("A", 0, &a); err != nil {
+			return 0, err
+		}
+		if err := c.Call("B", 0, &b); err != nil {
+			return 0, err
+		}
+		return a + b, nil
+	}
+
+	if n, err := sum(mockCaller{"A": 1, "B": 2}); err != nil || n != 3 {
+		t.Errorf("sum with mock = %d, %v, want 3", n, err)
+	}
+
+	b, sock := newBroker(t)
+	newClient(t, sock, map[string]interface{}{
+		"A": func(arg int, reply *int) error { *reply = 10; return nil },
+		"B": func(arg int, reply *int) error { *reply = 20; return nil },
+	})
+	waitRoute(t, b, "A")
+	waitRoute(t, b, "B")
+	if n, err := sum(newClient(t, sock, nil)); err != nil || n != 30 {
+		t.Errorf("sum with router = %d, %v, want 30", n, err)
+	}
+}
+
+// Idempotent calls pending when the uplink drops are re-sent over the standby, others fail with ErrClosed.
+func TestFailoverResendsIdempotent(t *testing.T) {
+	standby, ssock := newBroker(t)
+	var calls int32
+	standby.RegisterName("Echo", func(arg int, reply *int) error {
+		atomic.AddInt32(&calls, 1)
+		*reply = arg
+		return nil
+	})
+
+	// Primary dropping the client once both calls have reached it.
+	primary := rawListener(t, func(p *rawPeer) {
+		p.ackHandshake(t)
+		for n := 0; n < 2; {
+			m := p.read(t)
+			if m == nil {
+				return
+			}
+			if m.Dst == "Echo" && m.Tag > 0 {
+				n++
+			}
+		}
+	})
+
+	c := newRouter(t)
+	c.SetStandby(primary, ssock)
+	if err := c.Dial(primary); err != nil {
+		t.Fatal(err)
+	}
+	idempotent, plain := make(chan error, 1), make(chan error, 1)
+	var reply int
+	go func() { idempotent <- c.CallIdempotent("Echo", 1, &reply) }()
+	go func() {
+		var reply int
+		plain <- c.Call("Echo", 2, &reply)
+	}()
+
+	for _, ch := range []chan error{plain, idempotent} {
+		select {
+		case err := <-ch:
+			if ch == plain && err != ErrClosed {
+				t.Errorf("Call pending at failover = %v, want ErrClosed", err)
+			}
+			if ch == idempotent && (err != nil || reply != 1) {
+				t.Errorf("CallIdempotent pending at failover = %d, %v", reply, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Call pending at failover never returned.")
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("Standby handled %d calls, want only the idempotent one", n)
+	}
+}
+
+// Labels declared when dialing are listed among the broker's connections.
+func TestConnectionLabels(t *testing.T) {
+	b, sock := newBroker(t)
+	newClient(t, sock, nil)
+	c := newRouter(t)
+	if err := c.DialWithLabels(map[string]string{"region": "east", "version": "2"}, sock); err != nil {
+		t.Fatal(err)
+	}
+
+	var conns []ConnInfo
+	waitFor(t, "labels", func() bool {
+		conns = b.Connections()
+		for _, info := range conns {
+			if info.Labels["region"] == "east" {
+				return true
+			}
+		}
+		return false
+	})
+	var labelled int
+	for i, info := range conns {
+		if i > 0 && len(info.ID) == len(conns[i-1].ID) && info.ID < conns[i-1].ID {
+			t.Errorf("Connections out of order: %s after %s", info.ID, conns[i-1].ID)
+		}
+		if len(info.Labels) > 0 {
+			labelled++
+			if info.Labels["version"] != "2" || len(info.Labels) != 2 {
+				t.Errorf("Labels = %v", info.Labels)
+			}
+		}
+	}
+	if labelled != 1 {
+		t.Errorf("%d connections labelled, want 1", labelled)
+	}
+}
+
+// Leaves a socket file at sock with nothing listening on it, as a crashed broker would.
+func staleSocket(t *testing.T, sock string) {
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetUnlinkOnClose(false)
+	l.Close()
+}
+
+// Listen removes a stale socket file, and nothing else sharing its name, unless cleanup is disabled.
+func TestSocketCleanup(t *testing.T) {
+	sock := tempSocket(t)
+	keep := sock + ".keep"
+	if err := os.WriteFile(keep, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	staleSocket(t, sock)
+	listen(t, newRouter(t), sock)
+	if _, err := os.Stat(keep); err != nil {
+		t.Errorf("Listen removed %s: %v", keep, err)
+	}
+
+	sock = tempSocket(t)
+	staleSocket(t, sock)
+	b := newRouter(t)
+	b.SetSocketCleanup(false)
+	errs := make(chan error, 1)
+	go func() { errs <- b.Listen(sock) }()
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("Listen over a stale socket with cleanup disabled succeeded.")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Listen over a stale socket with cleanup disabled did not fail.")
+	}
+}
+
+// Started is closed once Listen serves, including when it connects to a broker already listening.
+func TestStarted(t *testing.T) {
+	b, sock := newBroker(t)
+	e := newRouter(t)
+	select {
+	case <-e.Started():
+		t.Fatal("Started before Listen.")
+	default:
+	}
+	e.RegisterName("Echo", func(arg int, reply *int) error { *reply = arg; return nil })
+	listen(t, e, sock)
+	waitRoute(t, b, "Echo")
+}
+
+// Errors and arguments containing the frame delimiters reach the caller intact, with either framing.
+func TestDelimitersInFields(t *testing.T) {
+	const text = "field\x1fseparator and\x04terminator\\"
+	for _, opts := range [][]Option{nil, {WithBinaryFraming()}} {
+		b, sock := newBroker(t, opts...)
+		newClient(t, sock, map[string]interface{}{
+			"Fail": func(arg string, reply *string) error {
+				*reply = arg
+				return errors.New(arg)
+			},
+			"Echo": func(arg string, reply *string) error {
+				*reply = arg
+				return nil
+			},
+		}, opts...)
+		waitRoute(t, b, "Fail")
+		waitRoute(t, b, "Echo")
+		c := newClient(t, sock, nil, opts...)
+
+		var reply string
+		if err := c.Call("Fail", text, &reply); err == nil || err.Error() != text {
+			t.Errorf("Error with delimiters = %q, want %q", err, text)
+		}
+		if err := c.Call("Echo", text, &reply); err != nil || reply != text {
+			t.Errorf("Echo with delimiters = %q, %v", reply, err)
+		}
+	}
+}
+
+// Binary framing is used once the broker agrees to it, alongside peers which keep text framing.
+func TestBinaryFraming(t *testing.T) {
+	b, sock := newBroker(t)
+	newClient(t, sock, map[string]interface{}{
+		"Echo": func(arg []byte, reply *[]byte) error { *reply = arg; return nil },
+	})
+	waitRoute(t, b, "Echo")
+	c := newClient(t, sock, nil, WithBinaryFraming())
+
+	data := []byte{0, 0x04, 0x1f, 0xff, '\\'}
+	var reply []byte
+	if err := c.Call("Echo", data, &reply); err != nil || string(reply) != string(data) {
+		t.Errorf("Echo over binary framing = %v, %v", reply, err)
+	}
+	if !c.getUplink().isBinary() {
+		t.Error("Binary framing not in use after the broker agreed to it.")
+	}
+}
+
+// A provider reconnecting before the broker sees its old connection close has its routes moved to the new connection,
+// and the old connection closing later leaves them in place.
+func TestReconnectBeforeClose(t *testing.T) {
+	b, sock := newBroker(t)
+	p := newClient(t, sock, map[string]interface{}{
+		"Work": func(arg int, reply *int) error { *reply = arg; return nil },
+	})
+	waitRoute(t, b, "Work")
+	first := b.Dump().Routes["Work"]
+
+	old := p.getUplink()
+	if err := p.Dial(sock); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "route to move to the new connection", func() bool {
+		r := b.Dump().Routes["Work"]
+		return len(r) == 1 && r[0] != first[0]
+	})
+	moved := b.Dump().Routes["Work"]
+
+	old.conn.Close()
+	waitFor(t, "broker to see the old connection close", func() bool { return len(b.Dump().Conns) == 1 })
+	if r := b.Dump().Routes["Work"]; len(r) != 1 || r[0] != moved[0] {
+		t.Fatalf("Routes of Work after old connection closed = %v, want %v.", r, moved)
+	}
+
+	c := newClient(t, sock, nil)
+	var reply int
+	if err := c.Call("Work", 3, &reply); err != nil || reply != 3 {
+		t.Errorf("Call after reconnect = %d, %v", reply, err)
+	}
+}
+
+// Dialing again after the uplink drops announces everything registered before, without registering again.
+func TestRedialAnnounces(t *testing.T) {
+	b, sock := newBroker(t)
+	p := newClient(t, sock, map[string]interface{}{
+		"Work":  func(arg int, reply *int) error { *reply = arg; return nil },
+		"Other": func(arg int, reply *int) error { *reply = -arg; return nil },
+	})
+	waitRoute(t, b, "Work")
+	waitRoute(t, b, "Other")
+
+	p.getUplink().conn.Close()
+	waitFor(t, "routes to be dropped", func() bool { return !b.CanRoute("Work") && !b.CanRoute("Other") })
+
+	if err := p.Dial(sock); err != nil {
+		t.Fatal(err)
+	}
+	waitRoute(t, b, "Work")
+	waitRoute(t, b, "Other")
+
+	c := newClient(t, sock, nil)
+	var reply int
+	if err := c.Call("Other", 3, &reply); err != nil || reply != -3 {
+		t.Errorf("Call after redial = %d, %v", reply, err)
+	}
+}
+
+// A broker with an uplink forwards calls for names it doesn't provide upstream, unless fallback is disabled.
+func TestUplinkFallback(t *testing.T) {
+	top, topSock := newBroker(t)
+	newClient(t, topSock, map[string]interface{}{
+		"Top": func(arg int, reply *int) error { *reply = arg + 1; return nil },
+	})
+	waitRoute(t, top, "Top")
+
+	mid, midSock := newBroker(t)
+	if err := mid.Dial(topSock); err != nil {
+		t.Fatal(err)
+	}
+	c := newClient(t, midSock, nil)
+
+	var reply int
+	if err := c.Call("Top", 1, &reply); err != nil || reply != 2 {
+		t.Errorf("Call through mid tier broker = %d, %v", reply, err)
+	}
+
+	mid.SetUplinkFallback(false)
+	if err := c.Call("Top", 1, &reply); err != ErrFail {
+		t.Errorf("Call with fallback disabled = %v, want ErrFail", err)
+	}
+}
+
+// With Debug set, frames and route announcements are logged with their destination, tag and error.
+func TestDebug(t *testing.T) {
+	log := new(testLogger)
+	b := newRouter(t)
+	b.Debug = true
+	b.SetLogger(log)
+	sock := listen(t, b, tempSocket(t))
+	newClient(t, sock, map[string]interface{}{
+		"Fail": func(arg int, reply *int) error { return errors.New("Failed.") },
+	})
+	waitRoute(t, b, "Fail")
+	c := newClient(t, sock, nil)
+
+	var reply int
+	c.Call("Fail", 1, &reply)
+	for _, want := range []string{
+		"Route Fail announced by connection",
+		"Recieved from connection",
+		`dst=Fail err=""`,
+		`dst=Fail err="Failed."`,
+	} {
+		if !log.logged(want) {
+			t.Errorf("Nothing logged containing %q.", want)
+		}
+	}
+
+	quiet := new(testLogger)
+	c.SetLogger(quiet)
+	c.Call("Fail", 1, &reply)
+	if quiet.logged("Sent to connection") {
+		t.Error("Frames logged without Debug set.")
+	}
+}
+
+// A logger given to New with WithLogger recieves diagnostics, which are otherwise discarded.
+func TestWithLogger(t *testing.T) {
+	log := new(testLogger)
+	b, sock := newBroker(t, WithLogger(log))
+	c := newClient(t, sock, nil)
+	waitFor(t, "connection", func() bool { return len(b.Dump().Conns) == 1 })
+	c.Close()
+	waitFor(t, "goodbye to be logged", func() bool { return log.logged("closing at peer's request") })
+}
+
+// Relay buckets are dropped once either end of the relay closes, failing the call when the destination is lost
+// and cancelling the handler when the source is.
+func TestRelayClosed(t *testing.T) {
+	for _, kill := range []string{"destination", "source"} {
+		b, sock := newBroker(t)
+		release := make(chan struct{})
+		cancelled := make(chan struct{}, 1)
+		handler := newClient(t, sock, map[string]interface{}{
+			"Block": func(ctx context.Context, arg int, reply *int) error {
+				select {
+				case <-release:
+				case <-ctx.Done():
+					cancelled <- struct{}{}
+				}
+				return nil
+			},
+		})
+		waitRoute(t, b, "Block")
+		c := newClient(t, sock, nil)
+
+		errs := make(chan error, 1)
+		go func() {
+			var reply int
+			errs <- c.Call("Block", 1, &reply)
+		}()
+		waitFor(t, "relay of Block", func() bool { return b.Stats().PendingTags == 1 })
+
+		if kill == "destination" {
+			handler.getUplink().conn.Close()
+			if err := <-errs; !errors.Is(err, ErrClosed) {
+				t.Errorf("Call to lost destination = %v, want ErrClosed.", err)
+			}
+		} else {
+			c.getUplink().conn.Close()
+			select {
+			case <-cancelled:
+			case <-time.After(5 * time.Second):
+				t.Error("Handler not cancelled after the caller closed.")
+			}
+		}
+		waitFor(t, "relay to be dropped after its "+kill+" closed", func() bool { return b.Stats().PendingTags == 0 })
+		close(release)
+	}
+}
+
+// Brokers serve over TCP as over a socket file, reached with DialTCP or a tcp:// address.
+func TestTCP(t *testing.T) {
+	addr := freeAddr(t)
+	b := newRouter(t)
+	errs := make(chan error, 1)
+	go func() { errs <- b.ListenTCP(addr) }()
+	select {
+	case <-b.Started():
+	case err := <-errs:
+		t.Fatalf("ListenTCP: %s", err)
+	}
+
+	p := newRouter(t)
+	p.RegisterName("Echo", func(arg int, reply *int) error { *reply = arg; return nil })
+	if err := p.DialTCP(addr); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	waitRoute(t, b, "Echo")
+
+	c := newClient(t, "tcp://"+addr, nil)
+	var reply int
+	if err := c.Call("Echo", 5, &reply); err != nil || reply != 5 {
+		t.Errorf("Call over TCP = %d, %v", reply, err)
+	}
+}
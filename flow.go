@@ -0,0 +1,156 @@
+package ezipc
+
+import (
+	"context"
+	"strconv"
+	"sync"
+)
+
+// SetFlowWindow enables credit based flow control, allowing a peer to send at most n frames before we grant it more credit.
+// Flow control is only used on connections where both peers have set a window, 0 disables.
+// Brokers stop reading from a peer while calls it sent wait on the credit of a connection with its window of frames already waiting,
+// so a slow peer holds up those calling it rather than having calls queued for it without bound.
+func (e *EzIPC) SetFlowWindow(n int) {
+	e.flow_window = n
+}
+
+// Flow control state of a connection.
+type flow struct {
+	lock sync.Mutex
+	// Frames we may send before the peer grants more credit.
+	credits int
+	// Frames waiting on credit to be sent, and the peer's window, the most relayed calls wait on credit before backlog blocks.
+	queue []*msg
+	limit int
+	// Closed and replaced whenever credit is granted.
+	avail chan struct{}
+	// Set once the connection has closed.
+	closed bool
+	// Our recieve window, and frames recieved since we last granted credit.
+	window   int
+	consumed int
+}
+
+// Creates flow control state, window is ours and credits is the window of the peer.
+func newFlow(window, credits int) *flow {
+	return &flow{
+		credits: credits,
+		limit:   credits,
+		avail:   make(chan struct{}),
+		window:  window,
+	}
+}
+
+// Sets up flow control on c if both we and the peer have a window.
+func (c *connection) setFlow(peer_window string) {
+	credits, _ := strconv.Atoi(peer_window)
+	if credits > 0 && c.router.flow_window > 0 {
+		c.flow.Store(newFlow(c.router.flow_window, credits))
+	}
+}
+
+// Returns the flow control state of c, nil when not in use.
+// Set by the reciever while senders are already running, so is published atomically.
+func (c *connection) getFlow() *flow {
+	f, _ := c.flow.Load().(*flow)
+	return f
+}
+
+// Determines if req must wait on credit, queueing it if so.
+func (f *flow) hold(req *msg) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.credits > 0 && len(f.queue) == 0 {
+		f.credits--
+		return false
+	}
+	f.queue = append(f.queue, req)
+	return true
+}
+
+// Adds credit granted by the peer, sending any frames which were waiting on it.
+func (c *connection) grant(n int) {
+	f := c.getFlow()
+	f.lock.Lock()
+	f.credits += n
+	var ready []*msg
+	for len(f.queue) > 0 && f.credits > 0 {
+		ready = append(ready, f.queue[0])
+		f.queue = f.queue[1:]
+		f.credits--
+	}
+	close(f.avail)
+	f.avail = make(chan struct{})
+	f.lock.Unlock()
+
+	for _, req := range ready {
+		c.write(req)
+	}
+}
+
+// Blocks until the peer has credit for us to send or ctx is done.
+func (f *flow) wait(ctx context.Context) error {
+	for {
+		f.lock.Lock()
+		if f.closed {
+			f.lock.Unlock()
+			return ErrClosed
+		}
+		if f.credits > 0 && len(f.queue) == 0 {
+			f.lock.Unlock()
+			return nil
+		}
+		avail := f.avail
+		f.lock.Unlock()
+
+		select {
+		case <-avail:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Blocks while as many frames wait on credit as the peer's window, until the peer grants more or the connection closes.
+func (f *flow) backlog() {
+	for {
+		f.lock.Lock()
+		if f.closed || len(f.queue) < f.limit {
+			f.lock.Unlock()
+			return
+		}
+		avail := f.avail
+		f.lock.Unlock()
+		<-avail
+	}
+}
+
+// Wakes calls waiting on credit once the connection has closed.
+func (f *flow) shut() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !f.closed {
+		f.closed = true
+		close(f.avail)
+		f.avail = make(chan struct{})
+	}
+}
+
+// Records a frame recieved from the peer, granting more credit once half our window is used.
+func (c *connection) consumed() {
+	f := c.getFlow()
+	f.lock.Lock()
+	f.consumed++
+	n := f.consumed
+	if n*2 < f.window {
+		f.lock.Unlock()
+		return
+	}
+	f.consumed = 0
+	f.lock.Unlock()
+
+	credit := &msg{Tag: 0}
+	credit.setHdr(hdrCredit, strconv.Itoa(n))
+	c.write(credit)
+}
@@ -0,0 +1,131 @@
+package ezipc
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Calls flow over connections with a small window, including those sent while the handshake sets flow control up.
+func TestFlowWindow(t *testing.T) {
+	b := newRouter(t)
+	b.SetFlowWindow(2)
+	sock := listen(t, b, tempSocket(t))
+
+	handler := newRouter(t)
+	handler.SetFlowWindow(1)
+	handler.RegisterName("Double", func(arg int, reply *int) error { *reply = arg * 2; return nil })
+	if err := handler.Dial(sock); err != nil {
+		t.Fatal(err)
+	}
+	waitRoute(t, b, "Double")
+
+	c := newRouter(t)
+	c.SetFlowWindow(3)
+	if err := c.Dial(sock); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				var reply int
+				if err := c.Call("Double", i, &reply); err != nil || reply != i*2 {
+					t.Errorf("Double(%d) = %d, %v", i, reply, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := backlogged(b); n != 0 {
+		t.Errorf("%d frames left waiting on credit.", n)
+	}
+}
+
+// A broker stops reading calls relayed to a peer which stops granting credit once its window of them are queued,
+// rather than queueing them without bound, and carries on once the peer goes away.
+func TestFlowBacklog(t *testing.T) {
+	b := newRouter(t)
+	b.SetFlowWindow(4)
+	sock := listen(t, b, tempSocket(t))
+	b.RegisterName("Echo", func(arg int, reply *int) error { *reply = arg; return nil })
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Peer with a window of 2, which never reads what it is sent so never grants credit.
+	p := newRouter(t).addconnection(conn)
+	hs := &msg{Tag: 0}
+	hs.setHdr(hdrHandshake, "1")
+	hs.setHdr(hdrWindow, "2")
+	p.write(hs)
+	p.write(&msg{Tag: 0, Dst: "Slow"})
+	waitRoute(t, b, "Slow")
+	c := newClient(t, sock, nil)
+
+	for i := 0; i < 10; i++ {
+		go func() {
+			var reply int
+			c.Call("Slow", 1, &reply)
+		}()
+	}
+	// Two calls are sent on the peer's credit and two queued, the rest wait on the broker to read them.
+	waitFor(t, "calls to be queued", func() bool { return backlogged(b) == 2 })
+	time.Sleep(50 * time.Millisecond)
+	if n := backlogged(b); n != 2 {
+		t.Errorf("%d frames queued for the peer, want its window of 2.", n)
+	}
+
+	conn.Close()
+	done := make(chan error, 1)
+	go func() {
+		var reply int
+		done <- c.Call("Echo", 1, &reply)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Call once the peer closed = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Broker still held up after the peer closed.")
+	}
+}
+
+// Returns the frames waiting on credit over connections of b.
+func backlogged(b *EzIPC) (n int) {
+	for _, info := range b.Dump().Conns {
+		n += info.Queued
+	}
+	return
+}
+
+// Credit is granted back once half the window is used, and for every frame with a window of 1.
+func TestFlowConsumed(t *testing.T) {
+	for _, test := range []struct{ window, grants int }{{1, 4}, {2, 4}, {4, 2}, {5, 1}} {
+		conn, peer := net.Pipe()
+		go io.Copy(ioutil.Discard, peer)
+		c := newRouter(t).addconnection(conn)
+		c.flow.Store(newFlow(test.window, 0))
+		var grants int
+		for i := 0; i < 4; i++ {
+			c.consumed()
+			if c.getFlow().consumed == 0 {
+				grants++
+			}
+		}
+		conn.Close()
+		if grants != test.grants {
+			t.Errorf("Window %d granted credit %d times over 4 frames, want %d.", test.window, grants, test.grants)
+		}
+	}
+}
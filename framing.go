@@ -0,0 +1,113 @@
+package ezipc
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// Leads frames using length prefixed binary framing, text frames always start with the tag.
+const binaryFrame = '\x02'
+
+// WithBinaryFraming requests length prefixed binary framing on connections we dial, should the peer support it.
+// Arguments and replies are then carried as raw bytes rather than base64, the delimited text framing remains the default.
+func WithBinaryFraming() Option {
+	return func(e *EzIPC) {
+		e.binary_framing = true
+	}
+}
+
+// Determines if frames written to c use binary framing.
+func (c *connection) isBinary() bool {
+	return atomic.LoadUint32(&c.binary) == 1
+}
+
+// Switches writes to c to binary framing.
+func (c *connection) useBinary() {
+	atomic.StoreUint32(&c.binary, 1)
+}
+
+// Encodes req as a binary frame: the lead byte, the length of the body, then the body as length prefixed fields.
+// va1 and va2 are the base64 encoded argument and reply, which are carried decoded.
+func encodeBinary(req *msg, va1, va2 string, blob []byte, hdr map[string]string) ([]byte, error) {
+	raw1, err := base64.StdEncoding.DecodeString(va1)
+	if err != nil {
+		return nil, err
+	}
+	raw2, err := base64.StdEncoding.DecodeString(va2)
+	if err != nil {
+		return nil, err
+	}
+
+	var tag [4]byte
+	binary.BigEndian.PutUint32(tag[:], uint32(req.Tag))
+
+	fields := [][]byte{tag[:], []byte(req.Dst), []byte(req.Err), raw1, raw2, blob, encodeHdr(hdr)}
+
+	size := 0
+	for _, f := range fields {
+		size += 4 + len(f)
+	}
+	out := make([]byte, 5, 5+size)
+	out[0] = binaryFrame
+	binary.BigEndian.PutUint32(out[1:5], uint32(size))
+	for _, f := range fields {
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(len(f)))
+		out = append(append(out, n[:]...), f...)
+	}
+	return out, nil
+}
+
+var errBadFrame = errors.New("Corrupted binary frame.")
+
+// Reads a binary frame, failing if its body exceeds max bytes, corrupt is set if the frame could not be decoded.
+func readBinary(r *bufio.Reader, max int) (out *msg, corrupt bool, err error) {
+	var head [5]byte
+	if _, err = io.ReadFull(r, head[:]); err != nil {
+		return nil, false, err
+	}
+	size := int(binary.BigEndian.Uint32(head[1:5]))
+	if size < 0 || size > max {
+		return nil, false, fmt.Errorf("Frame exceeds maximum size of %d bytes: %w", max, ErrTooLarge)
+	}
+	body := make([]byte, size)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return nil, false, err
+	}
+
+	var fields [7][]byte
+	for i := range fields {
+		if len(body) < 4 {
+			return nil, true, errBadFrame
+		}
+		n := int(binary.BigEndian.Uint32(body[0:4]))
+		if n < 0 || n > len(body)-4 {
+			return nil, true, errBadFrame
+		}
+		fields[i] = body[4 : 4+n]
+		body = body[4+n:]
+	}
+	if len(fields[0]) != 4 {
+		return nil, true, errBadFrame
+	}
+
+	out = &msg{
+		Tag: int32(binary.BigEndian.Uint32(fields[0])),
+		Dst: string(fields[1]),
+		Err: string(fields[2]),
+		Va1: base64.StdEncoding.EncodeToString(fields[3]),
+		Va2: base64.StdEncoding.EncodeToString(fields[4]),
+	}
+	if len(fields[5]) > 0 {
+		out.Blob = fields[5]
+	}
+	if len(fields[6]) > 0 {
+		out.Hdr = decodeHdr(fields[6])
+	}
+	return
+}
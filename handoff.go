@@ -0,0 +1,260 @@
+package ezipc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ListenerFile returns a duplicate of the listening socket for handing off to a successor process.
+//
+// The handoff sequence for a zero-downtime restart is:
+//
+//  1. The old broker calls ListenerFile and starts the successor with the file in exec.Cmd.ExtraFiles.
+//  2. The successor calls ListenFile(os.NewFile(3, "listener")) and begins accepting connections.
+//  3. The old broker calls Drain, which stops accepting, lets in-flight calls finish and closes its connections.
+//  4. Clients of the old broker reconnect, the socket file is still served by the successor.
+func (e *EzIPC) ListenerFile() (*os.File, error) {
+	e.recv_lock.Lock()
+	listener := e.listener
+	e.recv_lock.Unlock()
+
+	l, ok := listener.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return nil, errors.New("No listener available for handoff.")
+	}
+	return l.File()
+}
+
+// ListenFile serves requests on an inherited listening socket, as returned by ListenerFile.
+func (e *EzIPC) ListenFile(f *os.File) error {
+	l, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return e.ListenWith(l)
+}
+
+// Drain stops accepting new connections and waits up to timeout for in-flight calls to complete before closing all connections.
+// The socket file is left in place for a successor process, Listen returns ErrClosed once drained.
+// As with Close, Drain returns once every connection has stopped recieving.
+func (e *EzIPC) Drain(timeout time.Duration) (err error) {
+	e.recv_lock.Lock()
+	atomic.StoreUint32(&e.draining, 1)
+	l := e.listener
+	e.recv_lock.Unlock()
+
+	if l != nil {
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		l.Close()
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		e.tagMapLock.Lock()
+		pending := len(e.tagMap)
+		e.tagMapLock.Unlock()
+		if pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			err = fmt.Errorf("Drain timed out with %d calls pending.", pending)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	e.connMapLock.RLock()
+	conns := make([]*connection, 0, len(e.conns))
+	for c := range e.conns {
+		conns = append(conns, c)
+	}
+	e.connMapLock.RUnlock()
+
+	for _, c := range conns {
+		c.closeGraceful()
+	}
+	if werr := e.waitRecievers(); err == nil {
+		err = werr
+	}
+	return
+}
+
+// Close shuts down the router, closing the listener and all connections, removing the socket file if Listen created it.
+// Listen returns ErrClosed, and pending calls are woken with ErrClosed. Calling Close again has no effect.
+// Close returns once every connection has stopped recieving, or ErrShutdownTimeout if one hasn't within 5 seconds.
+func (e *EzIPC) Close() error {
+	e.recv_lock.Lock()
+	closing := atomic.CompareAndSwapUint32(&e.closed, 0, 1)
+	l := e.listener
+	e.recv_lock.Unlock()
+	if !closing {
+		return nil
+	}
+
+	if l != nil {
+		l.Close()
+	}
+
+	e.connMapLock.RLock()
+	conns := make([]*connection, 0, len(e.conns))
+	for c := range e.conns {
+		conns = append(conns, c)
+	}
+	e.connMapLock.RUnlock()
+
+	for _, c := range conns {
+		c.closeGraceful()
+	}
+
+	// Wake calls waiting on replies.
+	e.tagMapLock.Lock()
+	for tag, b := range e.tagMap {
+		if b.flag != t_REQUEST {
+			continue
+		}
+		b.data = &msg{Tag: tag, Err: ErrClosed.Error()}
+		b.done <- struct{}{}
+		e.dropTag(tag)
+	}
+	e.tagMapLock.Unlock()
+
+	return e.waitRecievers()
+}
+
+// ErrShutdownTimeout is returned by Close and Drain when connections are still recieving once shutdownTimeout has passed.
+var ErrShutdownTimeout = errors.New("Timed out waiting on connections to stop recieving.")
+
+// Time Close and Drain wait on connections to stop recieving.
+const shutdownTimeout = 5 * time.Second
+
+// Counts a reciever about to start, unless the router is closed or draining, so none start once Close or Drain waits on them.
+func (e *EzIPC) startReciever() bool {
+	e.recv_lock.Lock()
+	defer e.recv_lock.Unlock()
+	if atomic.LoadUint32(&e.closed) == 1 || atomic.LoadUint32(&e.draining) == 1 {
+		return false
+	}
+	e.recv_count++
+	return true
+}
+
+// Counts a reciever exiting, waking waitRecievers once none are left.
+func (e *EzIPC) recieverDone() {
+	e.recv_lock.Lock()
+	defer e.recv_lock.Unlock()
+	e.recv_count--
+	if e.recv_count == 0 && e.recv_idle != nil {
+		close(e.recv_idle)
+		e.recv_idle = nil
+	}
+}
+
+// Waits up to shutdownTimeout for every reciever to exit, so nothing more is processed once we return.
+// Nothing is left waiting should it time out.
+func (e *EzIPC) waitRecievers() error {
+	e.recv_lock.Lock()
+	if e.recv_count == 0 {
+		e.recv_lock.Unlock()
+		return nil
+	}
+	if e.recv_idle == nil {
+		e.recv_idle = make(chan struct{})
+	}
+	idle := e.recv_idle
+	e.recv_lock.Unlock()
+
+	timer := time.NewTimer(shutdownTimeout)
+	defer timer.Stop()
+	select {
+	case <-idle:
+		return nil
+	case <-timer.C:
+		return ErrShutdownTimeout
+	}
+}
+
+// SetMaxConnAge closes accepted connections once they reach age d, prompting clients to reconnect, 0 disables.
+// Calls in flight on the connection when it reaches age d are allowed up to d again to complete first.
+func (e *EzIPC) SetMaxConnAge(d time.Duration) {
+	e.max_conn_age = d
+}
+
+// Closes c once calls in flight on it have completed.
+func (e *EzIPC) retire(c *connection) {
+	e.connMapLock.RLock()
+	_, open := e.conns[c]
+	e.connMapLock.RUnlock()
+	if !open {
+		return
+	}
+
+	// Snapshot buckets relaying to or from c.
+	pending := make(map[int32]*bucket)
+	e.tagMapLock.Lock()
+	for tag, b := range e.tagMap {
+		if b.src == c || b.dst == c {
+			pending[tag] = b
+		}
+	}
+	e.tagMapLock.Unlock()
+
+	// Don't wait forever on calls which will never complete.
+	deadline := time.Now().Add(e.max_conn_age)
+
+	for len(pending) > 0 && time.Now().Before(deadline) {
+		time.Sleep(busyCheck)
+		e.tagMapLock.Lock()
+		for tag, b := range pending {
+			if e.tagMap[tag] != b {
+				delete(pending, tag)
+			}
+		}
+		e.tagMapLock.Unlock()
+	}
+
+	e.logf("Recycling connection %s (%s) after %v.", c.id, c.addr, e.max_conn_age)
+	c.closeGraceful()
+}
+
+// DrainMethod stops routing new calls to the locally registered name and waits up to timeout for calls in flight to complete.
+// Returns the number of calls still executing, with ErrTimeout if the timeout passed before all completed.
+// Fails if name is not registered locally.
+func (e *EzIPC) DrainMethod(name string, timeout time.Duration) (int, error) {
+	var local []*connection
+	e.connMapLock.RLock()
+	for _, c := range e.connMap[name] {
+		if c.exec != nil {
+			atomic.StoreUint32(&c.draining, 1)
+			local = append(local, c)
+		}
+	}
+	e.connMapLock.RUnlock()
+
+	if len(local) == 0 {
+		return 0, fmt.Errorf("%s is not registered locally.", name)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		var pending int64
+		for _, c := range local {
+			pending += atomic.LoadInt64(&c.inflight)
+		}
+		if pending == 0 {
+			return 0, nil
+		}
+		if time.Now().After(deadline) {
+			return int(pending), ErrTimeout
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,322 @@
+package ezipc
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Idempotent calls in flight when the broker goes away are sent again once reconnected, others fail with ErrClosed.
+func TestReconnectResendsIdempotent(t *testing.T) {
+	release := make(chan struct{})
+	var lock sync.Mutex
+	seen := make(map[int]int)
+	slow := func(arg int, reply *int) error {
+		lock.Lock()
+		seen[arg]++
+		first := seen[arg] == 1
+		lock.Unlock()
+		// The first call of each arg is still running when its broker goes away.
+		if first {
+			<-release
+		}
+		*reply = arg
+		return nil
+	}
+	started := func(n int) func() bool {
+		return func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return len(seen) == n
+		}
+	}
+
+	sock := tempSocket(t)
+	b1 := newRouter(t)
+	b1.RegisterName("Slow", slow)
+	listen(t, b1, sock)
+	c := newClient(t, sock, nil, WithReconnect(10*time.Millisecond, 50*time.Millisecond))
+
+	idempotent, plain := make(chan error, 1), make(chan error, 1)
+	var reply int
+	go func() { idempotent <- c.CallIdempotent("Slow", 1, &reply) }()
+	go func() { var reply int; plain <- c.Call("Slow", 2, &reply) }()
+	waitFor(t, "both calls to start", started(2))
+
+	b1.Close()
+	if err := <-plain; !errors.Is(err, ErrClosed) {
+		t.Errorf("Call in flight when broker closed = %v, want ErrClosed.", err)
+	}
+	close(release)
+
+	b2 := newRouter(t)
+	b2.RegisterName("Slow", slow)
+	listen(t, b2, sock)
+
+	select {
+	case err := <-idempotent:
+		if err != nil || reply != 1 {
+			t.Errorf("CallIdempotent in flight when broker closed = %d, %v", reply, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("CallIdempotent was not sent again after reconnecting.")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if seen[1] != 2 || seen[2] != 1 {
+		t.Errorf("Handler calls by arg = %v, want the idempotent call twice and the other once.", seen)
+	}
+}
+
+// A successor serving the listener handed off by ListenerFile takes over the socket once the old broker drains.
+func TestHandoff(t *testing.T) {
+	sock := tempSocket(t)
+	old := newRouter(t)
+	old.RegisterName("Who", func(arg int, reply *string) error { *reply = "old"; return nil })
+	errs := make(chan error, 1)
+	go func() { errs <- old.Listen(sock) }()
+	var f *os.File
+	waitFor(t, "old broker to listen", func() bool {
+		var err error
+		f, err = old.ListenerFile()
+		return err == nil
+	})
+
+	successor := newRouter(t)
+	successor.RegisterName("Who", func(arg int, reply *string) error { *reply = "successor"; return nil })
+	go successor.ListenFile(f)
+
+	if err := old.Drain(time.Second); err != nil {
+		t.Errorf("Drain = %v", err)
+	}
+	select {
+	case err := <-errs:
+		if err != ErrClosed {
+			t.Errorf("Listen of drained broker = %v, want ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Listen still serving after Drain.")
+	}
+
+	if _, err := os.Stat(sock); err != nil {
+		t.Fatalf("Socket file removed by Drain: %s", err)
+	}
+	var reply string
+	if err := newClient(t, sock, nil).Call("Who", 0, &reply); err != nil || reply != "successor" {
+		t.Errorf("Call after handoff = %q, %v, want the successor", reply, err)
+	}
+}
+
+// Close and Drain racing Listen close its listener, which then fails with ErrClosed rather than serving.
+func TestCloseRacingListen(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		b := newRouter(t)
+		l, err := net.Listen("unix", tempSocket(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		errs := make(chan error, 1)
+		go func() { errs <- b.ListenWith(l) }()
+		if i%2 == 0 {
+			b.Close()
+		} else {
+			b.Drain(0)
+		}
+		select {
+		case err := <-errs:
+			if err != ErrClosed {
+				t.Fatalf("ListenWith = %v, want ErrClosed", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("ListenWith still serving after Close.")
+		}
+	}
+}
+
+// Connections past their maximum age are closed, once the calls in flight on them complete.
+func TestMaxConnAge(t *testing.T) {
+	b := newRouter(t)
+	b.SetMaxConnAge(300 * time.Millisecond)
+	sock := listen(t, b, tempSocket(t))
+	newClient(t, sock, map[string]interface{}{
+		"Slow": func(arg int, reply *int) error {
+			time.Sleep(450 * time.Millisecond)
+			*reply = arg
+			return nil
+		},
+	})
+	waitRoute(t, b, "Slow")
+
+	c := newClient(t, sock, nil)
+	var reply int
+	if err := c.Call("Slow", 1, &reply); err != nil || reply != 1 {
+		t.Errorf("Call spanning the connection's maximum age = %d, %v", reply, err)
+	}
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	// The broker says goodbye before closing a connection it recycles.
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		t.Fatalf("Recycled connection not closed: %s", err)
+	}
+	if d := time.Since(start); d >= 4*time.Second {
+		t.Errorf("Connection closed after %v, want about 300ms", d)
+	}
+}
+
+// DrainMethod stops new calls reaching a local function, waiting on those in flight.
+func TestDrainMethod(t *testing.T) {
+	b, sock := newBroker(t)
+	release := make(chan struct{})
+	b.RegisterName("Work", func(arg int, reply *int) error {
+		<-release
+		*reply = arg
+		return nil
+	})
+	c := newClient(t, sock, nil)
+
+	done := make(chan error, 1)
+	go func() {
+		var reply int
+		done <- c.Call("Work", 1, &reply)
+	}()
+	waitFor(t, "call in flight", func() bool {
+		b.tagMapLock.Lock()
+		defer b.tagMapLock.Unlock()
+		return len(b.tagMap) == 1
+	})
+
+	if n, err := b.DrainMethod("Work", 50*time.Millisecond); n != 1 || err != ErrTimeout {
+		t.Errorf("DrainMethod with a call in flight = %d, %v, want 1, ErrTimeout", n, err)
+	}
+	var reply int
+	if err := c.Call("Work", 2, &reply); err != ErrFail {
+		t.Errorf("Call of a drained function = %v, want ErrFail", err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("Call in flight while draining = %v", err)
+	}
+	if n, err := b.DrainMethod("Work", time.Second); n != 0 || err != nil {
+		t.Errorf("DrainMethod once idle = %d, %v", n, err)
+	}
+	if _, err := b.DrainMethod("Missing", time.Second); err == nil || !strings.Contains(err.Error(), "Missing") {
+		t.Errorf("DrainMethod of unregistered name = %v", err)
+	}
+}
+
+// Close stops Listen, removes the socket file and wakes pending calls with ErrClosed, and calling it again does nothing.
+func TestClose(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	sock := tempSocket(t)
+	b := newRouter(t)
+	errs := make(chan error, 1)
+	go func() { errs <- b.Listen(sock) }()
+	<-b.Started()
+	newClient(t, sock, map[string]interface{}{
+		"Block": func(arg int, reply *int) error { <-release; return nil },
+	})
+	waitRoute(t, b, "Block")
+
+	done := make(chan error, 1)
+	go func() {
+		var reply int
+		done <- b.Call("Block", 1, &reply)
+	}()
+	waitFor(t, "call to be sent", func() bool { return len(b.Dump().Buckets) == 1 })
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, ch := range []chan error{done, errs} {
+		select {
+		case err := <-ch:
+			if err != ErrClosed {
+				t.Errorf("Call and Listen after Close = %v, want ErrClosed", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Call or Listen still waiting after Close.")
+		}
+	}
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("Socket file left after Close: %v", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Errorf("Second Close = %v", err)
+	}
+}
+
+// Peers closing with a goodbye are shutting down on purpose, so quickly closing again and again doesn't put them in cooldown.
+func TestGoodbye(t *testing.T) {
+	log := new(testLogger)
+	b := newRouter(t)
+	b.SetLogger(log)
+	b.SetConnectCooldown(time.Minute)
+	addr := listenTCP(t, b)
+
+	for i := 0; i <= maxPeerFailures; i++ {
+		c := newRouter(t)
+		c.SetDialer(func(network, address string) (net.Conn, error) { return net.Dial("tcp", address) })
+		if err := c.Dial(addr); err != nil {
+			t.Fatalf("Dial %d: %s", i, err)
+		}
+		waitFor(t, "connection", func() bool { return len(b.Dump().Conns) == 1 })
+		c.Close()
+		waitFor(t, "disconnect", func() bool { return len(b.Dump().Conns) == 0 })
+	}
+	if !log.logged("closing at peer's request") {
+		t.Error("Goodbye from closing peers not recieved.")
+	}
+	if n := b.Stats().RefusedConns; n != 0 {
+		t.Errorf("RefusedConns = %d after peers said goodbye, want 0", n)
+	}
+}
+
+// Close waits on every reciever, even those of connections accepted while it is closing, and none start after it.
+func TestCloseWhileConnecting(t *testing.T) {
+	b, sock := newBroker(t)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				c := New()
+				c.Dial(sock)
+				c.Close()
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := b.Close(); err != nil {
+		t.Errorf("Close = %v", err)
+	}
+	close(stop)
+	wg.Wait()
+
+	b.recv_lock.Lock()
+	running := b.recv_count
+	b.recv_lock.Unlock()
+	if running != 0 {
+		t.Errorf("%d recievers running after Close.", running)
+	}
+	if b.startReciever() {
+		t.Errorf("Reciever started after Close.")
+	}
+}
@@ -0,0 +1,35 @@
+package ezipc
+
+import (
+	"sync/atomic"
+)
+
+// WithConnectHook calls hook with each connection we dial or accept, before any frames are read from it.
+// Hooks run on the goroutine opening the connection, so should return quickly.
+func WithConnectHook(hook func(c ConnInfo)) Option {
+	return func(e *EzIPC) {
+		e.connect_hook = hook
+	}
+}
+
+// WithDisconnectHook calls hook once for each connection as it closes, before its routes are removed,
+// so ConnInfo.Routes still lists what the peer provided.
+func WithDisconnectHook(hook func(c ConnInfo)) Option {
+	return func(e *EzIPC) {
+		e.disconnect_hook = hook
+	}
+}
+
+// Reports connection c to the connect hook.
+func (e *EzIPC) onConnect(c *connection) {
+	if e.connect_hook != nil {
+		e.connect_hook(c.info())
+	}
+}
+
+// Reports connection c to the disconnect hook, the first time it closes.
+func (e *EzIPC) onDisconnect(c *connection) {
+	if e.disconnect_hook != nil && atomic.CompareAndSwapUint32(&c.disconnected, 0, 1) {
+		e.disconnect_hook(c.info())
+	}
+}
@@ -0,0 +1,58 @@
+package ezipc
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// Hooks see each connection open once and close once, with the routes it provided as it closes.
+func TestConnectHooks(t *testing.T) {
+	var lock sync.Mutex
+	opened := make(map[string]int)
+	closed := make(map[string][]string)
+	b, sock := newBroker(t, WithConnectHook(func(c ConnInfo) {
+		lock.Lock()
+		opened[c.ID]++
+		lock.Unlock()
+	}), WithDisconnectHook(func(c ConnInfo) {
+		lock.Lock()
+		closed[c.ID] = append(closed[c.ID], c.Routes...)
+		lock.Unlock()
+	}))
+
+	dialed := make(chan ConnInfo, 1)
+	p := newClient(t, sock, map[string]interface{}{
+		"Echo": func(arg int, reply *int) error { *reply = arg; return nil },
+	}, WithConnectHook(func(c ConnInfo) { dialed <- c }))
+	waitRoute(t, b, "Echo")
+	if c := <-dialed; c.Addr != sock {
+		t.Errorf("Connect hook of dialer saw %q, want %q", c.Addr, sock)
+	}
+
+	lock.Lock()
+	var id string
+	for k, n := range opened {
+		id = k
+		if n != 1 {
+			t.Errorf("Connect hook called %d times for %s, want once.", n, k)
+		}
+	}
+	lock.Unlock()
+	if id == "" {
+		t.Fatal("Connect hook not called for the accepted connection.")
+	}
+
+	p.Close()
+	waitFor(t, "disconnect hook", func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		_, ok := closed[id]
+		return ok
+	})
+	lock.Lock()
+	defer lock.Unlock()
+	if routes := closed[id]; !reflect.DeepEqual(routes, []string{"Echo"}) {
+		t.Errorf("Disconnect hook saw routes %v, want [Echo] once.", routes)
+	}
+}
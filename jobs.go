@@ -0,0 +1,199 @@
+package ezipc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// ErrPending is returned by Result while the submitted call is still running.
+var ErrPending = errors.New("Result not yet available.")
+
+// ErrJobsRefused is returned by Submit when the broker does not accept submitted calls.
+var ErrJobsRefused = errors.New("Submitted calls are not accepted.")
+
+// ErrUnknownToken is returned by Result for tokens which were never issued, or whose result has expired.
+var ErrUnknownToken = errors.New("Unknown or expired token.")
+
+// How long submitted calls may run, and their results are kept, unless changed with SetJobTTL.
+const defaultJobTTL = 10 * time.Minute
+
+// Submitted calls kept at once unless changed with SetMaxJobs.
+const defaultMaxJobs = 1024
+
+// Call submitted to the broker, the argument already encoded by the submitter.
+type submission struct {
+	Name string
+	Arg  []byte
+}
+
+// Submitted call and its result once complete.
+type job struct {
+	name  string
+	done  bool
+	reply []byte
+	err   error
+}
+
+// Submitted calls by token.
+type jobTable struct {
+	lock sync.Mutex
+	jobs map[string]*job
+	ttl  time.Duration
+	max  int
+}
+
+// Encoded argument passed through call without being marshaled again.
+type rawArg []byte
+
+// SetJobTTL sets how long a call submitted to this router may run, timing out with ErrTimeout once it passes,
+// and how long its result is kept once complete, 0 restores the default of 10 minutes.
+func (e *EzIPC) SetJobTTL(d time.Duration) {
+	e.jobs.lock.Lock()
+	defer e.jobs.lock.Unlock()
+	e.jobs.ttl = d
+}
+
+// SetMaxJobs limits the calls submitted to this router which are running or holding a result to n,
+// further submissions fail with ErrBusy, 0 restores the default of 1024 and a negative n refuses submissions altogether.
+func (e *EzIPC) SetMaxJobs(n int) {
+	e.jobs.lock.Lock()
+	defer e.jobs.lock.Unlock()
+	e.jobs.max = n
+}
+
+// Submit queues a call of name with arg on the broker, returning a token to retrieve its result with Result.
+// The broker makes the call on our behalf, so the result is available even if we disconnect in the meantime.
+// Fails with ErrBusy while the broker holds as many submitted calls as SetMaxJobs allows.
+//
+// Any peer connected to the broker may submit calls, which the broker then makes with its own routes,
+// so brokers restrict who may connect with SetPSK, or refuse submissions with a negative SetMaxJobs.
+// Results are only handed out for the token, which is random and known only to the submitter.
+func (e *EzIPC) Submit(name string, arg interface{}) (token string, err error) {
+	data, err := e.codec.Marshal(arg)
+	if err != nil {
+		return "", fmt.Errorf("Submit %s: marshaling arg: %w", name, err)
+	}
+	err = e.Call("ezipc.Submit", submission{Name: name, Arg: data}, &token)
+	return
+}
+
+// Result retrieves the reply of a call queued with Submit into reply, returning the error of the call.
+// Returns ErrPending while the call is still running, so callers may poll until it completes.
+func (e *EzIPC) Result(token string, reply interface{}) error {
+	if reply != nil && reflect.ValueOf(reply).Kind() != reflect.Ptr {
+		return ErrReplyNotPointer
+	}
+	var data []byte
+	if err := e.Call("ezipc.Result", token, &data); err != nil {
+		return err
+	}
+	if reply == nil || len(data) == 0 {
+		return nil
+	}
+	return e.codec.Unmarshal(data, reply)
+}
+
+// Starts a submitted call, answering with its token.
+func (e *EzIPC) submit(s submission, token *string) error {
+	b := make([]byte, 16)
+	rand.Read(b)
+	*token = hex.EncodeToString(b)
+
+	j := &job{name: s.Name}
+	e.jobs.lock.Lock()
+	max, ttl := e.jobs.max, e.jobs.ttl
+	if max < 0 {
+		e.jobs.lock.Unlock()
+		*token = ""
+		return ErrJobsRefused
+	}
+	if max == 0 {
+		max = defaultMaxJobs
+	}
+	if ttl <= 0 {
+		ttl = defaultJobTTL
+	}
+	if len(e.jobs.jobs) >= max {
+		e.jobs.lock.Unlock()
+		*token = ""
+		return ErrBusy
+	}
+	if e.jobs.jobs == nil {
+		e.jobs.jobs = make(map[string]*job)
+	}
+	e.jobs.jobs[*token] = j
+	e.jobs.lock.Unlock()
+
+	// The call is given up on once the TTL has passed since it was submitted, so a job never outlives it by more than the TTL.
+	ctx, cancel := context.WithTimeout(context.Background(), ttl)
+
+	id := *token
+	e.spawn(func() {
+		defer cancel()
+
+		// Handlers we execute ourselves run to completion regardless of ctx, so the job doesn't wait on them past the TTL.
+		type outcome struct {
+			reply []byte
+			err   error
+		}
+		finished := make(chan outcome, 1)
+		go func() {
+			var o outcome
+			resp, err := e.call(ctx, &msg{Dst: s.Name}, rawArg(s.Arg), nil)
+			if o.err = err; resp != nil && err == nil {
+				o.reply, o.err = resp.payload()
+			}
+			finished <- o
+		}()
+
+		var reply []byte
+		var err error
+		select {
+		case o := <-finished:
+			reply, err = o.reply, o.err
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err == context.DeadlineExceeded {
+			err = ErrTimeout
+		}
+
+		e.jobs.lock.Lock()
+		j.done, j.reply, j.err = true, reply, err
+		e.jobs.lock.Unlock()
+
+		time.AfterFunc(ttl, func() {
+			e.jobs.lock.Lock()
+			delete(e.jobs.jobs, id)
+			e.jobs.lock.Unlock()
+		})
+	})
+	return nil
+}
+
+// Answers with the encoded reply of a submitted call, or its error.
+func (e *EzIPC) result(token string, reply *[]byte) error {
+	e.jobs.lock.Lock()
+	defer e.jobs.lock.Unlock()
+
+	j, ok := e.jobs.jobs[token]
+	switch {
+	case !ok:
+		return ErrUnknownToken
+	case !j.done:
+		return ErrPending
+	}
+	*reply = j.reply
+	// The error belongs to the submitted call, not to the retrieval of its result.
+	var re *RemoteError
+	if errors.As(j.err, &re) {
+		return &RemoteError{Method: j.name, Msg: re.Msg}
+	}
+	return j.err
+}
@@ -0,0 +1,104 @@
+package ezipc
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// A submitted call is made by the broker, its result retrieved with the token once complete.
+func TestSubmit(t *testing.T) {
+	b, sock := newBroker(t)
+	release := make(chan struct{})
+	newClient(t, sock, map[string]interface{}{
+		"Double": func(arg int, reply *int) error { <-release; *reply = arg * 2; return nil },
+		"Fails":  func(arg int, reply *int) error { return errors.New("Failed.") },
+	})
+	waitRoute(t, b, "Double")
+	waitRoute(t, b, "Fails")
+	c := newClient(t, sock, nil)
+
+	token, err := c.Submit("Double", 21)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply int
+	if err := c.Result(token, &reply); err != ErrPending {
+		t.Errorf("Result while running = %v, want ErrPending", err)
+	}
+	close(release)
+	waitFor(t, "submitted call", func() bool { return c.Result(token, &reply) != ErrPending })
+	if err := c.Result(token, &reply); err != nil || reply != 42 {
+		t.Errorf("Result = %d, %v, want 42", reply, err)
+	}
+
+	token, err = c.Submit("Fails", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "submitted call", func() bool { return c.Result(token, nil) != ErrPending })
+	if err := c.Result(token, nil); err == nil || err.Error() != "Failed." {
+		t.Errorf("Result of failed call = %v, want its error", err)
+	}
+
+	if err := c.Result("unknown", nil); err != ErrUnknownToken {
+		t.Errorf("Result of unknown token = %v, want ErrUnknownToken", err)
+	}
+}
+
+// Submissions past SetMaxJobs fail with ErrBusy, and calls running past the TTL time out.
+func TestSubmitLimits(t *testing.T) {
+	b, sock := newBroker(t)
+	b.SetMaxJobs(1)
+	b.SetJobTTL(200 * time.Millisecond)
+	hang := make(chan struct{})
+	defer close(hang)
+	newClient(t, sock, map[string]interface{}{
+		"Hang": func(arg int, reply *int) error { <-hang; return nil },
+	})
+	waitRoute(t, b, "Hang")
+	c := newClient(t, sock, nil)
+
+	token, err := c.Submit("Hang", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Submit("Hang", 2); err != ErrBusy {
+		t.Errorf("Submit past SetMaxJobs = %v, want ErrBusy", err)
+	}
+	waitFor(t, "submitted call to time out", func() bool { return c.Result(token, nil) != ErrPending })
+	if err := c.Result(token, nil); err != ErrTimeout {
+		t.Errorf("Result of call past the TTL = %v, want ErrTimeout", err)
+	}
+}
+
+// Errors of submitted calls name the method submitted, not the retrieval of the result.
+func TestSubmitError(t *testing.T) {
+	b, sock := newBroker(t)
+	newClient(t, sock, map[string]interface{}{
+		"Fails": func(arg int, reply *int) error { return errors.New("Failed.") },
+	})
+	waitRoute(t, b, "Fails")
+	c := newClient(t, sock, nil)
+
+	token, err := c.Submit("Fails", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "submitted call", func() bool { return !errors.Is(c.Result(token, nil), ErrPending) })
+
+	var re *RemoteError
+	if err := c.Result(token, nil); !errors.As(err, &re) || re.Method != "Fails" || re.Msg != "Failed." {
+		t.Errorf("Result = %#v, want RemoteError of Fails", err)
+	}
+}
+
+// Brokers refuse submitted calls with a negative SetMaxJobs.
+func TestSubmitRefused(t *testing.T) {
+	b, sock := newBroker(t)
+	b.SetMaxJobs(-1)
+	c := newClient(t, sock, nil)
+	if _, err := c.Submit("Anything", 1); !errors.Is(err, ErrJobsRefused) {
+		t.Errorf("Submit = %v, want ErrJobsRefused", err)
+	}
+}
@@ -0,0 +1,280 @@
+package ezipc
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Concurrent connections accepted by Listen unless changed with SetLimiter.
+const defaultLimit = 256
+
+// SetLimiter caps the connections Listen serves at once to n, further accepts wait until a connection closes.
+// Must be called before Listen, the default is 256.
+func (e *EzIPC) SetLimiter(n int) {
+	if n < 1 {
+		n = defaultLimit
+	}
+	e.limiter = make(chan struct{}, n)
+}
+
+// WithMaxInflight limits the calls we may have outstanding on a single connection to n, further calls wait until one completes,
+// or their context is done. Calls in flight are reported by Stats.
+func WithMaxInflight(n int) Option {
+	return func(e *EzIPC) {
+		e.max_inflight = n
+	}
+}
+
+// Takes a slot for a call over c, waiting on one to free up while c is at its limit of calls in flight.
+func (c *connection) acquire(ctx context.Context) error {
+	if c.slots != nil {
+		select {
+		case c.slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	atomic.AddInt64(&c.router.counters.inflight_calls, 1)
+	return nil
+}
+
+// Releases the slot of a call over c once it completes.
+func (c *connection) release() {
+	atomic.AddInt64(&c.router.counters.inflight_calls, -1)
+	if c.slots != nil {
+		<-c.slots
+	}
+}
+
+// Handlers a single connection may have executing at once unless changed with SetMaxConcurrentExecs.
+const defaultMaxExecs = 64
+
+// SetMaxConcurrentExecs bounds the handlers executing at once for calls from a single connection to n, 0 restores the default of 64.
+// Further calls from the connection wait their turn, so one client cannot exhaust goroutines. Pairs with SetMaxFramesPerRead.
+func (e *EzIPC) SetMaxConcurrentExecs(n int) {
+	e.max_execs = n
+}
+
+// Runs handler f for a call from c, queueing it while c is at its limit of executing handlers.
+// Handlers queued are run in turn by the goroutines of those finishing.
+func (c *connection) runExec(f func()) {
+	c.exec_lock.Lock()
+	if c.exec_running >= c.router.execLimit() {
+		c.exec_queue = append(c.exec_queue, f)
+		c.exec_lock.Unlock()
+		return
+	}
+	c.exec_running++
+	c.exec_lock.Unlock()
+
+	c.router.spawn(func() { c.execLoop(f) })
+}
+
+// Returns the handlers a single connection may have executing at once.
+func (e *EzIPC) execLimit() int {
+	if e.max_execs <= 0 {
+		return defaultMaxExecs
+	}
+	return e.max_execs
+}
+
+// Runs f, then calls queued on c in turn until none are left.
+func (c *connection) execLoop(f func()) {
+	for f != nil {
+		f()
+		c.exec_lock.Lock()
+		if len(c.exec_queue) > 0 {
+			f = c.exec_queue[0]
+			c.exec_queue[0] = nil
+			c.exec_queue = c.exec_queue[1:]
+		} else {
+			f = nil
+			c.exec_running--
+		}
+		c.exec_lock.Unlock()
+	}
+}
+
+// Gives up the place of a handler executing for c while it waits on other calls, such as the rest of its batch,
+// starting the next call queued in its place. Paired with resumeExec once it is done waiting.
+func (c *connection) suspendExec() {
+	c.exec_lock.Lock()
+	c.exec_running--
+	var next func()
+	if len(c.exec_queue) > 0 && c.exec_running < c.router.execLimit() {
+		next = c.exec_queue[0]
+		c.exec_queue[0] = nil
+		c.exec_queue = c.exec_queue[1:]
+		c.exec_running++
+	}
+	c.exec_lock.Unlock()
+
+	if next != nil {
+		c.router.spawn(func() { c.execLoop(next) })
+	}
+}
+
+// Takes back the place of a handler given up by suspendExec, the handler having finished waiting.
+func (c *connection) resumeExec() {
+	c.exec_lock.Lock()
+	c.exec_running++
+	c.exec_lock.Unlock()
+}
+
+// Connections closing sooner than this after being accepted count as failures toward a cooldown.
+const shortLived = time.Second
+
+// Failures of a peer which trigger its cooldown.
+const maxPeerFailures = 3
+
+// Throttles accepted connections.
+type admission struct {
+	lock sync.Mutex
+	// At most rate connections accepted per window.
+	rate         int
+	window       time.Duration
+	window_start time.Time
+	accepted     int
+	// Peers with repeated short lived connections are refused for cooldown.
+	cooldown time.Duration
+	failures map[string]int
+	until    map[string]time.Time
+}
+
+// SetConnectRate throttles Listen to accepting at most n connections per window, 0 disables.
+func (e *EzIPC) SetConnectRate(n int, per time.Duration) {
+	e.admit.lock.Lock()
+	defer e.admit.lock.Unlock()
+	e.admit.rate = n
+	e.admit.window = per
+}
+
+// SetConnectCooldown refuses connections from a peer for d after it repeatedly connects and disconnects, 0 disables.
+// Peers are identified by host over TCP, and by user ID over unix sockets where their credentials can be read.
+func (e *EzIPC) SetConnectCooldown(d time.Duration) {
+	e.admit.lock.Lock()
+	defer e.admit.lock.Unlock()
+	e.admit.cooldown = d
+}
+
+// Identifies the peer of a connection from addr with credentials peer, empty when it cannot be identified.
+// The port is left out, as each connection from a host is made from a new one.
+func peerKey(addr string, peer *PeerCred) string {
+	if peer != nil {
+		return fmt.Sprintf("uid:%d", peer.UID)
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return ""
+}
+
+// Determines if newly accepted connection from the peer identified by key should be kept, waiting out the connect rate if needed.
+// The wait is taken without holding the admission lock, so connections closing meanwhile are not held up.
+func (e *EzIPC) admitConn(key string) bool {
+	a := &e.admit
+	a.lock.Lock()
+
+	if until, ok := a.until[key]; ok && key != "" {
+		if time.Now().Before(until) {
+			a.lock.Unlock()
+			atomic.AddUint64(&e.counters.refused_conns, 1)
+			return false
+		}
+		delete(a.until, key)
+	}
+
+	var wait time.Duration
+	if a.rate > 0 {
+		now := time.Now()
+		if now.Sub(a.window_start) >= a.window {
+			a.window_start = now
+			a.accepted = 0
+		}
+		if a.accepted >= a.rate {
+			atomic.AddUint64(&e.counters.throttled_conns, 1)
+			e.logf("Connect rate of %d per %v exceeded, throttling accept.", a.rate, a.window)
+			// The next window starts once the wait is over.
+			wait = a.window - now.Sub(a.window_start)
+			a.window_start = now.Add(wait)
+			a.accepted = 0
+		}
+		a.accepted++
+	}
+	a.lock.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return true
+}
+
+// Records closing of an accepted connection, putting peers which repeatedly disconnect quickly into cooldown.
+func (e *EzIPC) connClosed(c *connection) {
+	key := peerKey(c.addr, c.peer)
+
+	a := &e.admit
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.cooldown == 0 || key == "" || c.closing() || time.Since(c.opened) >= shortLived {
+		return
+	}
+	if a.failures == nil {
+		a.failures = make(map[string]int)
+		a.until = make(map[string]time.Time)
+	}
+	a.failures[key]++
+	if a.failures[key] >= maxPeerFailures {
+		delete(a.failures, key)
+		a.until[key] = time.Now().Add(a.cooldown)
+		e.logf("Peer %s repeatedly disconnected, refusing connections for %v.", key, a.cooldown)
+	}
+}
+
+// SetMemoryLimit sheds new calls with ErrBusy once pending payloads and buffered frames reach n bytes, 0 is unlimited.
+func (e *EzIPC) SetMemoryLimit(n int) {
+	e.mem_limit = n
+}
+
+// Accounts for n bytes, negative once released.
+func (e *EzIPC) useMem(n int) {
+	if n != 0 {
+		atomic.AddInt64(&e.counters.mem_used, int64(n))
+	}
+}
+
+// Accounts for n bytes if it keeps us within the memory limit, reporting if it did.
+func (e *EzIPC) reserveMem(n int) bool {
+	if e.mem_limit > 0 && atomic.LoadInt64(&e.counters.mem_used)+int64(n) > int64(e.mem_limit) {
+		return false
+	}
+	e.useMem(n)
+	return true
+}
+
+// SetMaxFieldSize fails calls whose argument or reply decodes to more than n bytes before decoding them, 0 is unlimited.
+// Unlike SetMaxFrameSize it applies to each field, bounding what a handler allocates for a single value.
+func (e *EzIPC) SetMaxFieldSize(n int) {
+	e.max_field = n
+}
+
+// Decodes a base64 encoded field, failing with ErrTooLarge without decoding if it exceeds the field limit.
+func (e *EzIPC) decodeField(field string) ([]byte, error) {
+	if e.max_field > 0 {
+		if n := base64.StdEncoding.DecodedLen(len(field)); n > e.max_field {
+			return nil, fmt.Errorf("Field of %d bytes exceeds maximum field size of %d bytes: %w", n, e.max_field, ErrTooLarge)
+		}
+	}
+	return base64.StdEncoding.DecodeString(field)
+}
+
+// Size of the payload carried by m.
+func (m *msg) size() int {
+	return len(m.Va1) + len(m.Va2) + len(m.Blob)
+}
@@ -0,0 +1,316 @@
+package ezipc
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Starts b serving a TCP listener on loopback, returning its address.
+func listenTCP(t testing.TB, b *EzIPC) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go b.ListenWith(l)
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().String()
+}
+
+// Reports whether conn was closed by the broker rather than left open.
+func refused(t testing.TB, conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return true
+}
+
+// Accepts over the connect rate wait out the rest of the window.
+func TestConnectRate(t *testing.T) {
+	b := newRouter(t)
+	b.SetConnectRate(2, 300*time.Millisecond)
+	addr := listenTCP(t, b)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	waitFor(t, "third connection", func() bool {
+		b.connMapLock.RLock()
+		defer b.connMapLock.RUnlock()
+		return len(b.conns) == 3
+	})
+	if d := time.Since(start); d < 250*time.Millisecond {
+		t.Errorf("Third connection accepted after %v, want the window to pass first", d)
+	}
+	if n := b.Stats().ThrottledConns; n != 1 {
+		t.Errorf("ThrottledConns = %d, want 1", n)
+	}
+}
+
+// A host repeatedly connecting and disconnecting is refused until its cooldown passes.
+func TestConnectCooldown(t *testing.T) {
+	b := newRouter(t)
+	b.SetConnectCooldown(300 * time.Millisecond)
+	addr := listenTCP(t, b)
+
+	for i := 0; i < maxPeerFailures; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "connection", func() bool {
+			b.connMapLock.RLock()
+			defer b.connMapLock.RUnlock()
+			return len(b.conns) == 1
+		})
+		conn.Close()
+		waitFor(t, "disconnect", func() bool {
+			b.connMapLock.RLock()
+			defer b.connMapLock.RUnlock()
+			return len(b.conns) == 0
+		})
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !refused(t, conn) {
+		t.Error("Connection accepted from a host in cooldown.")
+	}
+	if n := b.Stats().RefusedConns; n != 1 {
+		t.Errorf("RefusedConns = %d, want 1", n)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if refused(t, conn) {
+		t.Error("Connection refused once the cooldown passed.")
+	}
+}
+
+// Calls are shed with ErrBusy while pending payloads would exceed the memory limit, which is given back as they complete.
+func TestMemoryLimit(t *testing.T) {
+	release := make(chan struct{})
+	b, sock := newBroker(t)
+	b.SetMemoryLimit(6000)
+	newClient(t, sock, map[string]interface{}{
+		"Slow": func(arg string, reply *int) error { <-release; *reply = len(arg); return nil },
+		"Echo": func(arg string, reply *int) error { *reply = len(arg); return nil },
+	})
+	waitRoute(t, b, "Slow")
+	waitRoute(t, b, "Echo")
+	c := newClient(t, sock, nil)
+
+	big := strings.Repeat("x", 3000)
+	done := make(chan error, 1)
+	go func() {
+		var reply int
+		done <- c.Call("Slow", big, &reply)
+	}()
+	waitFor(t, "pending call", func() bool { return b.Stats().MemoryUsed > 3000 })
+	var reply int
+	if err := c.Call("Echo", big, &reply); err != ErrBusy {
+		t.Errorf("Call over the memory limit = %v, want ErrBusy", err)
+	}
+	if err := c.Call("Echo", "small", &reply); err != nil {
+		t.Errorf("Call within the memory limit = %v", err)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	waitFor(t, "memory to be released", func() bool { return b.Stats().MemoryUsed == 0 })
+}
+
+// A peer sending a frame over the maximum size is disconnected, while frames larger than the read buffer are still read whole.
+func TestMaxFrameSize(t *testing.T) {
+	sock := tempSocket(t)
+	b := newRouter(t)
+	b.SetMaxFrameSize(64 << 10)
+	listen(t, b, sock)
+	newClient(t, sock, map[string]interface{}{
+		"Echo": func(arg string, reply *string) error { *reply = arg; return nil },
+	})
+	waitRoute(t, b, "Echo")
+	c := newClient(t, sock, nil)
+
+	big := strings.Repeat("x", 32<<10)
+	var reply string
+	if err := c.Call("Echo", big, &reply); err != nil || reply != big {
+		t.Fatalf("Call with a %d byte argument = %d bytes, %v", len(big), len(reply), err)
+	}
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(strings.Repeat("x", 128<<10)))
+	waitFor(t, "oversized frame to be refused", func() bool { return b.Stats().DecodeErrors == 1 })
+	if !refused(t, conn) {
+		t.Error("Connection sending an oversized frame was left open.")
+	}
+}
+
+// Arguments decoding to more than the field limit fail the call without reaching the handler.
+func TestMaxFieldSize(t *testing.T) {
+	b, sock := newBroker(t)
+	p := newRouter(t)
+	p.SetMaxFieldSize(1024)
+	var called bool
+	p.RegisterName("Echo", func(arg string, reply *string) error { called = true; *reply = arg; return nil })
+	if err := p.Dial(sock); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	waitRoute(t, b, "Echo")
+	c := newClient(t, sock, nil)
+
+	var reply string
+	if err := c.Call("Echo", "small", &reply); err != nil || reply != "small" {
+		t.Fatalf("Call under the field limit = %q, %v", reply, err)
+	}
+	called = false
+	err := c.Call("Echo", strings.Repeat("x", 4096), &reply)
+	if err == nil || !strings.Contains(err.Error(), "exceeds maximum field size of 1024 bytes") {
+		t.Errorf("Call over the field limit = %v, want the field size refused", err)
+	}
+	if called {
+		t.Error("Handler invoked with an argument over the field limit.")
+	}
+}
+
+// Once the limiter is full, connections wait to be served until one closes.
+func TestLimiter(t *testing.T) {
+	sock := tempSocket(t)
+	b := newRouter(t)
+	b.SetLimiter(1)
+	listen(t, b, sock)
+	served := func() int { return len(b.Dump().Conns) }
+
+	first := newClient(t, sock, nil)
+	waitFor(t, "first connection", func() bool { return served() == 1 })
+	id := b.Dump().Conns[0].ID
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	if n := served(); n != 1 {
+		t.Fatalf("%d connections served with a limit of 1", n)
+	}
+
+	first.Close()
+	waitFor(t, "waiting connection to be served", func() bool {
+		conns := b.Dump().Conns
+		return len(conns) == 1 && conns[0].ID != id
+	})
+}
+
+// Calls from a single connection beyond its limit of executing handlers wait their turn, and all complete.
+func TestMaxConcurrentExecs(t *testing.T) {
+	b, sock := newBroker(t)
+	p := newRouter(t)
+	p.SetMaxConcurrentExecs(2)
+	var lock sync.Mutex
+	var running, peak int
+	p.RegisterName("Work", func(arg int, reply *int) error {
+		lock.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		lock.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		lock.Lock()
+		running--
+		lock.Unlock()
+		*reply = arg
+		return nil
+	})
+	if err := p.Dial(sock); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	waitRoute(t, b, "Work")
+	c := newClient(t, sock, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var reply int
+			if err := c.Call("Work", i, &reply); err != nil || reply != i {
+				t.Errorf("Work(%d) = %d, %v", i, reply, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if peak != 2 {
+		t.Errorf("%d handlers ran at once for one connection, want 2", peak)
+	}
+}
+
+// Calls past WithMaxInflight wait on one to complete, giving up once their deadline passes.
+func TestMaxInflight(t *testing.T) {
+	b, sock := newBroker(t)
+	release := make(chan struct{})
+	newClient(t, sock, map[string]interface{}{
+		"Hold": func(arg int, reply *int) error { <-release; *reply = arg; return nil },
+	})
+	waitRoute(t, b, "Hold")
+	c := newClient(t, sock, nil, WithMaxInflight(1))
+
+	first := make(chan error, 1)
+	go func() {
+		var reply int
+		first <- c.Call("Hold", 1, &reply)
+	}()
+	waitFor(t, "call in flight", func() bool { return c.Stats().InflightCalls == 1 })
+
+	var reply int
+	if err := c.CallTimeout("Hold", 2, &reply, 50*time.Millisecond); err != ErrTimeout {
+		t.Errorf("Call past the limit = %v, want ErrTimeout", err)
+	}
+	second := make(chan error, 1)
+	go func() {
+		var reply int
+		second <- c.Call("Hold", 3, &reply)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if n := c.Stats().InflightCalls; n != 1 {
+		t.Errorf("%d calls in flight past a limit of 1.", n)
+	}
+
+	close(release)
+	for _, ch := range []chan error{first, second} {
+		if err := <-ch; err != nil {
+			t.Errorf("Call = %v", err)
+		}
+	}
+	if n := c.Stats().InflightCalls; n != 0 {
+		t.Errorf("%d calls in flight once all completed, want 0.", n)
+	}
+}
@@ -0,0 +1,148 @@
+package ezipc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MethodStats holds counters of the calls of a single name, as made, executed or relayed by the router.
+type MethodStats struct {
+	// "call", "exec" or "relay", as in CallTrace.
+	Kind string
+	Name string
+	// Calls completed, those which failed, and their total duration.
+	Calls    uint64
+	Errors   uint64
+	Duration time.Duration
+}
+
+// Counters of calls by kind and name.
+type methodTable struct {
+	lock  sync.Mutex
+	stats map[[2]string]*MethodStats
+}
+
+// Counts a completed call.
+func (m *methodTable) record(kind, name string, d time.Duration, failed bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.stats == nil {
+		m.stats = make(map[[2]string]*MethodStats)
+	}
+	key := [2]string{kind, name}
+	s := m.stats[key]
+	if s == nil {
+		s = &MethodStats{Kind: kind, Name: name}
+		m.stats[key] = s
+	}
+	s.Calls++
+	s.Duration += d
+	if failed {
+		s.Errors++
+	}
+}
+
+// MethodStats returns counters of calls by kind and name, sorted by kind then name.
+func (e *EzIPC) MethodStats() (stats []MethodStats) {
+	e.methods.lock.Lock()
+	for _, s := range e.methods.stats {
+		stats = append(stats, *s)
+	}
+	e.methods.lock.Unlock()
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Kind != stats[j].Kind {
+			return stats[i].Kind < stats[j].Kind
+		}
+		return stats[i].Name < stats[j].Name
+	})
+	return
+}
+
+// Escapes a Prometheus label value.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WriteMetrics writes the router's counters to w in the Prometheus text exposition format, for serving from a /metrics handler.
+// Metric names are stable across versions:
+//
+//	ezipc_decode_errors_total              frames recieved which could not be decoded
+//	ezipc_connection_resets_total          connections closed due to read errors
+//	ezipc_send_errors_total                frames which failed to send
+//	ezipc_throttled_connections_total      accepts delayed by the connect rate
+//	ezipc_refused_connections_total        connections refused from peers in cooldown
+//	ezipc_memory_used_bytes                pending payloads and buffered frames
+//	ezipc_connections                      open connections
+//	ezipc_pending_calls{kind}              calls waiting on a reply, by kind: request, relay or exec
+//	ezipc_calls_total{kind,name}           calls completed, by kind: call, exec or relay
+//	ezipc_call_errors_total{kind,name}     calls completed with an error
+//	ezipc_call_duration_seconds{kind,name} summary of call durations
+func (e *EzIPC) WriteMetrics(w io.Writer) error {
+	var buf bytes.Buffer
+
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	s := e.Stats()
+	for _, c := range []struct {
+		name, help string
+		value      uint64
+	}{
+		{"ezipc_decode_errors_total", "Frames recieved which could not be decoded.", s.DecodeErrors},
+		{"ezipc_connection_resets_total", "Connections closed due to read errors.", s.ConnResets},
+		{"ezipc_send_errors_total", "Frames which failed to send.", s.SendErrors},
+		{"ezipc_throttled_connections_total", "Accepts delayed by the connect rate.", s.ThrottledConns},
+		{"ezipc_refused_connections_total", "Connections refused from peers in cooldown.", s.RefusedConns},
+	} {
+		metric(c.name, "counter", c.help)
+		fmt.Fprintf(&buf, "%s %d\n", c.name, c.value)
+	}
+
+	metric("ezipc_memory_used_bytes", "gauge", "Bytes of pending payloads and buffered frames.")
+	fmt.Fprintf(&buf, "ezipc_memory_used_bytes %d\n", s.MemoryUsed)
+
+	e.connMapLock.RLock()
+	conns := len(e.conns)
+	e.connMapLock.RUnlock()
+	metric("ezipc_connections", "gauge", "Open connections.")
+	fmt.Fprintf(&buf, "ezipc_connections %d\n", conns)
+
+	pending := make(map[int]int)
+	e.tagMapLock.Lock()
+	for _, b := range e.tagMap {
+		pending[b.flag]++
+	}
+	e.tagMapLock.Unlock()
+	metric("ezipc_pending_calls", "gauge", "Calls waiting on a reply.")
+	for _, k := range []struct {
+		flag int
+		name string
+	}{{t_REQUEST, "request"}, {t_RELAY, "relay"}, {t_EXEC, "exec"}} {
+		fmt.Fprintf(&buf, "ezipc_pending_calls{kind=%q} %d\n", k.name, pending[k.flag])
+	}
+
+	methods := e.MethodStats()
+	labels := func(m MethodStats) string {
+		return fmt.Sprintf(`{kind="%s",name="%s"}`, m.Kind, labelEscaper.Replace(m.Name))
+	}
+	metric("ezipc_calls_total", "counter", "Calls completed.")
+	for _, m := range methods {
+		fmt.Fprintf(&buf, "ezipc_calls_total%s %d\n", labels(m), m.Calls)
+	}
+	metric("ezipc_call_errors_total", "counter", "Calls completed with an error.")
+	for _, m := range methods {
+		fmt.Fprintf(&buf, "ezipc_call_errors_total%s %d\n", labels(m), m.Errors)
+	}
+	metric("ezipc_call_duration_seconds", "summary", "Duration of completed calls.")
+	for _, m := range methods {
+		fmt.Fprintf(&buf, "ezipc_call_duration_seconds_sum%s %g\n", labels(m), m.Duration.Seconds())
+		fmt.Fprintf(&buf, "ezipc_call_duration_seconds_count%s %d\n", labels(m), m.Calls)
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,56 @@
+package ezipc
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Calls are counted by name on the caller, the broker and the provider, and exported in Prometheus text format.
+func TestMethodStats(t *testing.T) {
+	b, sock := newBroker(t)
+	p := newClient(t, sock, map[string]interface{}{
+		"Echo": func(arg int, reply *int) error { *reply = arg; return nil },
+		"Fail": func(arg int, reply *int) error { return errors.New("failed") },
+	})
+	waitRoute(t, b, "Echo")
+	waitRoute(t, b, "Fail")
+	c := newClient(t, sock, nil)
+
+	var reply int
+	for i := 0; i < 3; i++ {
+		c.Call("Echo", i, &reply)
+	}
+	c.Call("Fail", 1, &reply)
+
+	stats := c.MethodStats()
+	if len(stats) != 2 || stats[0].Name != "Echo" || stats[0].Calls != 3 || stats[0].Errors != 0 || stats[1].Name != "Fail" || stats[1].Errors != 1 {
+		t.Errorf("Caller counted %+v", stats)
+	}
+	for _, r := range []struct {
+		e    *EzIPC
+		kind string
+	}{{b, "relay"}, {p, "exec"}} {
+		waitFor(t, r.kind+" counters", func() bool {
+			stats := r.e.MethodStats()
+			return len(stats) == 2 && stats[0].Kind == r.kind && stats[0].Calls == 3 && stats[1].Errors == 1
+		})
+	}
+
+	var out strings.Builder
+	if err := b.WriteMetrics(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE ezipc_calls_total counter",
+		`ezipc_calls_total{kind="relay",name="Echo"} 3`,
+		`ezipc_call_errors_total{kind="relay",name="Fail"} 1`,
+		`ezipc_call_duration_seconds_count{kind="relay",name="Echo"} 3`,
+		"ezipc_connections 2",
+		`ezipc_pending_calls{kind="relay"} 0`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("WriteMetrics missing %q:\n%s", line, out.String())
+		}
+	}
+}
@@ -0,0 +1,735 @@
+package ezipc
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// MsgpackCodec encodes arguments and replies with MessagePack, more compact than JSON and readable by msgpack libraries in other languages.
+// Struct fields are named as encoding/json would name them, honoring json tags, and types implementing encoding.TextMarshaler are encoded as strings.
+// Combined with WithBinaryFraming the encoded bytes are carried as is, without the base64 of the text framing.
+type MsgpackCodec struct{}
+
+// Written against the MessagePack specification rather than on a msgpack library, as the package otherwise builds on the
+// standard library alone everywhere but Windows, and the codec only needs the subset encoding/json's types map onto.
+// Decoding of untrusted input is covered by FuzzMsgpack and bounded in depth and allocation below.
+
+func (MsgpackCodec) Name() string { return "msgpack" }
+
+func (MsgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var enc mpEncoder
+	if err := enc.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return enc.buf, nil
+}
+
+func (MsgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("msgpack: Unmarshal requires a non-nil pointer, got %T.", v)
+	}
+	dec := mpDecoder{data: data}
+	if err := dec.decode(rv.Elem()); err != nil {
+		return err
+	}
+	if dec.pos != len(data) {
+		return errors.New("msgpack: Trailing data after value.")
+	}
+	return nil
+}
+
+var (
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	anyType             = reflect.TypeOf((*interface{})(nil)).Elem()
+	stringType          = reflect.TypeOf("")
+)
+
+// Struct field as encoded by MsgpackCodec.
+type mpField struct {
+	name      string
+	index     []int
+	omitempty bool
+}
+
+// Lists encoded fields of struct t, flattening untagged embedded structs as encoding/json does.
+func mpFields(t reflect.Type) (fields []mpField) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if n := strings.Index(tag, ","); n >= 0 {
+			name, opts = tag[:n], tag[n+1:]
+		}
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for _, sub := range mpFields(f.Type) {
+				sub.index = append([]int{i}, sub.index...)
+				fields = append(fields, sub)
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, mpField{name: name, index: []int{i}, omitempty: strings.Contains(opts, "omitempty")})
+	}
+	return
+}
+
+// Determines if v is empty for omitempty.
+func mpEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	case reflect.Struct:
+		return false
+	}
+	return v.IsZero()
+}
+
+// Encodes values as MessagePack.
+type mpEncoder struct {
+	buf []byte
+}
+
+// Writes lead byte b followed by n as a big endian integer of size bytes.
+func (m *mpEncoder) head(b byte, n uint64, size int) {
+	m.buf = append(m.buf, b)
+	switch size {
+	case 1:
+		m.buf = append(m.buf, byte(n))
+	case 2:
+		m.buf = binary.BigEndian.AppendUint16(m.buf, uint16(n))
+	case 4:
+		m.buf = binary.BigEndian.AppendUint32(m.buf, uint32(n))
+	case 8:
+		m.buf = binary.BigEndian.AppendUint64(m.buf, n)
+	}
+}
+
+// Writes the header of a string, binary, array or map of length n, fix is the lead byte of the short form, limit its maximum length.
+func (m *mpEncoder) length(n int, fix byte, limit int, b8, b16, b32 byte) {
+	switch {
+	case fix != 0 && n < limit:
+		m.buf = append(m.buf, fix|byte(n))
+	case b8 != 0 && n <= math.MaxUint8:
+		m.head(b8, uint64(n), 1)
+	case n <= math.MaxUint16:
+		m.head(b16, uint64(n), 2)
+	default:
+		m.head(b32, uint64(n), 4)
+	}
+}
+
+func (m *mpEncoder) uint(u uint64) {
+	switch {
+	case u < 0x80:
+		m.buf = append(m.buf, byte(u))
+	case u <= math.MaxUint8:
+		m.head(0xcc, u, 1)
+	case u <= math.MaxUint16:
+		m.head(0xcd, u, 2)
+	case u <= math.MaxUint32:
+		m.head(0xce, u, 4)
+	default:
+		m.head(0xcf, u, 8)
+	}
+}
+
+func (m *mpEncoder) int(i int64) {
+	switch {
+	case i >= 0:
+		m.uint(uint64(i))
+	case i >= -32:
+		m.buf = append(m.buf, byte(i))
+	case i >= math.MinInt8:
+		m.head(0xd0, uint64(i), 1)
+	case i >= math.MinInt16:
+		m.head(0xd1, uint64(i), 2)
+	case i >= math.MinInt32:
+		m.head(0xd2, uint64(i), 4)
+	default:
+		m.head(0xd3, uint64(i), 8)
+	}
+}
+
+func (m *mpEncoder) str(s string) {
+	m.length(len(s), 0xa0, 32, 0xd9, 0xda, 0xdb)
+	m.buf = append(m.buf, s...)
+}
+
+func (m *mpEncoder) bin(b []byte) {
+	m.length(len(b), 0, 0, 0xc4, 0xc5, 0xc6)
+	m.buf = append(m.buf, b...)
+}
+
+func (m *mpEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		m.buf = append(m.buf, 0xc0)
+		return nil
+	}
+
+	if v.Type().Implements(textMarshalerType) && !(v.Kind() == reflect.Ptr && v.IsNil()) {
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return err
+		}
+		m.str(string(text))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			m.buf = append(m.buf, 0xc0)
+			return nil
+		}
+		return m.encode(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			m.buf = append(m.buf, 0xc3)
+		} else {
+			m.buf = append(m.buf, 0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		m.int(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		m.uint(v.Uint())
+	case reflect.Float32:
+		m.head(0xca, uint64(math.Float32bits(float32(v.Float()))), 4)
+	case reflect.Float64:
+		m.head(0xcb, math.Float64bits(v.Float()), 8)
+	case reflect.String:
+		m.str(v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			m.buf = append(m.buf, 0xc0)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if v.Kind() == reflect.Slice {
+				m.bin(v.Bytes())
+			} else {
+				b := make([]byte, v.Len())
+				reflect.Copy(reflect.ValueOf(b), v)
+				m.bin(b)
+			}
+			return nil
+		}
+		m.length(v.Len(), 0x90, 16, 0, 0xdc, 0xdd)
+		for i := 0; i < v.Len(); i++ {
+			if err := m.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			m.buf = append(m.buf, 0xc0)
+			return nil
+		}
+		m.length(v.Len(), 0x80, 16, 0, 0xde, 0xdf)
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := m.encode(iter.Key()); err != nil {
+				return err
+			}
+			if err := m.encode(iter.Value()); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		var fields []mpField
+		for _, f := range mpFields(v.Type()) {
+			if f.omitempty && mpEmpty(v.FieldByIndex(f.index)) {
+				continue
+			}
+			fields = append(fields, f)
+		}
+		m.length(len(fields), 0x80, 16, 0, 0xde, 0xdf)
+		for _, f := range fields {
+			m.str(f.name)
+			if err := m.encode(v.FieldByIndex(f.index)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: Unsupported type %s.", v.Type())
+	}
+	return nil
+}
+
+// Kinds of MessagePack values.
+const (
+	mpNil = iota
+	mpBool
+	mpInt
+	mpUint
+	mpFloat
+	mpStr
+	mpBin
+	mpArray
+	mpMap
+)
+
+// Header of a MessagePack value, scalars carry their value, others their length.
+type mpToken struct {
+	kind int
+	b    bool
+	i    int64
+	u    uint64
+	f    float64
+	n    int
+}
+
+// Deepest nesting of arrays and maps decoded, the limit of encoding/json, so input nested deeper can't exhaust the stack.
+const mpMaxDepth = 10000
+
+// Bytes allocated up front for the elements of an array or map, larger ones grow as their elements are decoded,
+// so a length small on the wire can't allocate beyond what its elements go on to fill.
+const mpMaxAlloc = 1 << 20
+
+// Decodes MessagePack values.
+type mpDecoder struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+var (
+	errMsgpackShort = errors.New("msgpack: Unexpected end of data.")
+	errMsgpackDepth = errors.New("msgpack: Exceeded maximum nesting depth.")
+)
+
+// Enters a nested value, failing once nested beyond mpMaxDepth. Each call is paired with leave.
+func (d *mpDecoder) enter() error {
+	d.depth++
+	if d.depth > mpMaxDepth {
+		return errMsgpackDepth
+	}
+	return nil
+}
+
+func (d *mpDecoder) leave() { d.depth-- }
+
+// Returns n, reduced so n elements of size bytes fit in mpMaxAlloc.
+func mpPrealloc(n int, size uintptr) int {
+	if size > 0 && uintptr(n) > mpMaxAlloc/size {
+		return int(mpMaxAlloc / size)
+	}
+	return n
+}
+
+func (d *mpDecoder) take(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errMsgpackShort
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// Reads a big endian integer of size bytes.
+func (d *mpDecoder) uint(size int) (uint64, error) {
+	b, err := d.take(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// Reads the header of the next value.
+func (d *mpDecoder) next() (t mpToken, err error) {
+	lead, err := d.take(1)
+	if err != nil {
+		return t, err
+	}
+	b := lead[0]
+
+	// Length of the value, when it is read from the following bytes.
+	size, kind := 0, mpNil
+
+	switch {
+	case b <= 0x7f:
+		return mpToken{kind: mpInt, i: int64(b)}, nil
+	case b >= 0xe0:
+		return mpToken{kind: mpInt, i: int64(int8(b))}, nil
+	case b&0xf0 == 0x80:
+		return mpToken{kind: mpMap, n: int(b & 0x0f)}, nil
+	case b&0xf0 == 0x90:
+		return mpToken{kind: mpArray, n: int(b & 0x0f)}, nil
+	case b&0xe0 == 0xa0:
+		return mpToken{kind: mpStr, n: int(b & 0x1f)}, nil
+	}
+
+	switch b {
+	case 0xc0:
+		return mpToken{kind: mpNil}, nil
+	case 0xc2, 0xc3:
+		return mpToken{kind: mpBool, b: b == 0xc3}, nil
+	case 0xc4, 0xc5, 0xc6:
+		kind, size = mpBin, 1<<(b-0xc4)
+	case 0xca:
+		u, err := d.uint(4)
+		return mpToken{kind: mpFloat, f: float64(math.Float32frombits(uint32(u)))}, err
+	case 0xcb:
+		u, err := d.uint(8)
+		return mpToken{kind: mpFloat, f: math.Float64frombits(u)}, err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := d.uint(1 << (b - 0xcc))
+		return mpToken{kind: mpUint, u: u}, err
+	case 0xd0:
+		u, err := d.uint(1)
+		return mpToken{kind: mpInt, i: int64(int8(u))}, err
+	case 0xd1:
+		u, err := d.uint(2)
+		return mpToken{kind: mpInt, i: int64(int16(u))}, err
+	case 0xd2:
+		u, err := d.uint(4)
+		return mpToken{kind: mpInt, i: int64(int32(u))}, err
+	case 0xd3:
+		u, err := d.uint(8)
+		return mpToken{kind: mpInt, i: int64(u)}, err
+	case 0xd9, 0xda, 0xdb:
+		kind, size = mpStr, 1<<(b-0xd9)
+	case 0xdc, 0xdd:
+		kind, size = mpArray, 2<<(b-0xdc)
+	case 0xde, 0xdf:
+		kind, size = mpMap, 2<<(b-0xde)
+	default:
+		return t, fmt.Errorf("msgpack: Unsupported type 0x%02x.", b)
+	}
+
+	n, err := d.uint(size)
+	if err != nil {
+		return t, err
+	}
+	// Every element takes at least a byte, longer lengths can only be corrupt.
+	if n > uint64(len(d.data)-d.pos) {
+		return t, errMsgpackShort
+	}
+	return mpToken{kind: kind, n: int(n)}, nil
+}
+
+// Skips the value following t.
+func (d *mpDecoder) skip(t mpToken) error {
+	switch t.kind {
+	case mpStr, mpBin:
+		_, err := d.take(t.n)
+		return err
+	case mpArray, mpMap:
+		if err := d.enter(); err != nil {
+			return err
+		}
+		defer d.leave()
+		n := t.n
+		if t.kind == mpMap {
+			n *= 2
+		}
+		for i := 0; i < n; i++ {
+			sub, err := d.next()
+			if err != nil {
+				return err
+			}
+			if err := d.skip(sub); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Decodes the next value into an interface{}, as encoding/json would for maps and arrays.
+func (d *mpDecoder) decodeAny(t mpToken) (interface{}, error) {
+	switch t.kind {
+	case mpBool:
+		return t.b, nil
+	case mpInt:
+		return t.i, nil
+	case mpUint:
+		return t.u, nil
+	case mpFloat:
+		return t.f, nil
+	case mpStr:
+		b, err := d.take(t.n)
+		return string(b), err
+	case mpBin:
+		b, err := d.take(t.n)
+		return append([]byte{}, b...), err
+	case mpArray:
+		out := make([]interface{}, 0, mpPrealloc(t.n, anyType.Size()))
+		for i := 0; i < t.n; i++ {
+			var v interface{}
+			if err := d.decode(reflect.ValueOf(&v).Elem()); err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	case mpMap:
+		out := make(map[string]interface{}, mpPrealloc(t.n, stringType.Size()+anyType.Size()))
+		for i := 0; i < t.n; i++ {
+			var k, v interface{}
+			if err := d.decode(reflect.ValueOf(&k).Elem()); err != nil {
+				return nil, err
+			}
+			if err := d.decode(reflect.ValueOf(&v).Elem()); err != nil {
+				return nil, err
+			}
+			out[fmt.Sprint(k)] = v
+		}
+		return out, nil
+	}
+	return nil, nil
+}
+
+// Decodes the next value into v, which must be settable.
+func (d *mpDecoder) decode(v reflect.Value) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+	t, err := d.next()
+	if err != nil {
+		return err
+	}
+	return d.decodeToken(t, v)
+}
+
+func (d *mpDecoder) decodeToken(t mpToken, v reflect.Value) error {
+	if t.kind == mpNil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decodeToken(t, v.Elem())
+	}
+
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		val, err := d.decodeAny(t)
+		if err != nil {
+			return err
+		}
+		if val != nil {
+			v.Set(reflect.ValueOf(val))
+		}
+		return nil
+	}
+
+	if t.kind == mpStr && reflect.PtrTo(v.Type()).Implements(textUnmarshalerType) {
+		b, err := d.take(t.n)
+		if err != nil {
+			return err
+		}
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText(b)
+	}
+
+	mismatch := func() error {
+		return fmt.Errorf("msgpack: Cannot decode %s into %s.", mpKindName[t.kind], v.Type())
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if t.kind != mpBool {
+			return mismatch()
+		}
+		v.SetBool(t.b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i := t.i
+		switch {
+		case t.kind == mpUint && t.u <= math.MaxInt64:
+			i = int64(t.u)
+		case t.kind != mpInt:
+			return mismatch()
+		}
+		if v.OverflowInt(i) {
+			return fmt.Errorf("msgpack: %d overflows %s.", i, v.Type())
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := t.u
+		switch {
+		case t.kind == mpInt && t.i >= 0:
+			u = uint64(t.i)
+		case t.kind != mpUint:
+			return mismatch()
+		}
+		if v.OverflowUint(u) {
+			return fmt.Errorf("msgpack: %d overflows %s.", u, v.Type())
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		switch t.kind {
+		case mpFloat:
+			v.SetFloat(t.f)
+		case mpInt:
+			v.SetFloat(float64(t.i))
+		case mpUint:
+			v.SetFloat(float64(t.u))
+		default:
+			return mismatch()
+		}
+	case reflect.String:
+		if t.kind != mpStr && t.kind != mpBin {
+			return mismatch()
+		}
+		b, err := d.take(t.n)
+		if err != nil {
+			return err
+		}
+		v.SetString(string(b))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 && (t.kind == mpBin || t.kind == mpStr) {
+			b, err := d.take(t.n)
+			if err != nil {
+				return err
+			}
+			v.SetBytes(append([]byte{}, b...))
+			return nil
+		}
+		if t.kind != mpArray {
+			return mismatch()
+		}
+		v.Set(reflect.MakeSlice(v.Type(), 0, mpPrealloc(t.n, v.Type().Elem().Size())))
+		for i := 0; i < t.n; i++ {
+			if i == v.Cap() {
+				v.Grow(1)
+			}
+			v.SetLen(i + 1)
+			if err := d.decode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 && (t.kind == mpBin || t.kind == mpStr) {
+			b, err := d.take(t.n)
+			if err != nil {
+				return err
+			}
+			v.Set(reflect.Zero(v.Type()))
+			reflect.Copy(v, reflect.ValueOf(b))
+			return nil
+		}
+		if t.kind != mpArray {
+			return mismatch()
+		}
+		v.Set(reflect.Zero(v.Type()))
+		for i := 0; i < t.n; i++ {
+			if i >= v.Len() {
+				sub, err := d.next()
+				if err != nil {
+					return err
+				}
+				if err := d.skip(sub); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.decode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if t.kind != mpMap {
+			return mismatch()
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(v.Type(), mpPrealloc(t.n, v.Type().Key().Size()+v.Type().Elem().Size())))
+		}
+		for i := 0; i < t.n; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := d.decode(key); err != nil {
+				return err
+			}
+			val := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decode(val); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, val)
+		}
+	case reflect.Struct:
+		if t.kind != mpMap {
+			return mismatch()
+		}
+		fields := mpFields(v.Type())
+		for i := 0; i < t.n; i++ {
+			var name string
+			if err := d.decode(reflect.ValueOf(&name).Elem()); err != nil {
+				return err
+			}
+			f := mpLookup(fields, name)
+			if f == nil {
+				sub, err := d.next()
+				if err != nil {
+					return err
+				}
+				if err := d.skip(sub); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.decode(v.FieldByIndex(f.index)); err != nil {
+				return err
+			}
+		}
+	default:
+		return mismatch()
+	}
+	return nil
+}
+
+// Finds the field named name, preferring an exact match as encoding/json does.
+func mpLookup(fields []mpField, name string) *mpField {
+	for i := range fields {
+		if fields[i].name == name {
+			return &fields[i]
+		}
+	}
+	for i := range fields {
+		if strings.EqualFold(fields[i].name, name) {
+			return &fields[i]
+		}
+	}
+	return nil
+}
+
+// Names of MessagePack kinds for errors.
+var mpKindName = map[int]string{
+	mpNil:   "nil",
+	mpBool:  "bool",
+	mpInt:   "int",
+	mpUint:  "uint",
+	mpFloat: "float",
+	mpStr:   "string",
+	mpBin:   "binary",
+	mpArray: "array",
+	mpMap:   "map",
+}
@@ -0,0 +1,371 @@
+package ezipc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+type mpInner struct {
+	Name string
+	Tags []string
+}
+
+type mpEmbedded struct {
+	Shared int
+}
+
+type mpSample struct {
+	mpEmbedded
+	ID       int64
+	Count    uint16
+	Ratio    float64
+	Small    float32
+	OK       bool
+	Label    string `json:"label"`
+	Skipped  string `json:"-"`
+	Empty    string `json:",omitempty"`
+	Raw      []byte
+	Fixed    [3]byte
+	Scores   map[int]int
+	Index    map[string]*mpInner
+	Inner    mpInner
+	Ptr      *mpInner
+	Nil      *mpInner
+	When     time.Time
+	Any      interface{}
+	Nested   [][]int
+	internal int
+}
+
+// Round trips values through MsgpackCodec, comparing them with the original.
+func TestMsgpackRoundTrip(t *testing.T) {
+	when := time.Date(2024, 2, 29, 12, 30, 0, 5, time.UTC)
+	sample := mpSample{
+		mpEmbedded: mpEmbedded{Shared: 7},
+		ID:         -1 << 40,
+		Count:      65535,
+		Ratio:      math.Pi,
+		Small:      1.5,
+		OK:         true,
+		Label:      strings.Repeat("é", 40),
+		Raw:        []byte{},
+		Fixed:      [3]byte{9, 8, 7},
+		Scores:     map[int]int{-1: 1, 0: 0, 1 << 20: -1 << 20},
+		Index:      map[string]*mpInner{"a": {Name: "a"}, "b": nil},
+		Inner:      mpInner{Name: "inner", Tags: []string{"x", ""}},
+		Ptr:        &mpInner{Tags: []string{}},
+		When:       when,
+		Any:        "any",
+		Nested:     [][]int{{1}, nil, {}},
+	}
+
+	values := []interface{}{
+		sample,
+		[]int{0, 127, 128, 255, 256, 65535, 65536, -32, -33, -128, -129, -32768, -32769, math.MaxInt64, math.MinInt64},
+		[]uint64{0, math.MaxUint8, math.MaxUint16, math.MaxUint32, math.MaxUint64},
+		map[int]string{1: "one", -2: "minus two"},
+		strings.Repeat("s", 70000),
+		make([]bool, 70000),
+		[]byte{0, 1, 0xc1, 0xff},
+		map[string]int{},
+		[]string(nil),
+	}
+
+	var codec MsgpackCodec
+	for _, want := range values {
+		data, err := codec.Marshal(want)
+		if err != nil {
+			t.Fatalf("Marshal(%T): %s", want, err)
+		}
+		got := reflect.New(reflect.TypeOf(want))
+		if err := codec.Unmarshal(data, got.Interface()); err != nil {
+			t.Fatalf("Unmarshal(%T): %s", want, err)
+		}
+		if !reflect.DeepEqual(got.Elem().Interface(), want) {
+			t.Errorf("%T did not round trip:\n got %#v\nwant %#v", want, got.Elem().Interface(), want)
+		}
+	}
+}
+
+// Checks encodings against the MessagePack specification, so values are readable by other implementations.
+func TestMsgpackWireFormat(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		hex   string
+	}{
+		{nil, "c0"},
+		{false, "c2"},
+		{true, "c3"},
+		{0, "00"},
+		{127, "7f"},
+		{128, "cc80"},
+		{256, "cd0100"},
+		{65536, "ce00010000"},
+		{uint64(1) << 32, "cf0000000100000000"},
+		{-1, "ff"},
+		{-32, "e0"},
+		{-33, "d0df"},
+		{-129, "d1ff7f"},
+		{-32769, "d2ffff7fff"},
+		{int64(-1) << 32, "d3ffffffff00000000"},
+		{float32(1.5), "ca3fc00000"},
+		{1.5, "cb3ff8000000000000"},
+		{"", "a0"},
+		{"abc", "a3616263"},
+		{strings.Repeat("a", 32), "d920" + strings.Repeat("61", 32)},
+		{[]byte{1, 2}, "c4020102"},
+		{[]int{1, 2}, "920102"},
+		{map[string]int{"a": 1}, "81a16101"},
+		{struct {
+			A int `json:"a"`
+			B int `json:",omitempty"`
+		}{A: 1}, "81a16101"},
+	}
+
+	var codec MsgpackCodec
+	for _, test := range tests {
+		data, err := codec.Marshal(test.value)
+		if err != nil {
+			t.Fatalf("Marshal(%#v): %s", test.value, err)
+		}
+		if got := hex.EncodeToString(data); got != test.hex {
+			t.Errorf("Marshal(%#v) = %s, want %s", test.value, got, test.hex)
+		}
+	}
+}
+
+// Decodes values written by other implementations, in forms our encoder doesn't produce.
+func TestMsgpackDecodeForeign(t *testing.T) {
+	var codec MsgpackCodec
+
+	var small int8
+	if err := codec.Unmarshal([]byte{0xcc, 0x7f}, &small); err != nil || small != 127 {
+		t.Errorf("uint8 into int8 = %d, %v", small, err)
+	}
+	if err := codec.Unmarshal([]byte{0xcc, 0x80}, &small); err == nil {
+		t.Errorf("128 into int8 should overflow")
+	}
+
+	var s string
+	if err := codec.Unmarshal([]byte{0xc4, 0x02, 'h', 'i'}, &s); err != nil || s != "hi" {
+		t.Errorf("bin into string = %q, %v", s, err)
+	}
+
+	var any interface{}
+	if err := codec.Unmarshal([]byte{0x82, 0x01, 0xa1, 'x', 0xa1, 'k', 0x92, 0xc3, 0xc0}, &any); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"1": "x", "k": []interface{}{true, nil}}
+	if !reflect.DeepEqual(any, want) {
+		t.Errorf("map into interface{} = %#v, want %#v", any, want)
+	}
+
+	// Unknown fields are skipped, names are matched case insensitively as encoding/json does.
+	var inner mpInner
+	data := []byte{0x82, 0xa4, 'n', 'a', 'm', 'e', 0xa1, 'n', 0xa5, 'e', 'x', 't', 'r', 'a', 0x91, 0x80}
+	if err := codec.Unmarshal(data, &inner); err != nil || inner.Name != "n" {
+		t.Errorf("struct with unknown field = %#v, %v", inner, err)
+	}
+}
+
+// Rejects malformed data with an error rather than panicking or over allocating.
+func TestMsgpackMalformed(t *testing.T) {
+	var codec MsgpackCodec
+	inputs := []string{
+		"c1",
+		"a5616263",
+		"dc",
+		"dcffff",
+		"ddffffffff",
+		"dfffffffff",
+		"c6ffffffff",
+		"9301",
+		"0102",
+	}
+	for _, in := range inputs {
+		data, _ := hex.DecodeString(in)
+		var any interface{}
+		if err := codec.Unmarshal(data, &any); err == nil {
+			t.Errorf("Unmarshal(%s) succeeded with %#v", in, any)
+		}
+	}
+
+	var n int
+	if err := codec.Unmarshal([]byte{0xa1, 'x'}, &n); err == nil {
+		t.Errorf("string into int should fail")
+	}
+	if err := codec.Unmarshal([]byte{0x01}, n); err == nil {
+		t.Errorf("Unmarshal into non-pointer should fail")
+	}
+}
+
+// Rejects values nested beyond mpMaxDepth with an error, whether decoded, decoded into interface{} or skipped,
+// rather than overflowing the stack.
+func TestMsgpackDepth(t *testing.T) {
+	var codec MsgpackCodec
+	nested := func(depth int) []byte {
+		data := append([]byte{0x81, 0xa1, 'x'}, bytes.Repeat([]byte{0x91}, depth)...)
+		return append(data, 0x01)
+	}
+
+	deep := nested(4 << 20)
+	var skipped struct{ A int }
+	if err := codec.Unmarshal(deep, &skipped); err == nil {
+		t.Error("Unmarshal of deeply nested unknown field succeeded.")
+	}
+	var any interface{}
+	if err := codec.Unmarshal(deep, &any); err == nil {
+		t.Error("Unmarshal of deeply nested value into interface{} succeeded.")
+	}
+	var slices map[string][][][]int
+	if err := codec.Unmarshal(deep, &slices); err == nil {
+		t.Error("Unmarshal of deeply nested value into slices succeeded.")
+	}
+
+	if err := codec.Unmarshal(nested(mpMaxDepth-2), &skipped); err != nil {
+		t.Errorf("Unmarshal nested to the limit: %s", err)
+	}
+	if err := codec.Unmarshal(nested(mpMaxDepth-2), &any); err != nil {
+		t.Errorf("Unmarshal into interface{} nested to the limit: %s", err)
+	}
+}
+
+// Allocates for the elements of an array as they are decoded, not the length claimed on the wire.
+func TestMsgpackAllocation(t *testing.T) {
+	const n = 1 << 20
+	// An array of n elements, the first of which fails to decode.
+	data := append([]byte{0xdd, 0, 0x10, 0, 0, 0xc3}, make([]byte, n-1)...)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	var large [][4096]byte
+	if err := (MsgpackCodec{}).Unmarshal(data, &large); err == nil {
+		t.Fatal("Unmarshal of bool into byte array succeeded.")
+	}
+	runtime.ReadMemStats(&after)
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 64<<20 {
+		t.Errorf("Decoding allocated %d bytes for an array of %d bytes.", alloc, len(data))
+	}
+}
+
+// Decodes arbitrary input without panicking, and re-encodes whatever decodes to the same value.
+func FuzzMsgpack(f *testing.F) {
+	var codec MsgpackCodec
+	for _, v := range []interface{}{
+		nil, 1, -1, 1 << 40, "str", []byte{1}, []byte{}, []interface{}{1, "a"},
+		map[string]interface{}{"a": []int{1}}, mpInner{Name: "n", Tags: []string{"t"}},
+	} {
+		data, _ := codec.Marshal(v)
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var inner mpInner
+		codec.Unmarshal(data, &inner)
+
+		var any interface{}
+		if err := codec.Unmarshal(data, &any); err != nil {
+			return
+		}
+		again, err := codec.Marshal(any)
+		if err != nil {
+			t.Fatalf("Marshal(%#v): %s", any, err)
+		}
+		var back interface{}
+		if err := codec.Unmarshal(again, &back); err != nil {
+			t.Fatalf("Unmarshal of re-encoded %x: %s", again, err)
+		}
+		if !reflect.DeepEqual(normalizeMsgpack(any), normalizeMsgpack(back)) {
+			t.Fatalf("%x decoded to %#v, re-encoded to %#v", data, any, back)
+		}
+	})
+}
+
+// Maps values decoded into interface{} to a comparable form, unsigned and signed integers of equal value compare equal
+// as the encoder chooses the smallest form, and NaN never equals itself.
+func normalizeMsgpack(v interface{}) interface{} {
+	switch v := v.(type) {
+	case uint64:
+		if v <= math.MaxInt64 {
+			return int64(v)
+		}
+	case float64:
+		if math.IsNaN(v) {
+			return "NaN"
+		}
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i := range v {
+			out[i] = normalizeMsgpack(v[i])
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k := range v {
+			out[k] = normalizeMsgpack(v[k])
+		}
+		return out
+	}
+	return v
+}
+
+// A struct of roughly 10KB when encoded as JSON.
+type benchRecord struct {
+	ID     int
+	Name   string
+	Tags   []string
+	Scores []float64
+	Meta   map[string]string
+}
+
+func benchPayload() []benchRecord {
+	records := make([]benchRecord, 64)
+	for i := range records {
+		records[i] = benchRecord{
+			ID:     i,
+			Name:   strings.Repeat("record", 4),
+			Tags:   []string{"alpha", "beta", "gamma"},
+			Scores: []float64{1.25, 2.5, 1e6, -3.75, 0.1},
+			Meta:   map[string]string{"region": "us-east", "owner": "team"},
+		}
+	}
+	return records
+}
+
+// Compares the round trip time and size of JSON and MessagePack on a 10KB payload.
+func BenchmarkCodecRoundTrip(b *testing.B) {
+	payload := benchPayload()
+	codecs := []struct {
+		name  string
+		codec Codec
+	}{
+		{"json", jsonCodec{}},
+		{"msgpack", MsgpackCodec{}},
+	}
+	for _, c := range codecs {
+		b.Run(c.name, func(b *testing.B) {
+			data, _ := c.codec.Marshal(payload)
+			b.ReportMetric(float64(len(data)), "bytes")
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				data, err := c.codec.Marshal(payload)
+				if err != nil {
+					b.Fatal(err)
+				}
+				var out []benchRecord
+				if err := c.codec.Unmarshal(data, &out); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+	if data, _ := (jsonCodec{}).Marshal(payload); !bytes.Contains(data, []byte("alpha")) || len(data) < 8<<10 {
+		b.Fatalf("Payload of %d bytes is not representative.", len(data))
+	}
+}
@@ -0,0 +1,103 @@
+package ezipc
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"sync/atomic"
+)
+
+// Tag reserved for calls which expect no reply, never issued to a Call.
+const notifyTag = math.MaxInt32
+
+// Notify calls name with arg without waiting on, or recieving, a reply, returning once the call is sent.
+// Nothing is held for the call along the way, errors from the handler are only logged by its router.
+func (e *EzIPC) Notify(name string, arg interface{}) error {
+	data, err := e.codec.Marshal(arg)
+	if err != nil {
+		return fmt.Errorf("Notify %s: marshaling arg: %w", name, err)
+	}
+	// Handlers decode the reply template, so one is sent even though no reply is.
+	data2, err := e.codec.Marshal(nil)
+	if err != nil {
+		return fmt.Errorf("Notify %s: marshaling reply: %w", name, err)
+	}
+
+	req := &msg{
+		Tag: notifyTag,
+		Dst: name,
+		Va1: base64.StdEncoding.EncodeToString(data),
+		Va2: base64.StdEncoding.EncodeToString(data2),
+	}
+
+	dest := e.getUplink()
+	if dest == nil {
+		if dest = e.lookup(name); dest == nil {
+			dest = e.provide(name)
+		}
+	}
+	if dest == nil {
+		if atomic.LoadUint32(&e.connected) == 0 {
+			return ErrNotConnected
+		}
+		return ErrFail
+	}
+	if err := dest.recvErr(); err != nil {
+		return err
+	}
+
+	if dest.exec != nil {
+		e.spawn(func() { e.execNotify(dest, req) })
+		return nil
+	}
+	return dest.send(req)
+}
+
+// Routes a notification recieved from a peer.
+func (e *EzIPC) routeNotify(req *msg) {
+	if e.rewriter != nil {
+		req.Dst = e.rewriter(req.Dst)
+	}
+
+	dest := e.lookup(req.Dst)
+	if dest == nil {
+		dest = e.provide(req.Dst)
+	}
+	if up := e.getUplink(); dest == nil && !e.no_fallback && up != nil && req.conn != up {
+		dest = up
+	}
+	if dest == nil {
+		e.logf("Notification of %s from connection %s dropped: %s", req.Dst, req.conn.id, ErrFail)
+		return
+	}
+	if req.conn.codecName() != dest.codecName() {
+		e.logf("Notification of %s from connection %s dropped: %s", req.Dst, req.conn.id, ErrCodecMismatch)
+		return
+	}
+
+	if dest.exec == nil {
+		req.relay = dest
+		dest.send(req)
+		return
+	}
+
+	size := req.size()
+	if !e.reserveMem(size) {
+		e.logf("Notification of %s from connection %s dropped: %s", req.Dst, req.conn.id, ErrBusy)
+		return
+	}
+	req.conn.runExec(func() {
+		defer e.useMem(-size)
+		e.execNotify(dest, req)
+	})
+}
+
+// Executes notification on local function dest, logging any error as there is no one to return it to.
+func (e *EzIPC) execNotify(dest *connection, req *msg) {
+	atomic.AddInt64(&dest.inflight, 1)
+	defer atomic.AddInt64(&dest.inflight, -1)
+	name := req.Dst
+	if resp := e.execute(dest, req); resp.Err != "" {
+		e.logf("Notification of %s failed: %s", name, resp.Err)
+	}
+}
@@ -0,0 +1,48 @@
+package ezipc
+
+import (
+	"errors"
+	"testing"
+)
+
+// Notifications run on the provider without a reply, and failures are logged by the router that ran them.
+func TestNotify(t *testing.T) {
+	bl := new(testLogger)
+	b, sock := newBroker(t, WithLogger(bl))
+	got := make(chan int, 3)
+	l := new(testLogger)
+	newClient(t, sock, map[string]interface{}{
+		"Record": func(arg int, reply *int) error { got <- arg; return nil },
+		"Fail":   func(arg int, reply *int) error { return errors.New("Refused.") },
+	}, WithLogger(l))
+	waitRoute(t, b, "Record")
+	waitRoute(t, b, "Fail")
+	c := newClient(t, sock, nil)
+
+	for i := 0; i < 3; i++ {
+		if err := c.Notify("Record", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seen := make(map[int]bool)
+	for len(seen) < 3 {
+		seen[<-got] = true
+	}
+
+	if err := c.Notify("Fail", 1); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "failed notification to be logged", func() bool { return l.logged("Notification of Fail failed") })
+
+	if err := c.Notify("Missing", 1); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "unroutable notification to be dropped", func() bool { return bl.logged("Notification of Missing") })
+
+	b.tagMapLock.Lock()
+	pending := len(b.tagMap)
+	b.tagMapLock.Unlock()
+	if pending != 0 {
+		t.Errorf("Broker holds %d tags after notifications, want none.", pending)
+	}
+}
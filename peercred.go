@@ -0,0 +1,31 @@
+package ezipc
+
+import "net"
+
+// PeerCred identifies the process at the other end of an accepted Unix socket connection.
+type PeerCred struct {
+	UID int
+	GID int
+	PID int
+}
+
+// WithPeerAuth calls auth with the credentials of each peer connecting to Listen, closing the connection before anything is routed if it returns false.
+// Credentials are only read for Unix socket connections on Linux, Unix socket connections whose credentials can't be read are refused,
+// which on other platforms is all of them. TCP connections carry no credentials, and are accepted without calling auth.
+func WithPeerAuth(auth func(uid, gid, pid int) bool) Option {
+	return func(e *EzIPC) {
+		e.peer_auth = auth
+	}
+}
+
+// Determines if the peer of conn, with credentials cred or nil if they couldn't be read, may connect.
+func (e *EzIPC) authPeer(conn net.Conn, cred *PeerCred) bool {
+	if e.peer_auth == nil {
+		return true
+	}
+	if cred == nil {
+		_, unix := conn.(*net.UnixConn)
+		return !unix
+	}
+	return e.peer_auth(cred.UID, cred.GID, cred.PID)
+}
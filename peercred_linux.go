@@ -0,0 +1,29 @@
+//go:build linux
+// +build linux
+
+package ezipc
+
+import (
+	"net"
+	"syscall"
+)
+
+// Reads SO_PEERCRED of conn, nil if conn is not a Unix socket.
+func peerCred(conn net.Conn) *PeerCred {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var cred *syscall.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || cred == nil {
+		return nil
+	}
+	return &PeerCred{UID: int(cred.Uid), GID: int(cred.Gid), PID: int(cred.Pid)}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package ezipc
+
+import "net"
+
+// Peer credentials are only read on Linux, reading LOCAL_PEERCRED on BSD and macOS needs golang.org/x/sys.
+func peerCred(conn net.Conn) *PeerCred {
+	return nil
+}
@@ -0,0 +1,95 @@
+package ezipc
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"testing"
+)
+
+// Unix socket peers are authorized by their credentials, and refused when they can't be read.
+func TestPeerAuth(t *testing.T) {
+	var uids []int
+	e := New(WithPeerAuth(func(uid, gid, pid int) bool {
+		uids = append(uids, uid)
+		return uid == os.Getuid()
+	}))
+
+	pipe, other := net.Pipe()
+	defer pipe.Close()
+	defer other.Close()
+	if !e.authPeer(pipe, nil) {
+		t.Errorf("Connection other than a Unix socket refused.")
+	}
+
+	sock := tempSocket(t)
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go net.Dial("unix", sock)
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if e.authPeer(conn, nil) {
+		t.Errorf("Unix socket peer with unreadable credentials accepted.")
+	}
+	if runtime.GOOS != "linux" {
+		return
+	}
+	cred := peerCred(conn)
+	if cred == nil || cred.PID != os.Getpid() {
+		t.Fatalf("peerCred = %#v, want our own process.", cred)
+	}
+	if !e.authPeer(conn, cred) || len(uids) != 1 {
+		t.Errorf("Peer with our uid refused.")
+	}
+	if e.authPeer(conn, &PeerCred{UID: os.Getuid() + 1}) {
+		t.Errorf("Peer with another uid accepted.")
+	}
+}
+
+// Brokers record the credentials of accepted peers, and close connections WithPeerAuth refuses.
+func TestPeerAuthListen(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Peer credentials are only read on Linux.")
+	}
+	allow := int32(1)
+	log := new(testLogger)
+	b, sock := newBroker(t, WithLogger(log), WithPeerAuth(func(uid, gid, pid int) bool {
+		return atomic.LoadInt32(&allow) == 1
+	}))
+	b.RegisterName("Echo", func(arg int, reply *int) error { *reply = arg; return nil })
+
+	c := newClient(t, sock, nil)
+	var reply int
+	if err := c.Call("Echo", 1, &reply); err != nil {
+		t.Fatalf("Call of an authorized peer: %s", err)
+	}
+	var peer *PeerCred
+	for _, info := range b.Connections() {
+		peer = info.Peer
+	}
+	if peer == nil || peer.UID != os.Getuid() || peer.PID != os.Getpid() {
+		t.Errorf("Connections reports peer %#v, want our own process.", peer)
+	}
+	for _, cs := range b.Dump().Conns {
+		if cs.Peer == nil || cs.Peer.UID != os.Getuid() {
+			t.Errorf("Dump reports peer %#v, want our own process.", cs.Peer)
+		}
+	}
+
+	atomic.StoreInt32(&allow, 0)
+	r := newRouter(t)
+	r.Dial(sock)
+	defer r.Close()
+	if err := r.Call("Echo", 1, &reply); err == nil {
+		t.Errorf("Call of a refused peer succeeded.")
+	}
+	waitFor(t, "refusal to be logged", func() bool { return log.logged("refused") })
+}
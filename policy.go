@@ -0,0 +1,117 @@
+package ezipc
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// DuplicateRoutePolicy determines how a broker resolves a name registered by more than one provider.
+type DuplicateRoutePolicy int
+
+const (
+	// Keep all providers, preferring the most recent registration and falling back to earlier ones. This is the default.
+	RouteMulti DuplicateRoutePolicy = iota
+	// Keep all providers, spreading calls across them round-robin.
+	RouteRoundRobin
+	// Replace existing providers with the most recent registration.
+	RouteLastWins
+	// Refuse registrations of names which already have a provider.
+	RouteReject
+)
+
+// ErrDuplicateRoute is returned when registering a name which already has a provider under RouteReject.
+var ErrDuplicateRoute = errors.New("Name is already registered by another provider.")
+
+// SetDuplicateRoutePolicy sets how registrations of a name which already has a provider are resolved.
+func (e *EzIPC) SetDuplicateRoutePolicy(p DuplicateRoutePolicy) {
+	e.connMapLock.Lock()
+	defer e.connMapLock.Unlock()
+	e.dup_policy = p
+}
+
+// Adds c as a provider of name according to the duplicate route policy, connMapLock must be held.
+func (e *EzIPC) addRoute(name string, c *connection) error {
+	existing := e.connMap[name]
+	for _, p := range existing {
+		if p == c {
+			return nil
+		}
+	}
+
+	// A reconnected peer replaces its old connection, which may not have been seen to close yet.
+	if c.instance != "" {
+		kept := existing[:0:0]
+		for _, p := range existing {
+			if p.instance == c.instance {
+				p.removeName(name)
+				e.countLocal(p, -1)
+				e.logf("Route %s moved from connection %s to %s on reconnect.", name, p.id, c.id)
+				continue
+			}
+			kept = append(kept, p)
+		}
+		existing = kept
+	}
+
+	if len(existing) > 0 {
+		switch e.dup_policy {
+		case RouteReject:
+			return ErrDuplicateRoute
+		case RouteLastWins:
+			for _, p := range existing {
+				p.removeName(name)
+				e.countLocal(p, -1)
+			}
+			e.logf("Route %s taken over by connection %s.", name, c.id)
+			existing = nil
+		}
+	}
+
+	e.connMap[name] = append(existing, c)
+	c.routes = append(c.routes, name)
+	e.countLocal(c, 1)
+	atomic.StoreInt64(&e.counters.routes, int64(len(e.connMap)))
+	return nil
+}
+
+// Adjusts the count of local methods when c is a local handler.
+func (e *EzIPC) countLocal(c *connection, n int64) {
+	if c.exec != nil {
+		atomic.AddInt64(&e.counters.local_methods, n)
+	}
+}
+
+// Removes name from the routes of connection.
+func (c *connection) removeName(name string) {
+	for i, r := range c.routes {
+		if r == name {
+			c.routes = append(c.routes[:i:i], c.routes[i+1:]...)
+			return
+		}
+	}
+}
+
+// Round-robin positions for each name.
+type rotation struct {
+	lock sync.Mutex
+	pos  map[string]*uint32
+}
+
+// Returns the next of conns for name.
+func (r *rotation) next(name string, conns []*connection) *connection {
+	if len(conns) == 0 {
+		return nil
+	}
+	r.lock.Lock()
+	if r.pos == nil {
+		r.pos = make(map[string]*uint32)
+	}
+	pos := r.pos[name]
+	if pos == nil {
+		pos = new(uint32)
+		r.pos[name] = pos
+	}
+	r.lock.Unlock()
+	return conns[int(atomic.AddUint32(pos, 1)-1)%len(conns)]
+}
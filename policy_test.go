@@ -0,0 +1,80 @@
+package ezipc
+
+import (
+	"testing"
+	"time"
+)
+
+type policySvc struct{ id string }
+
+func (s *policySvc) Who(arg int, reply *string) error { *reply = s.id; return nil }
+
+// Starts a broker with policy p, with providers of policySvc.Who for each of ids, returning the broker and a client of it.
+func dupProviders(t *testing.T, p DuplicateRoutePolicy, ids ...string) (*EzIPC, *EzIPC) {
+	b, sock := newBroker(t)
+	b.SetDuplicateRoutePolicy(p)
+	for _, id := range ids {
+		if err := newClient(t, sock, nil).RegisterAndWait(&policySvc{id}, 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b, newClient(t, sock, nil)
+}
+
+// Returns who answers each of n calls.
+func whoAnswers(t *testing.T, c *EzIPC, n int) map[string]int {
+	seen := make(map[string]int)
+	for i := 0; i < n; i++ {
+		var reply string
+		if err := c.Call("policySvc.Who", 0, &reply); err != nil {
+			t.Fatal(err)
+		}
+		seen[reply]++
+	}
+	return seen
+}
+
+// Each policy resolves a name registered by several providers as documented.
+func TestDuplicateRoutePolicy(t *testing.T) {
+	_, c := dupProviders(t, RouteMulti, "a", "b")
+	if seen := whoAnswers(t, c, 2); seen["b"] != 2 {
+		t.Errorf("RouteMulti calls went to %v, want the latest, b.", seen)
+	}
+
+	_, c = dupProviders(t, RouteRoundRobin, "a", "b")
+	if seen := whoAnswers(t, c, 4); seen["a"] != 2 || seen["b"] != 2 {
+		t.Errorf("RouteRoundRobin calls went to %v, want two each.", seen)
+	}
+
+	b, c := dupProviders(t, RouteLastWins, "a", "b")
+	if seen := whoAnswers(t, c, 2); seen["b"] != 2 {
+		t.Errorf("RouteLastWins calls went to %v, want b.", seen)
+	}
+	b.connMapLock.RLock()
+	providers := len(b.connMap["policySvc.Who"])
+	b.connMapLock.RUnlock()
+	if providers != 1 {
+		t.Errorf("RouteLastWins kept %d providers, want 1.", providers)
+	}
+}
+
+// Under RouteReject, a second provider is refused by the broker, as is a local registration once the name is provided.
+func TestDuplicateRouteReject(t *testing.T) {
+	b, sock := newBroker(t)
+	b.SetDuplicateRoutePolicy(RouteReject)
+	if err := newClient(t, sock, nil).RegisterAndWait(&policySvc{"a"}, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := newClient(t, sock, nil).RegisterAndWait(&policySvc{"b"}, 5*time.Second); err != ErrDuplicateRoute {
+		t.Errorf("Second provider's RegisterAndWait = %v, want ErrDuplicateRoute", err)
+	}
+	if err := b.Register(&policySvc{"c"}); err == nil {
+		t.Error("Broker registered a name already provided.")
+	}
+
+	c := newClient(t, sock, nil)
+	var reply string
+	if err := c.Call("policySvc.Who", 0, &reply); err != nil || reply != "a" {
+		t.Errorf("Call = %q, %v, want the first provider", reply, err)
+	}
+}
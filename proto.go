@@ -0,0 +1,119 @@
+package ezipc
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Range of wire protocol versions we speak, the newest first.
+// Peers predating protocol versions don't declare one in their handshake, and are version 0.
+// Peers declare both ends of their range, and speak the newest version within both ranges.
+const (
+	protocolVersion    = 1
+	minProtocolVersion = 0
+)
+
+// Tag of the probe sent after our handshake, reserved as no call is ever sent on it.
+// Brokers predating protocol versions never acknowledge the handshake, but do answer the probe,
+// which fails as it names no function. Brokers declaring a version ignore it, having already acknowledged us.
+const probeTag = notifyTag - 1
+
+// Name the probe is sent to, which no function may be registered as.
+// Peers predating the handshake take the handshake and goodbye for registrations of the name they carry,
+// so they carry this name rather than none, leaving such brokers relaying the probe back to us instead of routing calls naming no function to us.
+const probeName = "ezipc.Probe"
+
+// Time Dial waits on the broker to acknowledge our handshake or answer the probe.
+const handshakeTimeout = 5 * time.Second
+
+// ErrProtocolVersion is returned by Dial and Listen when the peer speaks a protocol version we cannot, or cannot speak ours.
+var ErrProtocolVersion = errors.New("Incompatible protocol version.")
+
+// Returns the version to speak with a peer speaking versions min to version, or an error when none is spoken by both of us.
+func negotiate(version, min int) (int, error) {
+	agreed := version
+	if agreed > protocolVersion {
+		agreed = protocolVersion
+	}
+	if agreed < minProtocolVersion || agreed < min {
+		return 0, fmt.Errorf("%w Peer speaks versions %d to %d, we speak %d to %d.", ErrProtocolVersion, min, version, minProtocolVersion, protocolVersion)
+	}
+	return agreed, nil
+}
+
+// Returns the range of versions declared in the handshake or acknowledgement m.
+func declared(m *msg) (version, min int) {
+	version, _ = strconv.Atoi(m.hdr(hdrProto))
+	min, _ = strconv.Atoi(m.hdr(hdrProtoMin))
+	return
+}
+
+// Declares the range of versions we speak in the handshake or acknowledgement m.
+func declare(m *msg) {
+	m.setHdr(hdrProto, strconv.Itoa(protocolVersion))
+	m.setHdr(hdrProtoMin, strconv.Itoa(minProtocolVersion))
+}
+
+// Waits on the peer to acknowledge the handshake sent over c, or to answer the probe following it,
+// returning an error should either end have refused the other or the connection close first.
+func (c *connection) awaitHandshake() error {
+	select {
+	case err := <-c.handshake:
+		return err
+	case <-time.After(handshakeTimeout):
+		// The handshake settled just as we gave up, its outcome is on its way.
+		if !atomic.CompareAndSwapUint32(&c.settled, 0, 2) {
+			return <-c.handshake
+		}
+		c.close()
+		return fmt.Errorf("%w No acknowledgement of handshake within %v.", ErrClosed, handshakeTimeout)
+	}
+}
+
+// Settles the handshake of c, unless awaitHandshake gave up on it, passing err on to it.
+// Once settled, the reciever keeps the uplink should the connection drop, rather than reporting it to awaitHandshake.
+func (c *connection) settle(err error) {
+	if err == nil {
+		atomic.CompareAndSwapUint32(&c.settled, 0, 1)
+	}
+	c.handshakeDone(err)
+}
+
+// Passes the outcome of the handshake of c to awaitHandshake, unless one is already waiting.
+func (c *connection) handshakeDone(err error) {
+	select {
+	case c.handshake <- err:
+	default:
+	}
+}
+
+// Handles the peer's acknowledgement of our handshake, checking the protocol version it speaks.
+func (c *connection) handshakeAcked(req *msg) {
+	version, min := declared(req)
+	var err error
+	if req.Err != "" {
+		err = fmt.Errorf("%w Peer refused us: %s", ErrProtocolVersion, req.Err)
+	} else {
+		c.version, err = negotiate(version, min)
+	}
+	if err != nil {
+		c.refused = err
+		atomic.StoreUint32(&c.goodbye, 1)
+		c.conn.Close()
+	}
+	c.settle(err)
+}
+
+// Handles the answer to our probe, which only brokers predating protocol versions send, speaking version 0.
+func (c *connection) probed() {
+	_, err := negotiate(0, 0)
+	if err != nil {
+		c.refused = err
+		atomic.StoreUint32(&c.goodbye, 1)
+		c.conn.Close()
+	}
+	c.settle(err)
+}
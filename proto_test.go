@@ -0,0 +1,250 @@
+package ezipc
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Peer speaking the wire protocol directly, standing in for brokers and clients of other versions.
+type rawPeer struct {
+	c *connection
+	r *bufio.Reader
+}
+
+func newRawPeer(conn net.Conn) *rawPeer {
+	return &rawPeer{c: New().addconnection(conn), r: bufio.NewReader(conn)}
+}
+
+// Reads the next message, nil once the connection closes.
+func (p *rawPeer) read(t testing.TB) *msg {
+	p.c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	frame, err := p.c.readFrame(p.r, defaultMaxFrameSize)
+	if err != nil {
+		return nil
+	}
+	m, err := decodeText(frame)
+	if err != nil {
+		t.Fatalf("decodeText: %s", err)
+	}
+	return m
+}
+
+// Accepts a single connection on a temporary socket, passing it to serve, returning the socket path.
+func rawListener(t testing.TB, serve func(p *rawPeer)) string {
+	sock := tempSocket(t)
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serve(newRawPeer(conn))
+	}()
+	return sock
+}
+
+// Reads the handshake of the peer and acknowledges it, as brokers declaring a version do.
+func (p *rawPeer) ackHandshake(t testing.TB) {
+	if m := p.read(t); m == nil || m.hdr(hdrHandshake) == "" {
+		t.Errorf("Handshake not recieved, got %v.", m)
+		return
+	}
+	ack := &msg{Tag: 0}
+	ack.setHdr(hdrHandshakeAck, "1")
+	declare(ack)
+	p.c.write(ack)
+}
+
+// Handshake declaring versions min to version.
+func rawHandshake(version, min string) *msg {
+	hs := &msg{Tag: 0}
+	hs.setHdr(hdrHandshake, "1")
+	hs.setHdr(hdrProto, version)
+	hs.setHdr(hdrProtoMin, min)
+	return hs
+}
+
+// A broker refuses a client speaking only versions newer than ours, and closes the connection.
+func TestHandshakeRefusedByBroker(t *testing.T) {
+	_, sock := newBroker(t)
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	p := newRawPeer(conn)
+	p.c.write(rawHandshake("99", "98"))
+
+	ack := p.read(t)
+	if ack == nil || ack.hdr(hdrHandshakeAck) == "" || !strings.Contains(ack.Err, ErrProtocolVersion.Error()) {
+		t.Fatalf("Handshake of version 98 to 99 acknowledged with %#v, want refusal.", ack)
+	}
+	if m := p.read(t); m != nil {
+		t.Errorf("Connection left open after refusal, read %#v.", m)
+	}
+}
+
+// Dial fails when the broker refuses us, or speaks only versions newer than ours.
+func TestHandshakeRefusedByClient(t *testing.T) {
+	acks := map[string]*msg{
+		"broker refusing us":    {Tag: 0, Err: "Incompatible protocol version."},
+		"broker speaking 98-99": rawHandshake("99", "98"),
+	}
+	for name, ack := range acks {
+		sock := rawListener(t, func(p *rawPeer) {
+			p.read(t)
+			delete(ack.Hdr, hdrHandshake)
+			ack.setHdr(hdrHandshakeAck, "1")
+			p.c.write(ack)
+			for p.read(t) != nil {
+			}
+		})
+		c := newRouter(t)
+		err := c.Dial(sock)
+		c.Close()
+		if !errors.Is(err, ErrProtocolVersion) {
+			t.Errorf("Dial of %s = %v, want ErrProtocolVersion.", name, err)
+		}
+	}
+}
+
+// Brokers predating protocol versions never acknowledge the handshake, but answer the probe following it,
+// Dial treats them as version 0 without waiting out handshakeTimeout.
+// Brokers predating the handshake take it for a registration, relaying the probe back to us, and are left with no empty route.
+func TestHandshakeVersionZero(t *testing.T) {
+	empty := make(chan bool, 1)
+	sock := rawListener(t, func(p *rawPeer) {
+		routes := make(map[string]bool)
+		for m := p.read(t); m != nil; m = p.read(t) {
+			switch {
+			case m.Tag == 0:
+				routes[m.Dst] = true
+			case routes[m.Dst]:
+				p.c.write(m)
+			default:
+				send_err(&msg{Tag: m.Tag, Dst: m.Dst, conn: p.c}, ErrFail)
+			}
+		}
+		empty <- routes[""]
+	})
+	c := newRouter(t)
+	defer c.Close()
+	start := time.Now()
+	if err := c.Dial(sock); err != nil {
+		t.Fatalf("Dial of version 0 broker: %s", err)
+	}
+	if d := time.Since(start); d > handshakeTimeout/2 {
+		t.Errorf("Dial of version 0 broker took %v.", d)
+	}
+	if v := c.uplink.version; v != 0 {
+		t.Errorf("Agreed version %d with version 0 broker.", v)
+	}
+	c.Close()
+	if <-empty {
+		t.Errorf("Version 0 broker left routing an empty name to us.")
+	}
+}
+
+// Listen connecting to an existing broker returns once the handshake fails, and only reports having started once it settles.
+func TestListenAwaitsHandshake(t *testing.T) {
+	release := make(chan struct{})
+	sock := rawListener(t, func(p *rawPeer) {
+		p.read(t)
+		<-release
+		ack := &msg{Tag: 0}
+		ack.setHdr(hdrHandshakeAck, "1")
+		declare(ack)
+		p.c.write(ack)
+		for p.read(t) != nil {
+		}
+	})
+	b := newRouter(t)
+	defer b.Close()
+	errs := make(chan error, 1)
+	go func() { errs <- b.Listen(sock) }()
+	select {
+	case <-b.Started():
+		t.Fatal("Listen started before the handshake was acknowledged.")
+	case err := <-errs:
+		t.Fatalf("Listen: %s", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-b.Started():
+	case err := <-errs:
+		t.Fatalf("Listen: %s", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Listen did not start once the handshake was acknowledged.")
+	}
+
+	refused := rawListener(t, func(p *rawPeer) {
+		p.read(t)
+		ack := &msg{Tag: 0, Err: "Incompatible protocol version."}
+		ack.setHdr(hdrHandshakeAck, "1")
+		p.c.write(ack)
+	})
+	if err := newRouter(t).Listen(refused); !errors.Is(err, ErrProtocolVersion) {
+		t.Errorf("Listen of broker refusing us = %v, want ErrProtocolVersion.", err)
+	}
+}
+
+// Frames naming no function register nothing, whatever headers they carry.
+func TestRouteEmptyName(t *testing.T) {
+	b, sock := newBroker(t)
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	p := newRawPeer(conn)
+	p.c.write(rawHandshake("1", "0"))
+	unknown := &msg{Tag: 0}
+	unknown.setHdr("unknown", "1")
+	p.c.write(unknown)
+	p.c.write(&msg{Tag: 0, Dst: "Named"})
+	waitRoute(t, b, "Named")
+	if b.CanRoute("") {
+		t.Errorf("Frame naming no function registered an empty route.")
+	}
+}
+
+// Dial fails when the broker closes the connection before settling the handshake.
+func TestHandshakeClosed(t *testing.T) {
+	sock := rawListener(t, func(p *rawPeer) { p.read(t) })
+	c := newRouter(t)
+	defer c.Close()
+	if err := c.Dial(sock); !errors.Is(err, ErrClosed) {
+		t.Errorf("Dial of broker closing during handshake = %v, want ErrClosed.", err)
+	}
+}
+
+// A broker closing the connection right after settling the handshake is reconnected to, rather than failing Dial.
+func TestClosedAfterHandshake(t *testing.T) {
+	sock := rawListener(t, func(p *rawPeer) { p.ackHandshake(t) })
+	log := new(testLogger)
+	c := newRouter(t, WithLogger(log), WithReconnect(5*time.Millisecond, 20*time.Millisecond))
+	defer c.Close()
+	if err := c.Dial(sock); err != nil {
+		t.Errorf("Dial of broker closing after the handshake = %v", err)
+	}
+	waitFor(t, "reconnect", func() bool { return log.logged("reconnecting") })
+}
+
+// Peers of this version agree on it.
+func TestHandshakeAgreed(t *testing.T) {
+	_, sock := newBroker(t)
+	c := newClient(t, sock, nil)
+	if v := c.uplink.version; v != protocolVersion {
+		t.Errorf("Client agreed version %d, want %d.", v, protocolVersion)
+	}
+}
@@ -0,0 +1,88 @@
+package ezipc
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// MethodProvider resolves a name nothing is registered under, reporting if it provides it and the handler to call it with.
+// Handlers recieve the argument and return the reply as encoded by the router's codec.
+type MethodProvider func(name string) (found bool, exec func(arg []byte) ([]byte, error))
+
+// Consulted for names nothing is registered under.
+type providerTable struct {
+	lock     sync.Mutex
+	provider MethodProvider
+}
+
+// RegisterProvider sets provider to be consulted when a call arrives for a name nothing is registered under.
+// Methods it provides are registered on first call and announced to our uplink from then on.
+// Since our uplink only routes names announced to it, use AnnounceProvided to announce methods before they are first called through it.
+func (e *EzIPC) RegisterProvider(provider MethodProvider) {
+	e.method_provider.lock.Lock()
+	defer e.method_provider.lock.Unlock()
+	e.method_provider.provider = provider
+}
+
+// AnnounceProvided consults the provider for each of names, registering and announcing those it provides.
+// Names the provider doesn't provide are reported in the error, the rest are still registered.
+func (e *EzIPC) AnnounceProvided(names ...string) error {
+	var missing []string
+	for _, name := range names {
+		if e.provide(name) == nil {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("Provider does not provide %s.", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Registers name from the provider if it provides it, returning the connection it is registered under.
+func (e *EzIPC) provide(name string) *connection {
+	e.method_provider.lock.Lock()
+	defer e.method_provider.lock.Unlock()
+
+	if e.method_provider.provider == nil {
+		return nil
+	}
+	// Another call may have registered it while we waited.
+	if c := e.lookup(name); c != nil && c.exec != nil {
+		return c
+	}
+
+	found, exec := e.method_provider.provider(name)
+	if !found || exec == nil {
+		return nil
+	}
+	if err := e.registerExec(name, e.wrapProvided(exec), nil); err != nil {
+		return nil
+	}
+	return e.lookup(name)
+}
+
+// Wraps handler from a provider to handle incoming and outgoing IPC msgs.
+func (e *EzIPC) wrapProvided(exec func(arg []byte) ([]byte, error)) func(*msg) *msg {
+	return func(req *msg) *msg {
+		req.Blob = nil
+
+		Va1, err := e.decodeField(req.Va1)
+		req.Va1 = ""
+		req.Va2 = ""
+		if err != nil {
+			req.Err = err.Error()
+			return req
+		}
+
+		out, err := exec(Va1)
+		if err != nil {
+			setErr(req, err)
+			return req
+		}
+		req.Va2 = base64.StdEncoding.EncodeToString(out)
+		return req
+	}
+}
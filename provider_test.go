@@ -0,0 +1,43 @@
+package ezipc
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Upper cases strings for any name under Plugin.
+func pluginProvider(name string) (bool, func([]byte) ([]byte, error)) {
+	if !strings.HasPrefix(name, "Plugin.") {
+		return false, nil
+	}
+	return true, func(arg []byte) ([]byte, error) { return bytes.ToUpper(arg), nil }
+}
+
+// Names from a provider are registered on first call, and once announced are routed to it by the broker.
+func TestRegisterProvider(t *testing.T) {
+	b, sock := newBroker(t)
+	b.RegisterProvider(pluginProvider)
+	c := newClient(t, sock, nil)
+
+	var reply string
+	if err := c.Call("Plugin.Lazy", "lazy", &reply); err != nil || reply != "LAZY" {
+		t.Errorf("Call of a name provided by the broker = %q, %v", reply, err)
+	}
+	if !b.routable("Plugin.Lazy") {
+		t.Error("Provided name not registered after its first call.")
+	}
+	if err := c.Call("Other", "x", &reply); err != ErrFail {
+		t.Errorf("Call of a name not provided = %v, want ErrFail", err)
+	}
+
+	p := newClient(t, sock, nil)
+	p.RegisterProvider(pluginProvider)
+	if err := p.AnnounceProvided("Plugin.Upper", "Missing"); err == nil || !strings.Contains(err.Error(), "Missing") {
+		t.Errorf("AnnounceProvided = %v, want Missing reported", err)
+	}
+	waitRoute(t, b, "Plugin.Upper")
+	if err := c.Call("Plugin.Upper", "remote", &reply); err != nil || reply != "REMOTE" {
+		t.Errorf("Call of an announced name = %q, %v", reply, err)
+	}
+}
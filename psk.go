@@ -0,0 +1,240 @@
+package ezipc
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ErrPSKMismatch closes connections from peers which don't share our pre-shared key.
+var ErrPSKMismatch = errors.New("Pre-shared key mismatch.")
+
+// Size of the nonces each end contributes to the handshake.
+const pskNonceSize = 32
+
+// Time Dial waits on the listener's challenge.
+const pskTimeout = 5 * time.Second
+
+// SetPSK encrypts arguments, replies and blobs of every call with AES-GCM using a key derived from psk, nil disables.
+// Peers must share the same key: on connecting the listener sends a challenge, the dialer answers it in its handshake
+// and the listener answers the dialer's in its acknowledgement, so each end proves it holds the key without revealing it.
+// Payloads are sealed with a key unique to the connection, bound to their tag and direction, and frames which fail
+// to decrypt close the connection. Names, errors and routing remain unencrypted. Must be called before Dial or Listen.
+func (e *EzIPC) SetPSK(psk []byte) {
+	if len(psk) == 0 {
+		e.psk = nil
+		return
+	}
+	key := sha256.Sum256(psk)
+	e.psk = key[:]
+}
+
+// Returns the MAC of nonces ns and nc, under the key derived from the pre-shared key, for purpose label.
+func (e *EzIPC) pskMAC(label string, ns, nc []byte) []byte {
+	h := hmac.New(sha256.New, e.psk)
+	h.Write([]byte(label))
+	h.Write(ns)
+	h.Write(nc)
+	return h.Sum(nil)
+}
+
+// Returns pskNonceSize random bytes.
+func pskNonce() []byte {
+	nonce := make([]byte, pskNonceSize)
+	rand.Read(nonce)
+	return nonce
+}
+
+// Derives the key sealing payloads over c from the listener's nonce ns and the dialer's nonce nc.
+func (c *connection) pskSession(ns, nc []byte) error {
+	block, err := aes.NewCipher(c.router.pskMAC("session", ns, nc))
+	if err != nil {
+		return err
+	}
+	c.aead, err = cipher.NewGCM(block)
+	return err
+}
+
+// Sends the challenge of the listener over accepted connection c, which the dialer must answer in its handshake.
+func (c *connection) pskChallenge() error {
+	c.psk_nonce = pskNonce()
+	challenge := &msg{Tag: 0}
+	challenge.setHdr(hdrPSK, base64.StdEncoding.EncodeToString(c.psk_nonce))
+	return c.write(challenge)
+}
+
+// Reads the listener's challenge on dialed connection c, returning our answer for the handshake.
+// Read before the reciever starts, through the reader it goes on to use.
+func (c *connection) pskAnswer() (string, error) {
+	c.conn.SetReadDeadline(time.Now().Add(pskTimeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	c.rd = bufio.NewReader(c.conn)
+	frame, err := c.readFrame(c.rd, 4096)
+	if err != nil {
+		return "", fmt.Errorf("%w No challenge from listener: %s", ErrPSKMismatch, err)
+	}
+	m, err := decodeText(frame)
+	if err != nil || m.Tag != 0 {
+		return "", ErrPSKMismatch
+	}
+	ns, err := base64.StdEncoding.DecodeString(m.hdr(hdrPSK))
+	if err != nil || len(ns) != pskNonceSize {
+		return "", ErrPSKMismatch
+	}
+
+	e := c.router
+	nc := pskNonce()
+	if err = c.pskSession(ns, nc); err != nil {
+		return "", err
+	}
+	// Expected in the listener's acknowledgement.
+	c.psk_proof = base64.StdEncoding.EncodeToString(e.pskMAC("listen", ns, nc))
+	return base64.StdEncoding.EncodeToString(append(nc, e.pskMAC("dial", ns, nc)...)), nil
+}
+
+// Checks the dialer's answer to our challenge in its handshake m, preparing our own proof for the acknowledgement.
+func (c *connection) pskVerify(m *msg) error {
+	answer, err := base64.StdEncoding.DecodeString(m.hdr(hdrPSK))
+	if err != nil || len(answer) != pskNonceSize+sha256.Size || c.psk_nonce == nil {
+		return ErrPSKMismatch
+	}
+	e := c.router
+	ns, nc := c.psk_nonce, answer[:pskNonceSize]
+	if !hmac.Equal(answer[pskNonceSize:], e.pskMAC("dial", ns, nc)) {
+		return ErrPSKMismatch
+	}
+	if err = c.pskSession(ns, nc); err != nil {
+		return err
+	}
+	c.psk_proof = base64.StdEncoding.EncodeToString(e.pskMAC("listen", ns, nc))
+	return nil
+}
+
+// Returns the additional data binding a field of a frame to its tag, name and direction.
+// Frames we send are bound to our side of c, fromPeer binds those recieved to the peer's side.
+func (c *connection) pskAD(fromPeer bool, tag int32, field string, dst string) []byte {
+	dir := "d"
+	if c.accepted != fromPeer {
+		dir = "l"
+	}
+	return []byte(dir + "\x00" + strconv.Itoa(int(tag)) + "\x00" + field + "\x00" + dst)
+}
+
+// Encrypts data, prefixing it with its nonce.
+func (c *connection) sealPSK(data []byte, ad []byte) []byte {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(data)+c.aead.Overhead())
+	rand.Read(nonce)
+	return c.aead.Seal(nonce, nonce, data, ad)
+}
+
+// Decrypts data sealed by sealPSK.
+func (c *connection) openPSK(data []byte, ad []byte) ([]byte, error) {
+	n := c.aead.NonceSize()
+	if len(data) < n {
+		return nil, ErrPSKMismatch
+	}
+	out, err := c.aead.Open(nil, data[:n], data[n:], ad)
+	if err != nil {
+		return nil, ErrPSKMismatch
+	}
+	return out, nil
+}
+
+// Returns the argument, reply, blob and header of req encrypted for the wire, va1 and va2 as returned by compressFields.
+func (c *connection) sealFields(req *msg, va1, va2 string, hdr map[string]string) (string, string, []byte, map[string]string, error) {
+	if c.aead == nil {
+		return "", "", nil, nil, ErrPSKMismatch
+	}
+	raw1, err := base64.StdEncoding.DecodeString(va1)
+	if err != nil {
+		return "", "", nil, nil, err
+	}
+	raw2, err := base64.StdEncoding.DecodeString(va2)
+	if err != nil {
+		return "", "", nil, nil, err
+	}
+
+	sealed := make(map[string]string, len(hdr)+1)
+	for k, v := range hdr {
+		sealed[k] = v
+	}
+	sealed[hdrSealed] = "1"
+
+	va1 = base64.StdEncoding.EncodeToString(c.sealPSK(raw1, c.pskAD(false, req.Tag, "1", req.Dst)))
+	va2 = base64.StdEncoding.EncodeToString(c.sealPSK(raw2, c.pskAD(false, req.Tag, "2", req.Dst)))
+	return va1, va2, c.sealPSK(req.Blob, c.pskAD(false, req.Tag, "b", req.Dst)), sealed, nil
+}
+
+// Decrypts a message recieved on c, refusing messages from peers not holding our key.
+func (c *connection) unseal(m *msg) (err error) {
+	e := c.router
+	if e.psk == nil {
+		if m.hdr(hdrSealed) != "" || m.hdr(hdrPSK) != "" {
+			return ErrPSKMismatch
+		}
+		return nil
+	}
+
+	// Nothing is accepted from the peer until it has proven it holds the key,
+	// in the handshake from a dialer, or in the acknowledgement from a listener.
+	if atomic.LoadUint32(&c.authed) == 0 {
+		switch {
+		case m.Tag != 0:
+			return ErrPSKMismatch
+		case c.accepted && m.hdr(hdrHandshake) != "":
+			if err = c.pskVerify(m); err != nil {
+				return err
+			}
+		case !c.accepted && m.hdr(hdrHandshakeAck) != "" && c.psk_proof != "":
+			if !hmac.Equal([]byte(m.hdr(hdrPSK)), []byte(c.psk_proof)) {
+				return ErrPSKMismatch
+			}
+		default:
+			return ErrPSKMismatch
+		}
+		atomic.StoreUint32(&c.authed, 1)
+		return nil
+	}
+
+	if m.Tag == 0 {
+		return nil
+	}
+	if m.hdr(hdrSealed) == "" {
+		return ErrPSKMismatch
+	}
+	delete(m.Hdr, hdrSealed)
+
+	open := func(field string, ad []byte) (string, error) {
+		data, err := base64.StdEncoding.DecodeString(field)
+		if err != nil {
+			return "", fmt.Errorf("%w: %s", ErrPSKMismatch, err)
+		}
+		if data, err = c.openPSK(data, ad); err != nil {
+			return "", err
+		}
+		return base64.StdEncoding.EncodeToString(data), nil
+	}
+	if m.Va1, err = open(m.Va1, c.pskAD(true, m.Tag, "1", m.Dst)); err != nil {
+		return
+	}
+	if m.Va2, err = open(m.Va2, c.pskAD(true, m.Tag, "2", m.Dst)); err != nil {
+		return
+	}
+	if m.Blob, err = c.openPSK(m.Blob, c.pskAD(true, m.Tag, "b", m.Dst)); err != nil {
+		return
+	}
+	if len(m.Blob) == 0 {
+		m.Blob = nil
+	}
+	return nil
+}
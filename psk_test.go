@@ -0,0 +1,77 @@
+package ezipc
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Records everything written to the connection.
+type tapConn struct {
+	net.Conn
+	lock    sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *tapConn) Write(p []byte) (int, error) {
+	c.lock.Lock()
+	c.written.Write(p)
+	c.lock.Unlock()
+	return c.Conn.Write(p)
+}
+
+func (c *tapConn) contains(s string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return bytes.Contains(c.written.Bytes(), []byte(s))
+}
+
+// Returns a client dialing sock with key psk, nil for none, the tap on its connection, and the error of Dial.
+func pskClient(t *testing.T, sock string, psk []byte, opts ...Option) (*EzIPC, *tapConn, error) {
+	c := newRouter(t, opts...)
+	c.SetPSK(psk)
+	tap := new(tapConn)
+	c.SetDialer(func(network, addr string) (net.Conn, error) {
+		conn, err := net.Dial(network, addr)
+		tap.Conn = conn
+		return tap, err
+	})
+	t.Cleanup(func() { c.Close() })
+	return c, tap, c.Dial(sock)
+}
+
+// Peers sharing a key call each other with payloads encrypted on the wire, others are refused.
+func TestPSK(t *testing.T) {
+	key := []byte("shared secret")
+	for _, opts := range [][]Option{nil, {WithBinaryFraming()}} {
+		log := new(testLogger)
+		b := newRouter(t, WithLogger(log))
+		b.SetPSK(key)
+		b.RegisterName("Echo", func(arg string, reply *string) error { *reply = arg; return nil })
+		sock := listen(t, b, tempSocket(t))
+
+		c, tap, err := pskClient(t, sock, key, opts...)
+		if err != nil {
+			t.Fatalf("Dial with a shared key: %s", err)
+		}
+		arg := strings.Repeat("plaintext ", 10)
+		var reply string
+		if err := c.Call("Echo", arg, &reply); err != nil || reply != arg {
+			t.Fatalf("Echo with a shared key = %q, %v", reply, err)
+		}
+		if !tap.contains("Echo") || tap.contains("plaintext") {
+			t.Errorf("Frames on the wire should carry the name in the clear and the argument encrypted.")
+		}
+
+		for _, psk := range [][]byte{[]byte("wrong secret"), nil} {
+			if _, _, err := pskClient(t, sock, psk, opts...); err == nil {
+				t.Errorf("Dial with key %q succeeded, want refused.", psk)
+			}
+		}
+		if !log.logged(ErrPSKMismatch.Error()) {
+			t.Errorf("Broker didn't log refusing a peer without the key.")
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package ezipc
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// WithReconnect redials the uplink when it drops, waiting min before the first attempt and doubling the wait after each failure, up to max.
+// Names registered with us are announced again once reconnected. Calls pending on the dropped uplink fail with ErrClosed,
+// except those made with CallIdempotent, which are re-sent once reconnected.
+func WithReconnect(min, max time.Duration) Option {
+	return func(e *EzIPC) {
+		if max < min {
+			max = min
+		}
+		e.reconnect_min, e.reconnect_max = min, max
+	}
+}
+
+// IsConnected reports whether the router is listening, or has a live uplink.
+func (e *EzIPC) IsConnected() bool {
+	if atomic.LoadUint32(&e.closed) == 1 || atomic.LoadUint32(&e.connected) == 0 {
+		return false
+	}
+	e.connMapLock.RLock()
+	defer e.connMapLock.RUnlock()
+	if e.uplink == nil {
+		return true
+	}
+	_, open := e.conns[e.uplink]
+	return open
+}
+
+// Redials socketf with backoff after uplink c dropped with err, until reconnected or closed.
+func (e *EzIPC) reconnect(c *connection, socketf string, err error) (*connection, error) {
+	delay := e.reconnect_min
+	e.logf("Uplink %s dropped (%s), reconnecting in %v.", socketf, err, delay)
+	for {
+		time.Sleep(delay)
+		if atomic.LoadUint32(&e.closed) == 1 {
+			return nil, ErrClosed
+		}
+		// Dialed elsewhere in the meantime.
+		if uplink, _ := e.currentUplink(); uplink != c {
+			return nil, nil
+		}
+		next, err := e.open(socketf)
+		if err == nil {
+			e.logf("Reconnected to %s.", socketf)
+			return next, nil
+		}
+		if uplink, _ := e.currentUplink(); uplink != c {
+			return nil, err
+		}
+		if delay *= 2; delay > e.reconnect_max {
+			delay = e.reconnect_max
+		}
+		e.logf("Reconnecting to %s failed (%s), retrying in %v.", socketf, err, delay)
+	}
+}
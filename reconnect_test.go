@@ -0,0 +1,80 @@
+package ezipc
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A router serving through an existing broker keeps reconnecting as the broker restarts, from a single goroutine
+// whose stack doesn't grow with each reconnect, for both Listen and Dial.
+func TestReconnectLoop(t *testing.T) {
+	sock := tempSocket(t)
+	b := newRouter(t)
+	listen(t, b, sock)
+
+	s := newRouter(t, WithReconnect(5*time.Millisecond, 20*time.Millisecond))
+	s.RegisterName("Svc", func(arg int, reply *int) error { *reply = arg; return nil })
+	go s.Listen(sock)
+	defer s.Close()
+	c := newClient(t, sock, nil, WithReconnect(5*time.Millisecond, 20*time.Millisecond))
+	waitRoute(t, b, "Svc")
+
+	for i := 0; i < 3; i++ {
+		b.Close()
+		b = newRouter(t)
+		listen(t, b, sock)
+		waitRoute(t, b, "Svc")
+		waitFor(t, "client to reconnect", func() bool { return len(b.Dump().Conns) == 2 })
+	}
+
+	var reply int
+	if err := c.Call("Svc", 7, &reply); err != nil || reply != 7 {
+		t.Errorf("Call after reconnects = %d, %v", reply, err)
+	}
+
+	buf := make([]byte, 1<<20)
+	stacks := string(buf[:runtime.Stack(buf, true)])
+	for _, frame := range []string{").connect(", ").keepUplink("} {
+		if n := strings.Count(stacks, frame); n > 2 {
+			t.Errorf("%d frames of %s after reconnecting 3 times, want one per router.", n, frame)
+		}
+	}
+}
+
+// The uplink may be inspected and used while it reconnects, run with -race.
+func TestUplinkWhileReconnecting(t *testing.T) {
+	sock := tempSocket(t)
+	b := newRouter(t)
+	listen(t, b, sock)
+	c := newClient(t, sock, nil, WithReconnect(time.Millisecond, 5*time.Millisecond))
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			c.IsConnected()
+			c.Uplink()
+			c.Notify("Missing", 1)
+			if s, err := c.OpenStream("Missing"); err == nil {
+				s.Close()
+			}
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		b.Close()
+		b = newRouter(t)
+		listen(t, b, sock)
+		waitFor(t, "client to reconnect", func() bool { return len(b.Dump().Conns) == 1 })
+	}
+	close(stop)
+	<-done
+}
@@ -0,0 +1,54 @@
+package ezipc
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// ErrPanic is matched with errors.Is by errors returned to callers when a handler panics.
+var ErrPanic = errors.New("Handler panicked.")
+
+// PanicError is returned to the caller when the handler of a call panics, the panic is recovered rather than crashing the process.
+type PanicError struct {
+	Msg string
+}
+
+func (p *PanicError) Error() string { return p.Msg }
+
+func (p *PanicError) Is(target error) bool { return target == ErrPanic }
+
+// SetPanicTrace includes the stack trace of a panicking handler in the error returned to the caller, for debugging.
+func (e *EzIPC) SetPanicTrace(enable bool) {
+	e.panic_trace = enable
+}
+
+// Executes req with the local function of dest, returning a panic in the function to the caller as an error.
+func (e *EzIPC) execute(dest *connection, req *msg) (resp *msg) {
+	defer func() {
+		if r := recover(); r != nil {
+			e.panicked(r, debug.Stack(), req)
+			resp = req
+		}
+	}()
+	atomic.AddUint64(&e.counters.calls_recieved, 1)
+	return dest.exec(req)
+}
+
+// Logs panic r recovered from the handler of reqs, replacing their replies with the error.
+func (e *EzIPC) panicked(r interface{}, stack []byte, reqs ...*msg) {
+	if len(reqs) == 0 {
+		return
+	}
+	err := fmt.Sprintf("Handler %s panicked: %v", reqs[0].Dst, r)
+	e.logf("%s\n%s", err, stack)
+	if e.panic_trace {
+		err = err + "\n" + string(stack)
+	}
+	for _, req := range reqs {
+		req.Va1, req.Va2, req.Blob = "", "", nil
+		req.Err = err
+		req.setHdr(hdrPanic, "1")
+	}
+}
@@ -0,0 +1,52 @@
+package ezipc
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// A panicking handler returns a PanicError to the caller, whether executed locally, relayed or in a batch,
+// and the router goes on serving calls.
+func TestPanicRecovered(t *testing.T) {
+	boom := func(arg int, reply *int) error {
+		var m map[int]int
+		m[arg] = arg
+		return nil
+	}
+	boomBatch := func(args []int) ([]int, []error) { panic("batch") }
+
+	b, sock := newBroker(t)
+	b.RegisterName("Boom", boom)
+	b.RegisterName("Ok", func(arg int, reply *int) error { *reply = arg; return nil })
+	if err := b.RegisterBatch("BoomBatch", boomBatch, 2, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	newClient(t, sock, map[string]interface{}{"RemoteBoom": boom})
+	waitRoute(t, b, "RemoteBoom")
+	c := newClient(t, sock, nil)
+
+	calls := []struct {
+		path   string
+		caller *EzIPC
+		name   string
+	}{
+		{"local", b, "Boom"},
+		{"local batch", b, "BoomBatch"},
+		{"relayed", c, "RemoteBoom"},
+		{"batch", c, "BoomBatch"},
+	}
+	for _, call := range calls {
+		var reply int
+		err := call.caller.Call(call.name, 1, &reply)
+		var perr *PanicError
+		if !errors.Is(err, ErrPanic) || !errors.As(err, &perr) {
+			t.Errorf("%s call of panicking handler = %v, want PanicError.", call.path, err)
+		}
+	}
+
+	var reply int
+	if err := c.Call("Ok", 2, &reply); err != nil || reply != 2 {
+		t.Errorf("Call after panics = %d, %v", reply, err)
+	}
+}
@@ -1,30 +1,46 @@
 package ezipc
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/base64"
-	"encoding/json"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unicode"
 	"unicode/utf8"
 )
 
-// Wraps function to handle incoming and outgoing IPC msgs.
-func wrapFunc(fptr interface{}) (newFunc func(*msg) *msg, err error) {
-	fn := reflect.TypeOf(fptr)
+// CheckSignature reports whether fptr meets the requirements for registration, without registering it.
+// Useful in unit tests to verify handlers before deploying them.
+func CheckSignature(fptr interface{}) error {
+	if fptr == nil {
+		return errors.New("Cannot register nil.")
+	}
+	return checkSignature(reflect.TypeOf(fptr))
+}
 
-	// Sanity checks for registering function.
+// Sanity checks for registering function.
+func checkSignature(fn reflect.Type) error {
 	if fn.Kind() != reflect.Func {
-		return nil, fmt.Errorf("Only functions may be registered, got %s.", fn.Kind().String())
+		return fmt.Errorf("Only functions may be registered, got %s.", fn.Kind().String())
+	}
+
+	if isStreamFunc(fn) {
+		return nil
 	}
 
-	if fn.NumIn() != 2 {
-		return nil,
-			errors.New("Method must contain two exported (or builtin) arguments.")
+	if fn.NumIn() != 2 && !isLogFunc(fn) && !isContextFunc(fn) {
+		return fmt.Errorf("Method must contain two exported (or builtin) arguments, got %d.", fn.NumIn())
 	}
 
 	varCheck := func(input reflect.Type) bool {
@@ -47,132 +63,533 @@ func wrapFunc(fptr interface{}) (newFunc func(*msg) *msg, err error) {
 		return false
 	}
 
-	if !varCheck(fn.In(0)) {
-		return nil, errors.New("Method must use exported (or builtin) argument.")
+	arg, reply := argTypes(fn)
+
+	if !varCheck(arg) {
+		return fmt.Errorf("Method must use exported (or builtin) argument, got %s.", arg)
+	}
+
+	if isBlobFunc(fn) {
+		return nil
+	}
+
+	if reply.Kind() != reflect.Ptr || !varCheck(reply) {
+		return fmt.Errorf("Second argument or Reply must be ptr to exported (or builtin) value, got %s.", reply)
 	}
-	if fn.In(1).Kind() != reflect.Ptr || !varCheck(fn.In(1)) {
-		return nil, errors.New("Second argument or Reply must be ptr to exported (or builtin) value.")
+	if fn.NumOut() != 1 || fn.Out(0) != errorType {
+		return fmt.Errorf("Method must return only an error, got %s.", fn)
 	}
-	if fn.NumOut() != 1 || fn.Out(0).Name() != "error" {
-		return nil, errors.New("Method must return only an error.")
+	return nil
+}
+
+// Wraps function to handle incoming and outgoing IPC msgs.
+func (e *EzIPC) wrapFunc(fptr interface{}, opts ...RegisterOption) (newFunc func(*msg) *msg, err error) {
+	fn := reflect.TypeOf(fptr)
+
+	if err = checkSignature(fn); err != nil {
+		return nil, err
 	}
 
-	in := reflect.New(fn.In(0))
-	out := reflect.New(fn.In(1).Elem())
+	if isStreamFunc(fn) {
+		return e.wrapStreamFunc(fptr)
+	}
+
+	reg, err := newRegistration(fn, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if isBlobFunc(fn) {
+		return e.wrapBlobFunc(fptr, reg)
+	}
 
 	funcPtr := reflect.ValueOf(fptr)
+	logged := isLogFunc(fn)
+	with_ctx := isContextFunc(fn)
+	argType, replyType := argTypes(fn)
 
 	// Create new function that recieves *MSG and outputs *MSG.
 	newFunc = func(req *msg) *msg {
+		req.Blob = nil
+
+		in := reflect.New(argType)
+		out := reflect.New(replyType.Elem())
+
 		// Flip destination and source for return message.
-		Va1, err := base64.StdEncoding.DecodeString(req.Va1)
+		Va1, err := e.decodeField(req.Va1)
 		if err != nil {
 			req.Err = err.Error()
 			return req
 		}
 
-		Va2, err := base64.StdEncoding.DecodeString(req.Va2)
+		Va2, err := e.decodeField(req.Va2)
 		if err != nil {
 			req.Err = err.Error()
 			return req
 		}
 
-		err = json.Unmarshal(Va1, in.Interface())
+		err = e.codec.Unmarshal(Va1, in.Interface())
 		req.Va1 = ""
 		if err != nil {
 			req.Err = err.Error()
 			return req
 		}
 
-		err = json.Unmarshal(Va2, out.Interface())
+		// The caller's reply serves as a template, out starts pre-filled with it rather than zeroed.
+		err = e.codec.Unmarshal(Va2, out.Interface())
 		req.Va2 = ""
 		if err != nil {
 			req.Err = err.Error()
 			return req
 		}
 
-		errResp := funcPtr.Call([]reflect.Value{in.Elem(), out})[0].Interface()
-		if errResp != nil {
-			req.Err = errResp.(error).Error()
+		if err := reg.validate(in.Elem()); err != nil {
+			setErr(req, err)
 			return req
 		}
 
-		json_out, err := json.Marshal(out.Interface())
+		args := []reflect.Value{in.Elem(), out}
+		if with_ctx {
+			ctx := req.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			args = append([]reflect.Value{reflect.ValueOf(ctx)}, args...)
+		}
+		if logged {
+			args = append(args, reflect.ValueOf(io.Writer(&logWriter{req: req})))
+		}
+
+		errResp := funcPtr.Call(args)[0].Interface()
+		if errResp != nil {
+			setErr(req, errResp.(error))
+			if _, partial := errResp.(partialError); !partial {
+				return req
+			}
+		}
+
+		encoded, err := e.codec.Marshal(out.Interface())
 		if err != nil {
 			req.Err = err.Error()
 			return req
 		}
 
-		req.Va2 = base64.StdEncoding.EncodeToString(json_out)
+		req.Va2 = base64.StdEncoding.EncodeToString(encoded)
 
 		return req
 	}
 	return newFunc, err
 }
 
+// Partial wraps an error returned by a handler so that the reply is still delivered to the caller.
+// By default a reply is discarded when a handler returns an error, with Partial the caller's
+// Call populates reply with whatever the handler set and also returns the error.
+func Partial(err error) error {
+	if err == nil {
+		return nil
+	}
+	return partialError{err}
+}
+
+// Error which delivers the reply alongside it.
+type partialError struct {
+	error
+}
+
+func (p partialError) Unwrap() error { return p.error }
+
+var blobType = reflect.TypeOf([]byte(nil))
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+var writerType = reflect.TypeOf((*io.Writer)(nil)).Elem()
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// Determines if function is a handler taking a context: func(ctx context.Context, argType T1, replyType *T2) error
+func isContextFunc(fn reflect.Type) bool {
+	return fn.Kind() == reflect.Func && fn.NumIn() == 3 && fn.In(0) == contextType
+}
+
+// Returns the argument and reply types of a handler, skipping its context if it takes one.
+func argTypes(fn reflect.Type) (arg, reply reflect.Type) {
+	if isContextFunc(fn) {
+		return fn.In(1), fn.In(2)
+	}
+	return fn.In(0), fn.In(1)
+}
+
+// Determines if function is a handler with a log writer: func(argType T1, replyType *T2, log io.Writer) error
+func isLogFunc(fn reflect.Type) bool {
+	return fn.Kind() == reflect.Func && fn.NumIn() == 3 && fn.In(2) == writerType
+}
+
+// Sends log output of a handler back to the caller of req as it is written.
+type logWriter struct {
+	req *msg
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	// Local calls pass output straight to the caller's callback.
+	if w.req.log != nil {
+		w.req.log(append([]byte(nil), p...))
+		return len(p), nil
+	}
+	if w.req.conn == nil {
+		return len(p), nil
+	}
+	out := &msg{
+		Tag:  w.req.Tag,
+		Dst:  w.req.Dst,
+		Blob: append([]byte(nil), p...),
+	}
+	out.setHdr(hdrReply, "1")
+	out.setHdr(hdrLog, "1")
+	if err := w.req.conn.send(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Determines if function is a blob handler: func(argType T1, blob []byte) ([]byte, error)
+func isBlobFunc(fn reflect.Type) bool {
+	return fn.NumIn() == 2 && fn.In(1) == blobType &&
+		fn.NumOut() == 2 && fn.Out(0) == blobType && fn.Out(1) == errorType
+}
+
+// Wraps blob handler, the blob is carried in the message rather than encoded with the argument.
+func (e *EzIPC) wrapBlobFunc(fptr interface{}, reg *registration) (newFunc func(*msg) *msg, err error) {
+	fn := reflect.TypeOf(fptr)
+	funcPtr := reflect.ValueOf(fptr)
+
+	newFunc = func(req *msg) *msg {
+		Va1, err := e.decodeField(req.Va1)
+		req.Va1 = ""
+		req.Va2 = ""
+		if err != nil {
+			req.Err = err.Error()
+			return req
+		}
+
+		in := reflect.New(fn.In(0))
+		err = e.codec.Unmarshal(Va1, in.Interface())
+		if err != nil {
+			req.Err = err.Error()
+			req.Blob = nil
+			return req
+		}
+
+		if err := reg.validate(in.Elem()); err != nil {
+			setErr(req, err)
+			req.Blob = nil
+			return req
+		}
+
+		out := funcPtr.Call([]reflect.Value{in.Elem(), reflect.ValueOf(req.Blob)})
+		req.Blob = out[0].Interface().([]byte)
+		if errResp := out[1].Interface(); errResp != nil {
+			setErr(req, errResp.(error))
+		}
+		return req
+	}
+	return newFunc, nil
+}
+
 // Registers local methods or function, informs Broker of registration.
 // Function/method template should follow:
 // func name(argType T1, replyType *T2) error
 // func (*T) Name(argType T1, replyType *T2) error
+// Handlers may also take a log writer, whose output is passed to the callback of CallWithLog as it is written:
+// func name(argType T1, replyType *T2, log io.Writer) error
+// replyType recieves the reply as provided by the caller, so handlers may fill in only the fields they change.
 func (e *EzIPC) Register(fptr interface{}) error { return e.RegisterName("", fptr) }
 
+// RegisterAndWait operates as Register, then blocks until the broker has acknowledged the names it registered.
+// Returns ErrTimeout if they are not acknowledged within timeout, or ErrDuplicateRoute if the broker refused one.
+func (e *EzIPC) RegisterAndWait(fptr interface{}, timeout time.Duration) error {
+	names, err := e.registerNamed("", fptr)
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		if e.getUplink() == nil {
+			return nil
+		}
+
+		acked, changed, err := e.acks.check(names)
+		if acked || err != nil {
+			return err
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return ErrTimeout
+		}
+	}
+}
+
+// Registrations acknowledged by the uplink.
+type acknowledgements struct {
+	lock    sync.Mutex
+	acked   map[string]error
+	changed chan struct{}
+}
+
+// Records acknowledgement of name, with the error text of a refused registration.
+func (a *acknowledgements) ack(name string, refused string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.acked == nil {
+		a.acked = make(map[string]error)
+	}
+	switch refused {
+	case "":
+		a.acked[name] = nil
+	case ErrDuplicateRoute.Error():
+		a.acked[name] = ErrDuplicateRoute
+	default:
+		a.acked[name] = errors.New(refused)
+	}
+	if a.changed != nil {
+		close(a.changed)
+		a.changed = nil
+	}
+}
+
+// Forgets acknowledgement of name, once unregistered.
+func (a *acknowledgements) forget(name string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.acked, name)
+}
+
+// Forgets acknowledgements, for a new uplink.
+func (a *acknowledgements) reset() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.acked = nil
+}
+
+// Determines if all names are acknowledged, otherwise returns a channel closed on the next acknowledgement.
+// Returns the error of the first refused registration.
+func (a *acknowledgements) check(names []string) (bool, <-chan struct{}, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, name := range names {
+		err, ok := a.acked[name]
+		if err != nil {
+			return false, nil, err
+		}
+		if !ok {
+			if a.changed == nil {
+				a.changed = make(chan struct{})
+			}
+			return false, a.changed, nil
+		}
+	}
+	return true, nil, nil
+}
+
 // RegisterName operates exactly as Register but allows changing the name of the object or function.
 func (e *EzIPC) RegisterName(name string, fptr interface{}) (err error) {
+	_, err = e.registerNamed(name, fptr)
+	return
+}
+
+// Registers fptr as RegisterName, returning the names it was registered as.
+func (e *EzIPC) registerNamed(name string, fptr interface{}) (names []string, err error) {
 	// Allows registration of both functions and methods.
 	// Register function if provided function, register all methods if provided an object.
 
 	switch reflect.TypeOf(fptr).Kind() {
 	case reflect.Func:
-		wFunc, err := wrapFunc(fptr)
-		if err != nil {
-			return err
-		}
-
-		if name == "" {
-			name = strings.TrimPrefix(runtime.FuncForPC(reflect.ValueOf(fptr).Pointer()).Name(), "main.")
-		}
-
-		// Add wrapped method to local method map.
-		e.route(&msg{
-			Dst: name,
-			Tag: 0,
-			conn: &connection{
-				routes: []string{name},
-				router: e,
-				exec:   wFunc,
-			},
-		})
+		name = funcName(name, fptr)
+		return []string{name}, e.registerFunc(name, fptr)
 
 	case reflect.Ptr:
 		ft := reflect.TypeOf(fptr)
 		fv := reflect.ValueOf(fptr)
+
+		// Methods are registered as base.Method, base defaulting to the name of the object's type.
+		base := name
+		if base == "" {
+			base = ft.Elem().Name()
+		}
+
 		for i := 0; i < ft.NumMethod(); i++ {
-			method := fv.Method(i)
-			if name == "" {
-				name = ft.Elem().Name()
-			}
-			method_name := fmt.Sprintf("%s.%s", name, ft.Method(i).Name)
-			method_ch, _ := utf8.DecodeRune([]byte(ft.Method(i).Name))
+			method := ft.Method(i)
+			method_ch, _ := utf8.DecodeRuneInString(method.Name)
 			if unicode.ToUpper(method_ch) != method_ch {
 				continue
 			}
-			err_s := e.RegisterName(method_name, method.Interface())
-			if err_s != nil {
-				return fmt.Errorf("Registration failed for [%s.%s]: %s", name, ft.Method(i).Name, err_s)
+			method_name := fmt.Sprintf("%s.%s", base, method.Name)
+			if err := e.registerFunc(method_name, fv.Method(i).Interface()); err != nil {
+				return names, fmt.Errorf("Registration failed for [%s]: %s", method_name, err)
 			}
-
+			names = append(names, method_name)
 		}
 	default:
-		return fmt.Errorf("Cannot register invalid type: %s", reflect.TypeOf(fptr).Kind())
+		return nil, fmt.Errorf("Cannot register invalid type: %s", reflect.TypeOf(fptr).Kind())
 	}
 	return
 }
 
+// RegisterNames registers a single function or method under each of names, such as both "Set" and "KV.Set".
+// The function is wrapped once and shared, so all names behave identically.
+func (e *EzIPC) RegisterNames(fptr interface{}, names ...string) error {
+	if fptr == nil || reflect.TypeOf(fptr).Kind() != reflect.Func {
+		return errors.New("RegisterNames requires a function or method value.")
+	}
+	if len(names) == 0 {
+		return errors.New("RegisterNames requires at least one name.")
+	}
+
+	wFunc, err := e.wrapFunc(fptr)
+	if err != nil {
+		return err
+	}
+	schema := deriveSchema(reflect.TypeOf(fptr))
+
+	for _, name := range names {
+		if err := e.registerExec(name, wFunc, schema); err != nil {
+			return fmt.Errorf("Registration failed for [%s]: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// Registers function under name, or its own name if empty.
+func (e *EzIPC) registerFunc(name string, fptr interface{}, opts ...RegisterOption) error {
+	wFunc, err := e.wrapFunc(fptr, opts...)
+	if err != nil {
+		return err
+	}
+
+	return e.registerExec(funcName(name, fptr), wFunc, deriveSchema(reflect.TypeOf(fptr)))
+}
+
+// Returns name, or the name of function fptr if empty.
+func funcName(name string, fptr interface{}) string {
+	if name == "" {
+		name = strings.TrimPrefix(runtime.FuncForPC(reflect.ValueOf(fptr).Pointer()).Name(), "main.")
+	}
+	return name
+}
+
+// Unregister removes name registered by this router's own functions, telling our uplink to stop routing it to us.
+func (e *EzIPC) Unregister(name string) error {
+	e.connMapLock.Lock()
+	var local []*connection
+	for _, c := range e.connMap[name] {
+		if c.exec != nil {
+			local = append(local, c)
+		}
+	}
+	if len(local) == 0 {
+		e.connMapLock.Unlock()
+		return fmt.Errorf("%s is not registered locally.", name)
+	}
+	var withdraw []func()
+	for _, c := range local {
+		if w := e.unroute(name, c); w != nil {
+			withdraw = append(withdraw, w)
+		}
+	}
+	e.acks.forget(name)
+	e.connMapLock.Unlock()
+
+	for _, w := range withdraw {
+		w()
+	}
+	return nil
+}
+
+// Removes name from the routes of c, returning the withdrawal of it from our uplink once nothing else provides it.
+// Must be called with connMapLock held, the withdrawal is sent once it is released.
+func (e *EzIPC) unroute(name string, c *connection) (withdraw func()) {
+	e.removeRoute(name, c)
+	c.removeName(name)
+	up := e.uplink
+	if len(e.connMap[name]) > 0 || up == nil || c == up {
+		return nil
+	}
+	unreg := &msg{Tag: 0, Dst: name}
+	unreg.setHdr(hdrUnregister, "1")
+	return func() { up.send(unreg) }
+}
+
+// Adds wrapped function to local method map, announcing it to our uplink.
+func (e *EzIPC) registerExec(name string, exec func(*msg) *msg, schema []byte) error {
+	e.connMapLock.RLock()
+	refused := e.dup_policy == RouteReject && len(e.connMap[name]) > 0
+	e.connMapLock.RUnlock()
+	if refused {
+		return ErrDuplicateRoute
+	}
+
+	e.route(&msg{
+		Dst: name,
+		Tag: 0,
+		conn: &connection{
+			id:     newConnID(),
+			routes: make([]string, 0),
+			router: e,
+			exec:   exec,
+			schema: schema,
+		},
+	})
+	return nil
+}
+
+var conn_ids uint64
+
+// Generates a process unique connection ID.
+func newConnID() string {
+	return strconv.FormatUint(atomic.AddUint64(&conn_ids, 1), 10)
+}
+
+// Generates a random identifier for a router instance.
+func newInstanceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Wraps a function provided by the router itself.
+func (e *EzIPC) builtin(fptr interface{}) *connection {
+	wFunc, err := e.wrapFunc(fptr)
+	if err != nil {
+		panic(err)
+	}
+	return &connection{
+		id:     newConnID(),
+		router: e,
+		exec:   wFunc,
+	}
+}
+
 // Generates new *riphub.connection from net.Conn.
 func (e *EzIPC) addconnection(conn net.Conn) *connection {
-	return &connection{
+	var addr string
+	if ra := conn.RemoteAddr(); ra != nil {
+		addr = ra.String()
+	}
+	c := &connection{
+		id:     newConnID(),
 		conn:   conn,
+		addr:   addr,
+		opened: time.Now(),
 		router: e,
 		routes: make([]string, 0),
 	}
+	if e.max_inflight > 0 {
+		c.slots = make(chan struct{}, e.max_inflight)
+	}
+	e.connMapLock.Lock()
+	e.conns[c] = struct{}{}
+	atomic.AddInt64(&e.counters.connections, 1)
+	e.connMapLock.Unlock()
+	return c
 }
@@ -0,0 +1,234 @@
+package ezipc
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+type unexportedArg struct{}
+
+// CheckSignature accepts what Register accepts, and names what is wrong with the rest.
+func TestCheckSignature(t *testing.T) {
+	valid := map[string]interface{}{
+		"builtin types": func(arg int, reply *string) error { return nil },
+		"blob handler":  func(arg int, blob []byte) ([]byte, error) { return nil, nil },
+	}
+	for name, f := range valid {
+		if err := CheckSignature(f); err != nil {
+			t.Errorf("CheckSignature of %s = %v", name, err)
+		}
+	}
+	invalid := map[string]interface{}{
+		"nil":                nil,
+		"not a function":     42,
+		"one argument":       func(arg int) error { return nil },
+		"unexported arg":     func(arg *unexportedArg, reply *int) error { return nil },
+		"reply not a ptr":    func(arg int, reply int) error { return nil },
+		"no error returned":  func(arg int, reply *int) {},
+		"not error returned": func(arg int, reply *int) int { return 0 },
+	}
+	for name, f := range invalid {
+		if err := CheckSignature(f); err == nil {
+			t.Errorf("CheckSignature of %s = nil, want an error", name)
+		}
+		if f == nil {
+			continue
+		}
+		if err := New().RegisterName("Invalid", f); err == nil {
+			t.Errorf("RegisterName of %s = nil, want an error like CheckSignature", name)
+		}
+	}
+}
+
+// A handler's reply is discarded along with its error, unless the error is wrapped with Partial.
+func TestPartial(t *testing.T) {
+	b, sock := newBroker(t)
+	failed := errors.New("Half done.")
+	newClient(t, sock, map[string]interface{}{
+		"Whole": func(arg int, reply *int) error { *reply = arg; return failed },
+		"Part":  func(arg int, reply *int) error { *reply = arg; return Partial(failed) },
+		"None":  func(arg int, reply *int) error { *reply = arg; return Partial(nil) },
+	})
+	waitRoute(t, b, "None")
+	c := newClient(t, sock, nil)
+
+	for _, tc := range []struct {
+		name  string
+		reply int
+		err   error
+	}{
+		{"Whole", 0, failed},
+		{"Part", 7, failed},
+		{"None", 7, nil},
+	} {
+		var reply int
+		err := c.Call(tc.name, 7, &reply)
+		if reply != tc.reply || fmt.Sprint(err) != fmt.Sprint(tc.err) {
+			t.Errorf("Call %s = %d, %v, want %d, %v", tc.name, reply, err, tc.reply, tc.err)
+		}
+	}
+}
+
+type regKV struct{ val int }
+
+func (k *regKV) Get(arg int, reply *int) error { *reply = k.val; return nil }
+
+type regCounter struct{ val int }
+
+func (c *regCounter) Get(arg int, reply *int) error { *reply = c.val; return nil }
+func (c *regCounter) Add(arg int, reply *int) error { c.val += arg; *reply = c.val; return nil }
+
+// Objects register their methods under their own base name, which doesn't carry over to objects registered after them.
+func TestRegisterObjects(t *testing.T) {
+	b, _ := newBroker(t)
+	if err := b.RegisterName("Store", &regKV{val: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Register(&regCounter{val: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Register(&regKV{val: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for name := range b.Dump().Routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	want := []string{"Store.Get", "regCounter.Add", "regCounter.Get", "regKV.Get"}
+	if len(names) != len(want) {
+		t.Fatalf("Registered %v, want %v.", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("Registered %v, want %v.", names, want)
+		}
+	}
+
+	for name, want := range map[string]int{"Store.Get": 1, "regKV.Get": 2, "regCounter.Get": 10} {
+		var reply int
+		if err := b.Call(name, 0, &reply); err != nil || reply != want {
+			t.Errorf("%s = %d, %v, want %d", name, reply, err, want)
+		}
+	}
+}
+
+// RegisterAndWait returns once the broker acknowledges the names it registered, regardless of others pending.
+func TestRegisterAndWait(t *testing.T) {
+	// Broker acknowledging only registrations of regCounter.
+	sock := rawListener(t, func(p *rawPeer) {
+		for m := p.read(t); m != nil; m = p.read(t) {
+			ack := &msg{Tag: 0}
+			switch {
+			case m.hdr(hdrHandshake) != "":
+				ack.setHdr(hdrHandshakeAck, "1")
+				declare(ack)
+			case m.Tag == 0 && strings.HasPrefix(m.Dst, "regCounter."):
+				ack.setHdr(hdrRegAck, m.Dst)
+			default:
+				continue
+			}
+			p.c.write(ack)
+		}
+	})
+
+	c := newClient(t, sock, nil)
+	if err := c.RegisterName("Stuck", func(arg int, reply *int) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RegisterAndWait(&regCounter{}, 5*time.Second); err != nil {
+		t.Errorf("RegisterAndWait with another registration pending = %v", err)
+	}
+	if err := c.RegisterAndWait(&regKV{}, 100*time.Millisecond); err != ErrTimeout {
+		t.Errorf("RegisterAndWait never acknowledged = %v, want ErrTimeout", err)
+	}
+
+	// Against a real broker, which acknowledges once it routes the names.
+	b, bsock := newBroker(t)
+	d := newClient(t, bsock, nil)
+	if err := d.RegisterAndWait(&regCounter{}, 5*time.Second); err != nil {
+		t.Fatalf("RegisterAndWait = %v", err)
+	}
+	var reply int
+	if err := b.Call("regCounter.Add", 2, &reply); err != nil || reply != 2 {
+		t.Errorf("Call once acknowledged = %d, %v", reply, err)
+	}
+}
+
+// RegisterNames serves one handler, and its state, under each name.
+func TestRegisterNames(t *testing.T) {
+	kv := &regCounter{}
+	b, sock := newBroker(t)
+	p := newRouter(t)
+	if err := p.RegisterNames(kv.Add, "Add", "KV.Add"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Dial(sock); err != nil {
+		t.Fatal(err)
+	}
+	waitRoute(t, b, "Add")
+	waitRoute(t, b, "KV.Add")
+	c := newClient(t, sock, nil)
+
+	var reply int
+	for _, name := range []string{"Add", "KV.Add"} {
+		if err := c.Call(name, 2, &reply); err != nil {
+			t.Fatalf("Call %s = %v", name, err)
+		}
+	}
+	if reply != 4 {
+		t.Errorf("Reply = %d, want 4 from a shared counter.", reply)
+	}
+
+	if err := p.RegisterNames(kv.Add); err == nil {
+		t.Error("RegisterNames without names succeeded.")
+	}
+	if err := p.RegisterNames(kv, "KV"); err == nil {
+		t.Error("RegisterNames of an object succeeded.")
+	}
+}
+
+// Unregistering withdraws a name from the broker, which keeps routing it to anyone still providing it.
+func TestUnregister(t *testing.T) {
+	b, sock := newBroker(t)
+	who := func(id string) func(arg int, reply *string) error {
+		return func(arg int, reply *string) error { *reply = id; return nil }
+	}
+	p1 := newClient(t, sock, map[string]interface{}{"Who": who("p1"), "Only": who("p1")})
+	newClient(t, sock, map[string]interface{}{"Who": who("p2")})
+	waitRoute(t, b, "Only")
+	waitFor(t, "both providers", func() bool {
+		b.connMapLock.RLock()
+		defer b.connMapLock.RUnlock()
+		return len(b.connMap["Who"]) == 2
+	})
+	c := newClient(t, sock, nil)
+
+	if err := p1.Unregister("Missing"); err == nil {
+		t.Error("Unregister of a name never registered succeeded.")
+	}
+	for _, name := range []string{"Who", "Only"} {
+		if err := p1.Unregister(name); err != nil {
+			t.Fatalf("Unregister(%s): %s", name, err)
+		}
+	}
+	if p1.CanRoute("Only") {
+		t.Error("Unregistered name still routed locally.")
+	}
+	waitFor(t, "broker to drop the route", func() bool { return !b.CanRoute("Only") })
+
+	var reply string
+	if err := c.Call("Only", 1, &reply); err != ErrFail {
+		t.Errorf("Call of a withdrawn name = %q, %v, want ErrFail", reply, err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := c.Call("Who", 1, &reply); err != nil || reply != "p2" {
+			t.Errorf("Call of a name still provided elsewhere = %q, %v, want p2", reply, err)
+		}
+	}
+}
@@ -1,13 +1,17 @@
 package ezipc
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
-	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"math/big"
+	mrand "math/rand"
 	"reflect"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,130 +29,553 @@ type bucket struct {
 	data *msg
 	dst  *connection
 	src  *connection
+	// Original request, for relays rerouted by ErrTryAgain or idempotent calls re-sent after failover.
+	req *msg
+	// Providers attempted, for relays rerouted by ErrTryAgain.
+	tried []*connection
+	// When the bucket was created.
+	created time.Time
+	// Payload bytes held for the bucket, counted toward the memory limit.
+	size int
+	// Recieves log output of the handler, for calls made with CallWithLog.
+	// Output is queued in logs, with logged signalled, to be passed to log by the caller.
+	log    func([]byte)
+	logs   [][]byte
+	logged chan struct{}
+	// Our end of a stream, for calls made with OpenStream.
+	stream *stream
+	// Cancels the context of the handler, for calls we execute.
+	cancel context.CancelFunc
 }
 
+// Maximum number of providers a relayed call is attempted on when handlers return ErrTryAgain.
+const maxTryAgain = 3
+
 var ErrFail = errors.New("Call failed.")
 var ErrClosed = errors.New("Connection closed.")
+var ErrTooLarge = errors.New("Message exceeds maximum size.")
+
+// ErrTimeout is returned when a call's deadline passes, errors.Is also matches it with context.DeadlineExceeded.
+var ErrTimeout error = timeoutError{}
+
+var ErrNotConnected = errors.New("Not connected, Dial or Listen first.")
+
+// Type of ErrTimeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string        { return "Call timed out." }
+func (timeoutError) Is(target error) bool { return target == context.DeadlineExceeded }
+
+// ErrTryAgain may be returned by a handler to have the broker reroute the call to another provider of the same name.
+var ErrTryAgain = errors.New("Provider busy, try again.")
+
+// ErrBusy is returned when the broker is relaying too many calls from this connection already.
+var ErrBusy = errors.New("Too many calls pending, try later.")
+
+// ErrUnknownConn is returned by CallTo when there is no connection with the ID given.
+var ErrUnknownConn = errors.New("No connection with that ID.")
 var errBadTag = errors.New("Duplicate tag detected.")
 
+// ErrReplyNotPointer is returned when a reply is given which is not a pointer and so could not recieve the result.
+var ErrReplyNotPointer = errors.New("Reply must be a pointer, or nil to ignore the result.")
+
+// RemoteError is an error returned by the handler of a call, as opposed to one raised in reaching it.
+// Its text is never taken for a sentinel such as ErrFail, even should it match.
+type RemoteError struct {
+	// Name of the method called, and the text of the handler's error.
+	Method string
+	Msg    string
+}
+
+func (r *RemoteError) Error() string { return r.Msg }
+
+// Errors carried over the wire by their text, decoded back to themselves so callers may compare them with errors.Is.
+var sentinels = []error{
+	ErrFail,
+	ErrTooLarge,
+	ErrTryAgain,
+	ErrBusy,
+	ErrUnknownConn,
+	ErrCodecMismatch,
+	ErrTimeout,
+	ErrClosed,
+	ErrPending,
+	ErrUnknownToken,
+	ErrJobsRefused,
+}
+
+// Determines if err is one of sentinels, rather than an error of the handler's own.
+func isSentinel(err error) bool {
+	for _, s := range sentinels {
+		if err == s {
+			return true
+		}
+	}
+	return false
+}
+
 // Call invokes a registered method/function, blocks while actively checking for for completion, returns err on failure.
+// reply must be a pointer, or nil to ignore the result.
+// Errors returned by the handler are returned as a *RemoteError, errors in reaching it as sentinels such as ErrFail or ErrClosed.
+// The value of reply is sent along with arg as a template, so the handler's reply starts pre-filled with whatever the caller set,
+// and the whole of it is sent back, so fields the handler doesn't set come back as the caller sent them.
+// Should the handler succeed with an empty reply, reply is set to its zero value.
+// arg and reply may be the same pointer: arg is encoded before the call is sent, so the handler sees its value as it was
+// when Call was made, and reply is only written once the call completes.
 func (e *EzIPC) Call(name string, arg interface{}, reply interface{}) (err error) {
-	data, err := json.Marshal(arg)
-	if err != nil {
-		return err
+	return e.CallContext(context.Background(), name, arg, reply)
+}
+
+// CallContext operates as Call, giving up once ctx is done and returning ctx.Err(), or ErrTimeout if its deadline passed,
+// which errors.Is matches with both ErrTimeout and context.DeadlineExceeded.
+// The destination is told of the cancellation so it may stop relaying the call.
+func (e *EzIPC) CallContext(ctx context.Context, name string, arg interface{}, reply interface{}) (err error) {
+	_, err = e.call(ctx, &msg{Dst: name}, arg, reply)
+	return
+}
+
+// CallTimeout operates as Call, returning ErrTimeout if no reply arrives within timeout.
+// The timeout is an absolute deadline, a slow handler still answering busyChecks is given up on once it passes.
+func (e *EzIPC) CallTimeout(name string, arg interface{}, reply interface{}, timeout time.Duration) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return e.CallContext(ctx, name, arg, reply)
+}
+
+// Go operates as Call asynchronously, returning a channel which recieves the error of the call, or nil, once complete.
+// reply is populated before the channel recieves. The channel is buffered, so the call completes and is cleaned up whether or not it is read.
+func (e *EzIPC) Go(name string, arg interface{}, reply interface{}) <-chan error {
+	done := make(chan error, 1)
+	req := &msg{Dst: name}
+	e.spawn(func() {
+		_, err := e.call(context.Background(), req, arg, reply)
+		done <- err
+	})
+	return done
+}
+
+// CallIdempotent operates as Call, for calls which are safe to repeat.
+// Should the uplink fail over while waiting, the call is re-sent over the new uplink rather than failing with ErrClosed.
+func (e *EzIPC) CallIdempotent(name string, arg interface{}, reply interface{}) (err error) {
+	_, err = e.call(context.Background(), &msg{Dst: name, idempotent: true}, arg, reply)
+	return
+}
+
+// CallTo operates as Call, sending the call directly to the connection with connID rather than routing by name.
+// Useful to probe a particular instance among many providers of name, returns ErrUnknownConn if no such connection is open.
+func (e *EzIPC) CallTo(connID, name string, arg interface{}, reply interface{}) (err error) {
+	req := &msg{Dst: name}
+	req.setHdr(hdrTo, connID)
+	_, err = e.call(context.Background(), req, arg, reply)
+	return
+}
+
+// CallWithLog operates as Call, passing log output written by handlers taking a log writer to logf as it arrives.
+// logf is called from the connection's reciever and should not block.
+func (e *EzIPC) CallWithLog(name string, arg interface{}, reply interface{}, logf func(output []byte)) (err error) {
+	_, err = e.call(context.Background(), &msg{Dst: name, log: logf}, arg, reply)
+	return
+}
+
+// CallRawReply operates as Call, also returning the encoded reply for logging or forwarding.
+func (e *EzIPC) CallRawReply(name string, arg interface{}, reply interface{}) ([]byte, error) {
+	resp, err := e.call(context.Background(), &msg{Dst: name}, arg, reply)
+	if resp == nil {
+		return nil, err
+	}
+	raw, perr := resp.payload()
+	if err == nil {
+		err = perr
+	}
+	return raw, err
+}
+
+// CallWithBlob invokes a registered blob handler, passing blob raw alongside arg and returning the handler's blob.
+// Blob handlers should look like:
+// func name(argType T1, blob []byte) ([]byte, error)
+func (e *EzIPC) CallWithBlob(name string, arg interface{}, blob []byte) ([]byte, error) {
+	if e.max_msg_size > 0 && len(blob) > e.max_msg_size {
+		return nil, ErrTooLarge
+	}
+	resp, err := e.call(context.Background(), &msg{Dst: name, Blob: blob}, arg, nil)
+	if resp == nil {
+		return nil, err
+	}
+	return resp.Blob, err
+}
+
+// Performs call of req.Dst, encoding arg and reply into req, returns the reply message once complete.
+func (e *EzIPC) call(ctx context.Context, req *msg, arg interface{}, reply interface{}) (resp *msg, err error) {
+	if reply != nil && reflect.ValueOf(reply).Kind() != reflect.Ptr {
+		return nil, ErrReplyNotPointer
 	}
 
-	data2, err := json.Marshal(reply)
+	name := req.Dst
+
+	// Both are encoded before anything is sent or decoded, so arg is captured even when reply aliases it.
+	var data []byte
+	if raw, ok := arg.(rawArg); ok {
+		data = raw
+	} else if data, err = e.codec.Marshal(arg); err != nil {
+		return nil, fmt.Errorf("Call %s: marshaling arg: %w", name, err)
+	}
+
+	data2, err := e.codec.Marshal(reply)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("Call %s: marshaling reply: %w", name, err)
 	}
 
-	dest := e.uplink
+	req.Va1 = base64.StdEncoding.EncodeToString(data)
+	req.Va2 = base64.StdEncoding.EncodeToString(data2)
+
+	atomic.AddUint64(&e.counters.calls_sent, 1)
+	start := time.Now()
+	dest := e.getUplink()
+	to := req.hdr(hdrTo)
+
+	// Apply default deadline when the call doesn't have one.
+	if _, ok := ctx.Deadline(); !ok {
+		timeout := e.call_timeout
+		if dest != nil && e.uplink_timeout > 0 {
+			timeout = e.uplink_timeout
+		}
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+	}
+
+	// Connection holding a slot for the call.
+	var slot *connection
+	defer func() {
+		if slot != nil {
+			slot.release()
+		}
+	}()
 
 new_request:
 	if dest == nil {
-		e.connMapLock.RLock()
-		dest = e.connMap[name]
-		e.connMapLock.RUnlock()
+		// Calls directed at one of our own connections need no further direction.
+		if to != "" {
+			dest = e.connByID(to, name)
+			delete(req.Hdr, hdrTo)
+		} else if dest = e.lookup(name); dest == nil {
+			dest = e.provide(name)
+		}
 	}
 
 	if dest == nil {
-		return ErrClosed
+		if atomic.LoadUint32(&e.connected) == 0 {
+			return nil, ErrNotConnected
+		}
+		if to != "" {
+			return nil, ErrUnknownConn
+		}
+		return nil, ErrClosed
 	}
 
 	// If there is already an error pending on this connection, send this back instead.
-	if dest.err != nil {
-		return dest.err
+	if err := dest.recvErr(); err != nil {
+		return nil, err
 	}
 
-	bucket, tag := e.getBucket()
-	bucket.data = nil
-	bucket.dst = dest
+	// Connections to our own peers must share our codec.
+	if dest != e.getUplink() && dest.codecName() != codecName(e.codec) {
+		return nil, ErrCodecMismatch
+	}
 
-	err = dest.send(&msg{
-		Dst: name,
-		Va1: base64.StdEncoding.EncodeToString(data),
-		Va2: base64.StdEncoding.EncodeToString(data2),
-		Tag: tag,
-	})
-	if err != nil {
-		return err
+	// Local functions are executed in the background, so the caller can give up on them as it would a remote call.
+	if dest.exec != nil {
+		atomic.AddInt64(&dest.inflight, 1)
+		req.ctx = ctx
+		done := make(chan *msg, 1)
+		e.spawn(func() {
+			defer atomic.AddInt64(&dest.inflight, -1)
+			done <- e.execute(dest, req)
+		})
+		select {
+		case resp = <-done:
+		case <-ctx.Done():
+			err = ctx.Err()
+			if err == context.DeadlineExceeded {
+				err = ErrTimeout
+			}
+			e.trace("call", name, 0, start, err.Error(), nil)
+			return nil, err
+		}
+		err = resp.decode(e.codec, reply)
+		e.logSlow("call", name, time.Since(start))
+		e.trace("call", name, 0, start, resp.Err, nil)
+		return
 	}
 
+	// Wait for a slot on the connection, so callers flooding it feel backpressure.
+	if slot != dest {
+		if slot != nil {
+			slot.release()
+			slot = nil
+		}
+		if err = dest.acquire(ctx); err != nil {
+			if err == context.DeadlineExceeded {
+				err = ErrTimeout
+			}
+			return nil, err
+		}
+		slot = dest
+	}
+
+	bucket, tag := e.getBucket(dest)
+
 	// Remove bucket from map.
 	reset_bucket := func() {
 		e.tagMapLock.Lock()
-		delete(e.tagMap, tag)
+		e.dropTag(tag)
+		e.tagMapLock.Unlock()
+	}
+
+	// Wait for the connection to have credit, so callers feel backpressure.
+	if f := dest.getFlow(); f != nil {
+		if err = f.wait(ctx); err != nil {
+			reset_bucket()
+			return nil, err
+		}
+	}
+
+	req.Tag = tag
+	e.tagMapLock.Lock()
+	if req.idempotent {
+		bucket.req = req
+	}
+	if req.log != nil {
+		bucket.log = req.log
+		bucket.logged = make(chan struct{}, 1)
+	}
+	e.tagMapLock.Unlock()
+
+	// Passes queued log output to the caller's callback.
+	flush_logs := func() {
+		e.tagMapLock.Lock()
+		logs := bucket.logs
+		bucket.logs = nil
 		e.tagMapLock.Unlock()
+		for _, l := range logs {
+			req.log(l)
+		}
+	}
+	err = dest.send(req)
+	if err != nil {
+		reset_bucket()
+		return nil, err
 	}
 
+	var pings int
+
 	for {
 		select {
 		// Once request is met, provide result and/or error to Caller.
 		case <-bucket.done:
-			if len(bucket.data.Va2) > 0 && reflect.ValueOf(reply).Kind() == reflect.Ptr {
-
-				var va2 []byte
-				va2, err = base64.StdEncoding.DecodeString(bucket.data.Va2)
-				if err != nil {
-					return
-				}
-
-				err = json.Unmarshal(va2, reply)
-				if err != nil && err != io.EOF {
-					return
-				}
+			resp = bucket.data
+			reset_bucket()
+			if req.log != nil {
+				flush_logs()
 			}
-
-			switch bucket.data.Err {
-			case errBadTag.Error():
-				reset_bucket()
+			if resp.Err == errBadTag.Error() {
 				goto new_request
-			case ErrFail.Error():
-				err = ErrFail
-			default:
-				if bucket.data.Err != "" {
-					err = errors.New(bucket.data.Err)
-				}
 			}
-			reset_bucket()
+			err = resp.decode(e.codec, reply)
+			e.logSlow("call", name, time.Since(start))
+			e.trace("call", name, tag, start, resp.Err, nil)
 			return
 
+		// Handler sent log output.
+		case <-bucket.logged:
+			flush_logs()
+
+		// Caller gave up waiting.
+		case <-ctx.Done():
+			reset_bucket()
+			e.tagMapLock.Lock()
+			dest = bucket.dst
+			e.tagMapLock.Unlock()
+			if dest != nil {
+				cancel := &msg{Dst: name, Tag: tag * -1}
+				cancel.setHdr(hdrCancel, "1")
+				dest.send(cancel)
+			}
+			err = ctx.Err()
+			if err == context.DeadlineExceeded {
+				err = ErrTimeout
+			}
+			e.trace("call", name, tag, start, err.Error(), nil)
+			return nil, err
+
 		// Send busyCheck to see if we should continue waiting on reply.
-		case <-time.After(time.Millisecond * 300):
+		case <-time.After(busyInterval()):
+			// Bucket may have been handed off to a new uplink.
+			e.tagMapLock.Lock()
+			dest = bucket.dst
+			e.tagMapLock.Unlock()
 			if dest == nil {
-				return ErrClosed
+				return nil, ErrClosed
 			}
+			// Past the limit, stop pinging and simply wait on the reply.
+			if e.max_busy_checks > 0 && pings >= e.max_busy_checks {
+				continue
+			}
+			pings++
 			err = dest.send(&msg{
 				Dst: name,
 				Tag: tag * -1,
 			})
 			if err != nil {
-				return err
+				return nil, err
 			}
 			continue
 		}
 	}
+}
+
+// Returns the base64 decoded reply, decoding it only once.
+func (m *msg) payload() (va2 []byte, err error) {
+	if m.va2 == nil && len(m.Va2) > 0 {
+		m.va2, err = base64.StdEncoding.DecodeString(m.Va2)
+	}
+	return m.va2, err
+}
+
+// Decodes reply message into reply, returning the error carried by the message.
+// A successful reply with no payload sets reply to its zero value.
+func (m *msg) decode(codec Codec, reply interface{}) (err error) {
+	if rv := reflect.ValueOf(reply); rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		if len(m.Va2) > 0 {
+			var va2 []byte
+			va2, err = m.payload()
+			if err != nil {
+				return
+			}
+
+			err = codec.Unmarshal(va2, reply)
+			if err != nil && err != io.EOF {
+				return
+			}
+		} else if m.Err == "" {
+			rv.Elem().Set(reflect.Zero(rv.Elem().Type()))
+		}
+	}
+
+	if m.hdr(hdrInvalid) != "" && m.Err != "" {
+		return &ValidationError{Msg: m.Err}
+	}
+
+	if m.hdr(hdrPanic) != "" && m.Err != "" {
+		return &PanicError{Msg: m.Err}
+	}
+
+	if status := m.hdr(hdrStatus); status != "" && m.Err != "" {
+		code, _ := strconv.Atoi(status)
+		return &StatusError{Code: code, Msg: m.Err}
+	}
+
+	if m.Err == "" {
+		return nil
+	}
+
+	if m.hdr(hdrRemote) != "" {
+		method := m.Dst
+		if name := m.hdr(hdrMethod); name != "" {
+			method = name
+		}
+		return &RemoteError{Method: method, Msg: m.Err}
+	}
+
+	for _, s := range sentinels {
+		if m.Err == s.Error() {
+			return s
+		}
+	}
+	return errors.New(m.Err)
+}
+
+// PurgeStaleBuckets removes relays which have been waiting on a reply for longer than olderThan, returning how many were removed.
+// The caller of each purged relay is sent ErrTimeout.
+func (e *EzIPC) PurgeStaleBuckets(olderThan time.Duration) (n int) {
+	e.tagMapLock.Lock()
+	defer e.tagMapLock.Unlock()
+
+	for tag, b := range e.tagMap {
+		if b.flag != t_RELAY || time.Since(b.created) < olderThan {
+			continue
+		}
+		e.dropTag(tag)
+		b.src.relays--
+		e.useMem(-b.size)
+		n++
+
+		stale := &msg{Tag: tag, conn: b.src}
+		if b.req != nil {
+			stale.Dst = b.req.Dst
+		}
+		send_err(stale, ErrTimeout)
+	}
+	if n > 0 {
+		e.logf("Purged %d stale relays.", n)
+	}
 	return
 }
 
-// Assigned Call a bucket to capture reply with.
-func (e *EzIPC) getBucket() (*bucket, int32) {
+// Base interval between busyChecks.
+const busyCheck = time.Millisecond * 300
+
+// Returns busyCheck interval with up to 25% jitter either way, so concurrent calls don't ping in lockstep.
+func busyInterval() time.Duration {
+	return busyCheck - busyCheck/4 + time.Duration(mrand.Int63n(int64(busyCheck/2)))
+}
+
+// TagSource selects how tags identifying calls are generated.
+type TagSource int
+
+const (
+	// Tags from crypto/rand, unpredictable to peers. This is the default.
+	TagsRandom TagSource = iota
+	// Tags from a counter starting at a random base, cheaper at high call rates.
+	TagsCounter
+)
 
-	// Creates a random 32bit tag for IPC calls.
-	genTag := func() int32 {
-		maxBig := *big.NewInt(int64(1<<31 - 1))
-		output, _ := rand.Int(rand.Reader, &maxBig)
-		return int32(output.Int64())
+// SetTagSource sets how tags identifying calls are generated.
+func (e *EzIPC) SetTagSource(s TagSource) {
+	e.tagMapLock.Lock()
+	defer e.tagMapLock.Unlock()
+	e.tag_source = s
+	if s == TagsCounter && e.tag_counter == 0 {
+		e.tag_counter = uint32(genTag())
 	}
+}
 
-	// Generates a random number to serve as the ticket for this Call.
-	tag := genTag()
+// Creates a random 31bit tag for IPC calls.
+func genTag() int32 {
+	maxBig := *big.NewInt(int64(1<<31 - 1))
+	output, _ := rand.Int(rand.Reader, &maxBig)
+	return int32(output.Int64())
+}
 
+// Assigned Call a bucket to capture reply with.
+func (e *EzIPC) getBucket(dst *connection) (*bucket, int32) {
 	e.tagMapLock.Lock()
 	defer e.tagMapLock.Unlock()
+
+	// Generates a number to serve as the ticket for this Call.
+	var tag int32
+	if e.tag_source == TagsCounter {
+		e.tag_counter++
+		tag = int32(e.tag_counter & (1<<31 - 1))
+	} else {
+		tag = genTag()
+	}
+
 	for {
-		if _, ok := e.tagMap[tag]; ok {
+		// Tag 0 is reserved for registrations, notifyTag for notifications and probeTag for the probe following handshakes.
+		if _, ok := e.tagMap[tag]; ok || tag == 0 || tag == notifyTag || tag == probeTag {
 			if tag < int32(1<<31-1) {
 				tag++
 				continue
@@ -158,12 +585,26 @@ func (e *EzIPC) getBucket() (*bucket, int32) {
 			}
 		} else {
 			newBucket := &bucket{
-				flag: t_REQUEST,
-				data: nil,
-				done: make(chan struct{}),
+				flag:    t_REQUEST,
+				data:    nil,
+				done:    make(chan struct{}, 1),
+				dst:     dst,
+				created: time.Now(),
 			}
-			e.tagMap[tag] = newBucket
+			e.setTag(tag, newBucket)
 			return newBucket, tag
 		}
 	}
 }
+
+// Stores bucket b under tag, called with tagMapLock held.
+func (e *EzIPC) setTag(tag int32, b *bucket) {
+	e.tagMap[tag] = b
+	atomic.StoreInt64(&e.counters.pending_tags, int64(len(e.tagMap)))
+}
+
+// Removes the bucket of tag, called with tagMapLock held.
+func (e *EzIPC) dropTag(tag int32) {
+	delete(e.tagMap, tag)
+	atomic.StoreInt64(&e.counters.pending_tags, int64(len(e.tagMap)))
+}
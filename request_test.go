@@ -0,0 +1,761 @@
+package ezipc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Blobs over the broker's limit are refused before reaching the handler, leaving nothing pending.
+func TestBlobTooLarge(t *testing.T) {
+	b := newRouter(t)
+	b.SetMaxMessageSize(16)
+	sock := listen(t, b, tempSocket(t))
+	var calls int32
+	newClient(t, sock, map[string]interface{}{
+		"Store": func(arg int, blob []byte) ([]byte, error) {
+			atomic.AddInt32(&calls, 1)
+			return blob, nil
+		},
+	})
+	waitRoute(t, b, "Store")
+	c := newClient(t, sock, nil)
+
+	if _, err := c.CallWithBlob("Store", 1, make([]byte, 17)); err == nil || err.Error() != ErrTooLarge.Error() {
+		t.Errorf("CallWithBlob over the broker's limit = %v, want ErrTooLarge.", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Errorf("Oversized blob relayed to the handler %d times.", n)
+	}
+	if n := b.Stats().PendingTags; n != 0 {
+		t.Errorf("%d tags left pending on the broker.", n)
+	}
+	if out, err := c.CallWithBlob("Store", 1, make([]byte, 16)); err != nil || len(out) != 16 {
+		t.Errorf("CallWithBlob at the broker's limit = %d bytes, %v", len(out), err)
+	}
+}
+
+// Calls go to the most recent provider of a name, moving on to the others while providers return ErrTryAgain.
+func TestTryAgain(t *testing.T) {
+	b, sock := newBroker(t)
+	var first, second int32
+	newClient(t, sock, map[string]interface{}{
+		"Work": func(arg int, reply *int) error { atomic.AddInt32(&first, 1); *reply = 1; return nil },
+	})
+	waitRoute(t, b, "Work")
+	newClient(t, sock, map[string]interface{}{
+		"Work": func(arg int, reply *int) error { atomic.AddInt32(&second, 1); return ErrTryAgain },
+	})
+	waitFor(t, "second provider", func() bool {
+		b.connMapLock.RLock()
+		defer b.connMapLock.RUnlock()
+		return len(b.connMap["Work"]) == 2
+	})
+	c := newClient(t, sock, nil)
+
+	var reply int
+	if err := c.Call("Work", 0, &reply); err != nil || reply != 1 {
+		t.Errorf("Call with the preferred provider busy = %d, %v, want 1 from the other provider", reply, err)
+	}
+	if atomic.LoadInt32(&second) != 1 || atomic.LoadInt32(&first) != 1 {
+		t.Errorf("Providers called %d and %d times, want once each.", second, first)
+	}
+
+	// With no other provider to move on to, the caller recieves ErrTryAgain.
+	b, sock = newBroker(t)
+	newClient(t, sock, map[string]interface{}{
+		"Work": func(arg int, reply *int) error { return ErrTryAgain },
+	})
+	waitRoute(t, b, "Work")
+	if err := newClient(t, sock, nil).Call("Work", 0, &reply); err != ErrTryAgain {
+		t.Errorf("Call with every provider busy = %v, want ErrTryAgain", err)
+	}
+}
+
+// busyCheck intervals stay within 25% of the base interval.
+func TestBusyInterval(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		if d := busyInterval(); d < busyCheck*3/4 || d >= busyCheck*5/4 {
+			t.Fatalf("busyInterval = %s, want within 25%% of %s", d, busyCheck)
+		}
+	}
+}
+
+// A Call stops pinging its provider once SetMaxBusyChecks is reached, still waiting on the reply.
+func TestMaxBusyChecks(t *testing.T) {
+	b, sock := newBroker(t)
+
+	// Provider counting the busyChecks relayed to it, replying well after several would have been sent.
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "0\x1fSlow\x1f\x1f\x1f\x04")
+	var pings int32
+	go func() {
+		r := bufio.NewReader(conn)
+		for {
+			frame, err := r.ReadString('\x04')
+			if err != nil {
+				return
+			}
+			part := strings.Split(frame, "\x1f")
+			tag, _ := strconv.Atoi(part[0])
+			if tag < 0 {
+				atomic.AddInt32(&pings, 1)
+			} else if tag > 0 {
+				go func() {
+					time.Sleep(1500 * time.Millisecond)
+					fmt.Fprintf(conn, "%d\x1fSlow\x1fdone\x1f\x1f\x04", tag)
+				}()
+			}
+		}
+	}()
+
+	waitRoute(t, b, "Slow")
+	c := newClient(t, sock, nil)
+	c.SetMaxBusyChecks(2)
+	var reply int
+	if err := c.Call("Slow", 0, &reply); err == nil || err.Error() != "done" {
+		t.Errorf("Call = %v, want the provider's reply", err)
+	}
+	if n := atomic.LoadInt32(&pings); n != 2 {
+		t.Errorf("Provider saw %d busyChecks, want 2", n)
+	}
+}
+
+// Calling before Dial or Listen reports ErrNotConnected rather than a closed connection.
+func TestNotConnected(t *testing.T) {
+	e := newRouter(t)
+	var reply int
+	if err := e.Call("Echo", 1, &reply); err != ErrNotConnected {
+		t.Errorf("Call before Dial = %v, want ErrNotConnected", err)
+	}
+
+	b, _ := newBroker(t)
+	waitFor(t, "listener", func() bool { return atomic.LoadUint32(&b.connected) == 1 })
+	if err := b.Call("Echo", 1, &reply); err != ErrClosed {
+		t.Errorf("Call of an unprovided name once listening = %v, want ErrClosed", err)
+	}
+}
+
+// Relays waiting too long on their provider are purged, their callers recieving ErrTimeout.
+func TestPurgeStaleBuckets(t *testing.T) {
+	b, sock := newBroker(t)
+	hang := make(chan struct{})
+	defer close(hang)
+	newClient(t, sock, map[string]interface{}{
+		"Hang": func(arg int, reply *int) error { <-hang; return nil },
+	})
+	waitRoute(t, b, "Hang")
+	c := newClient(t, sock, nil)
+
+	done := make(chan error, 1)
+	go func() {
+		var reply int
+		done <- c.Call("Hang", 0, &reply)
+	}()
+	waitFor(t, "relay", func() bool {
+		b.tagMapLock.Lock()
+		defer b.tagMapLock.Unlock()
+		return len(b.tagMap) == 1
+	})
+	if n := b.PurgeStaleBuckets(time.Hour); n != 0 {
+		t.Errorf("PurgeStaleBuckets purged %d fresh relays", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := b.PurgeStaleBuckets(50 * time.Millisecond); n != 1 {
+		t.Errorf("PurgeStaleBuckets = %d, want 1", n)
+	}
+	select {
+	case err := <-done:
+		if err != ErrTimeout {
+			t.Errorf("Call of a purged relay = %v, want ErrTimeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Caller of a purged relay still waiting.")
+	}
+}
+
+// CallRawReply returns the reply as encoded by the provider, alongside decoding it.
+func TestCallRawReply(t *testing.T) {
+	b, sock := newBroker(t)
+	newClient(t, sock, map[string]interface{}{
+		"Pair": func(arg int, reply *[]int) error { *reply = []int{arg, arg * 2}; return nil },
+	})
+	waitRoute(t, b, "Pair")
+	c := newClient(t, sock, nil)
+
+	var reply []int
+	raw, err := c.CallRawReply("Pair", 2, &reply)
+	if err != nil || string(raw) != "[2,4]" || len(reply) != 2 || reply[1] != 4 {
+		t.Errorf("CallRawReply = %s, %v, %v", raw, reply, err)
+	}
+	if _, err := c.CallRawReply("Nobody", 2, &reply); err != ErrFail {
+		t.Errorf("CallRawReply of an unprovided name = %v, want ErrFail", err)
+	}
+}
+
+// Calls of local handlers time out and are cancelled as remote ones are, cancelling the handler's context as they give up.
+func TestLocalCallContext(t *testing.T) {
+	e := newRouter(t)
+	gave_up := make(chan struct{}, 3)
+	e.RegisterName("Block", func(ctx context.Context, arg int, reply *int) error {
+		<-ctx.Done()
+		gave_up <- struct{}{}
+		return ctx.Err()
+	})
+	given_up := func(how string) {
+		select {
+		case <-gave_up:
+		case <-time.After(5 * time.Second):
+			t.Errorf("Handler's context not cancelled after %s.", how)
+		}
+	}
+
+	var reply int
+	if err := e.CallTimeout("Block", 1, &reply, 20*time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Errorf("CallTimeout of local handler = %v, want ErrTimeout", err)
+	}
+	given_up("CallTimeout")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if err := e.CallContext(ctx, "Block", 1, &reply); err != context.Canceled {
+		t.Errorf("CallContext of local handler cancelled = %v, want context.Canceled", err)
+	}
+	given_up("CallContext")
+
+	e.SetCallTimeout(20 * time.Millisecond)
+	if err := e.Call("Block", 1, &reply); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Call of local handler past the default deadline = %v, want ErrTimeout", err)
+	}
+	given_up("the default deadline")
+}
+
+type Pair struct {
+	A, B int
+}
+
+// Dials a client to a new broker serving funcs from another client, for calls relayed between them.
+func relayedClient(t *testing.T, funcs map[string]interface{}, opts ...Option) *EzIPC {
+	b, sock := newBroker(t, opts...)
+	newClient(t, sock, funcs, opts...)
+	for name := range funcs {
+		waitRoute(t, b, name)
+	}
+	return newClient(t, sock, nil, opts...)
+}
+
+// With arg and reply the same pointer, the handler sees arg as it was when Call was made, and the reply then replaces it.
+func TestCallAliasedReply(t *testing.T) {
+	var seen Pair
+	c := relayedClient(t, map[string]interface{}{
+		"Swap": func(arg Pair, reply *Pair) error {
+			seen = arg
+			reply.A, reply.B = arg.B, arg.A
+			return nil
+		},
+	})
+
+	v := Pair{A: 1, B: 2}
+	if err := c.Call("Swap", &v, &v); err != nil {
+		t.Fatal(err)
+	}
+	if seen != (Pair{A: 1, B: 2}) {
+		t.Errorf("Handler saw arg %+v, want {A:1 B:2}.", seen)
+	}
+	if v != (Pair{A: 2, B: 1}) {
+		t.Errorf("Aliased reply = %+v, want {A:2 B:1}.", v)
+	}
+}
+
+// The caller's reply is a template, the handler sees it pre-filled and fields it doesn't set come back as sent.
+func TestCallReplyTemplate(t *testing.T) {
+	var seen Pair
+	c := relayedClient(t, map[string]interface{}{
+		"SetB": func(arg int, reply *Pair) error {
+			seen = *reply
+			reply.B = arg
+			return nil
+		},
+	})
+
+	reply := Pair{A: 1, B: 2}
+	if err := c.Call("SetB", 3, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if seen != (Pair{A: 1, B: 2}) {
+		t.Errorf("Handler's reply started as %+v, want the caller's {A:1 B:2}.", seen)
+	}
+	if reply != (Pair{A: 1, B: 3}) {
+		t.Errorf("Reply = %+v, want {A:1 B:3}.", reply)
+	}
+}
+
+// Replies which aren't pointers are refused before anything is sent, nil replies are allowed.
+func TestReplyNotPointer(t *testing.T) {
+	var calls int32
+	c := relayedClient(t, map[string]interface{}{
+		"Count": func(arg int, reply *int) error { atomic.AddInt32(&calls, 1); return nil },
+	})
+	var reply int
+	if err := c.Call("Count", 1, reply); err != ErrReplyNotPointer {
+		t.Errorf("Call with a non-pointer reply = %v, want ErrReplyNotPointer", err)
+	}
+	if err := c.Call("Count", 1, nil); err != nil {
+		t.Errorf("Call with a nil reply = %v", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("Handler called %d times, want once.", n)
+	}
+}
+
+// Counter tags follow on from each other, skipping tags in use and reserved tags as they wrap.
+func TestTagsCounter(t *testing.T) {
+	e := newRouter(t)
+	e.SetTagSource(TagsCounter)
+	e.tagMapLock.Lock()
+	e.tag_counter = 1<<31 - 5
+	e.tagMap[1<<31-3] = &bucket{}
+	e.tagMapLock.Unlock()
+
+	var tags []int32
+	for i := 0; i < 3; i++ {
+		_, tag := e.getBucket(nil)
+		tags = append(tags, tag)
+	}
+	if tags[0] != 1<<31-4 || tags[1] != 1 || tags[2] != 2 {
+		t.Errorf("Counter tags = %v, want [%d 1 2].", tags, 1<<31-4)
+	}
+}
+
+var tagSources = []struct {
+	name   string
+	source TagSource
+}{
+	{"random", TagsRandom},
+	{"counter", TagsCounter},
+}
+
+// Measures allocating and releasing a call's tag with each tag source.
+func BenchmarkGetBucket(b *testing.B) {
+	for _, ts := range tagSources {
+		b.Run(ts.name, func(b *testing.B) {
+			e := New()
+			e.SetTagSource(ts.source)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, tag := e.getBucket(nil)
+				e.tagMapLock.Lock()
+				e.dropTag(tag)
+				e.tagMapLock.Unlock()
+			}
+		})
+	}
+}
+
+// Measures calls relayed through a broker with each tag source, from concurrent callers.
+func BenchmarkCall(b *testing.B) {
+	for _, ts := range tagSources {
+		b.Run(ts.name, func(b *testing.B) {
+			br, sock := newBroker(b)
+			newClient(b, sock, map[string]interface{}{
+				"Echo": func(arg int, reply *int) error { *reply = arg; return nil },
+			})
+			waitRoute(b, br, "Echo")
+			c := newClient(b, sock, nil)
+			c.SetTagSource(ts.source)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				var reply int
+				for pb.Next() {
+					if err := c.Call("Echo", 1, &reply); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// Failing to marshal a call names the method and which of arg or reply failed, wrapping the codec's error.
+func TestCallMarshalError(t *testing.T) {
+	c := relayedClient(t, map[string]interface{}{
+		"Echo": func(arg int, reply *int) error { *reply = arg; return nil },
+	})
+	var reply int
+	err := c.Call("Echo", make(chan int), &reply)
+	var jsonErr *json.UnsupportedTypeError
+	if err == nil || !strings.HasPrefix(err.Error(), "Call Echo: marshaling arg:") || !errors.As(err, &jsonErr) {
+		t.Errorf("Call with an unmarshalable arg = %v", err)
+	}
+	bad := func() {}
+	err = c.Call("Echo", 1, &bad)
+	if err == nil || !strings.HasPrefix(err.Error(), "Call Echo: marshaling reply:") || !errors.As(err, &jsonErr) {
+		t.Errorf("Call with an unmarshalable reply = %v", err)
+	}
+}
+
+// Relays past the per connection limit fail with ErrBusy, without holding up other connections.
+func TestMaxRelaysPerConn(t *testing.T) {
+	release := make(chan struct{})
+	b, sock := newBroker(t)
+	b.SetMaxRelaysPerConn(1)
+	newClient(t, sock, map[string]interface{}{
+		"Slow": func(arg int, reply *int) error { <-release; *reply = arg; return nil },
+	})
+	waitRoute(t, b, "Slow")
+	c := newClient(t, sock, nil)
+
+	done := make(chan error, 2)
+	go func() {
+		var reply int
+		done <- c.Call("Slow", 1, &reply)
+	}()
+	waitFor(t, "relayed call", func() bool { return len(b.Dump().Buckets) == 1 })
+	var reply int
+	if err := c.Call("Slow", 2, &reply); err != ErrBusy {
+		t.Errorf("Call past the limit = %v, want ErrBusy", err)
+	}
+	other := newClient(t, sock, nil)
+	go func() {
+		var reply int
+		done <- other.Call("Slow", 3, &reply)
+	}()
+	waitFor(t, "call from another connection", func() bool { return len(b.Dump().Buckets) == 2 })
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+	for _, conn := range b.Dump().Conns {
+		if conn.Relays != 0 {
+			t.Errorf("Connection %s left with %d relays.", conn.ID, conn.Relays)
+		}
+	}
+}
+
+// CallTo reaches the connection given among several providers, and fails with ErrUnknownConn for IDs not open.
+func TestCallTo(t *testing.T) {
+	b, c := dupProviders(t, RouteMulti, "a", "b")
+	first := b.Dump().Routes["policySvc.Who"][0]
+	for i := 0; i < 2; i++ {
+		var reply string
+		if err := c.CallTo(first, "policySvc.Who", 0, &reply); err != nil || reply != "a" {
+			t.Errorf("CallTo first provider = %q, %v", reply, err)
+		}
+	}
+	var reply string
+	if err := c.CallTo("nonesuch", "policySvc.Who", 0, &reply); err != ErrUnknownConn {
+		t.Errorf("CallTo unknown connection = %v, want ErrUnknownConn", err)
+	}
+}
+
+// Calls time out by the global default, unless their connection sets its own deadline.
+func TestCallTimeoutDefaults(t *testing.T) {
+	b, sock := newBroker(t)
+	newClient(t, sock, map[string]interface{}{
+		"Slow": func(arg int, reply *int) error { time.Sleep(300 * time.Millisecond); return nil },
+	})
+	waitRoute(t, b, "Slow")
+
+	c := newRouter(t)
+	c.SetCallTimeout(50 * time.Millisecond)
+	if err := c.Dial(sock); err != nil {
+		t.Fatal(err)
+	}
+	var reply int
+	if err := c.Call("Slow", 1, &reply); err != ErrTimeout {
+		t.Errorf("Call past the global deadline = %v, want ErrTimeout", err)
+	}
+
+	c = newRouter(t)
+	c.SetCallTimeout(50 * time.Millisecond)
+	if err := c.DialWithCallTimeout(sock, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Call("Slow", 1, &reply); err != nil {
+		t.Errorf("Call within the connection's deadline = %v", err)
+	}
+}
+
+// Encodes with JSON, sending zero values as no data.
+type zeroOmitCodec struct{ jsonCodec }
+
+func (zeroOmitCodec) Name() string { return "zero-omit" }
+
+func (z zeroOmitCodec) Marshal(v interface{}) ([]byte, error) {
+	if rv := reflect.Indirect(reflect.ValueOf(v)); !rv.IsValid() || rv.IsZero() {
+		return nil, nil
+	}
+	return z.jsonCodec.Marshal(v)
+}
+
+func (z zeroOmitCodec) Unmarshal(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return z.jsonCodec.Unmarshal(data, v)
+}
+
+// A handler succeeding with an empty reply sets the caller's reply to its zero value, rather than leaving it as it was.
+// Failing with an empty reply leaves it as it was.
+func TestCallEmptyReply(t *testing.T) {
+	b, sock := newBroker(t)
+	newClient(t, sock, map[string]interface{}{
+		"Clear": func(arg int, reply *Pair) error {
+			*reply = Pair{}
+			return nil
+		},
+		"Fail": func(arg int, reply *Pair) error {
+			*reply = Pair{}
+			return errors.New("failed")
+		},
+	}, WithCodec(zeroOmitCodec{}))
+	waitRoute(t, b, "Clear")
+	waitRoute(t, b, "Fail")
+	c := newClient(t, sock, nil, WithCodec(zeroOmitCodec{}))
+
+	reply := Pair{A: 1, B: 2}
+	if err := c.Call("Clear", 1, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != (Pair{}) {
+		t.Errorf("Reply after empty reply = %+v, want zero value.", reply)
+	}
+
+	reply = Pair{A: 1, B: 2}
+	if err := c.Call("Fail", 1, &reply); err == nil {
+		t.Fatal("Call of failing handler succeeded.")
+	}
+	if reply != (Pair{A: 1, B: 2}) {
+		t.Errorf("Reply after failure = %+v, want it untouched.", reply)
+	}
+}
+
+// A call whose context expires returns an error matching both ErrTimeout and context.DeadlineExceeded,
+// a cancelled call returns context.Canceled, and neither leaves its bucket behind with the caller or the broker.
+func TestCallContextErrors(t *testing.T) {
+	b, sock := newBroker(t)
+	release := make(chan struct{})
+	defer close(release)
+	newClient(t, sock, map[string]interface{}{
+		"Block": func(arg int, reply *int) error { <-release; return nil },
+	})
+	waitRoute(t, b, "Block")
+	c := newClient(t, sock, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var reply int
+	err := c.CallContext(ctx, "Block", 1, &reply)
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, ErrTimeout) {
+		t.Errorf("CallContext past deadline = %v, want ErrTimeout matching context.DeadlineExceeded", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if err = c.CallContext(ctx, "Block", 1, &reply); err != context.Canceled {
+		t.Errorf("CallContext cancelled = %v, want context.Canceled", err)
+	}
+
+	if n := len(c.Dump().Buckets); n != 0 {
+		t.Errorf("%d calls left pending after they gave up.", n)
+	}
+	waitFor(t, "broker to drop cancelled relays", func() bool { return len(b.Dump().Buckets) == 0 })
+}
+
+// Log output of handlers taking a log writer reaches CallWithLog callers in order, before the call returns.
+func TestCallWithLog(t *testing.T) {
+	steps := func(arg int, reply *int, log io.Writer) error {
+		for i := 1; i <= arg; i++ {
+			fmt.Fprintf(log, "step %d", i)
+		}
+		*reply = arg
+		return nil
+	}
+	b, sock := newBroker(t)
+	b.RegisterName("Local", steps)
+	newClient(t, sock, map[string]interface{}{"Steps": steps})
+	waitRoute(t, b, "Steps")
+	c := newClient(t, sock, nil)
+
+	for _, call := range []struct {
+		e    *EzIPC
+		name string
+	}{{c, "Steps"}, {b, "Local"}} {
+		var logged []string
+		var reply int
+		err := call.e.CallWithLog(call.name, 3, &reply, func(output []byte) { logged = append(logged, string(output)) })
+		if err != nil || reply != 3 {
+			t.Errorf("CallWithLog %s = %d, %v", call.name, reply, err)
+		}
+		if strings.Join(logged, ",") != "step 1,step 2,step 3" {
+			t.Errorf("CallWithLog %s logged %q", call.name, logged)
+		}
+	}
+
+	var reply int
+	if err := c.Call("Steps", 2, &reply); err != nil || reply != 2 {
+		t.Errorf("Call without a log callback = %d, %v", reply, err)
+	}
+}
+
+// Go runs calls concurrently, each reporting on its own channel once its reply is populated.
+func TestGo(t *testing.T) {
+	b, sock := newBroker(t)
+	release := make(chan struct{})
+	newClient(t, sock, map[string]interface{}{
+		"Double": func(arg int, reply *int) error { <-release; *reply = arg * 2; return nil },
+	})
+	waitRoute(t, b, "Double")
+	c := newClient(t, sock, nil)
+
+	replies := make([]int, 3)
+	var done []<-chan error
+	for i := range replies {
+		done = append(done, c.Go("Double", i+1, &replies[i]))
+	}
+	select {
+	case err := <-done[0]:
+		t.Fatalf("Go completed before its handler returned: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	for i, ch := range done {
+		if err := <-ch; err != nil || replies[i] != (i+1)*2 {
+			t.Errorf("Go(Double, %d) = %d, %v", i+1, replies[i], err)
+		}
+	}
+
+	// Nobody reading the channel doesn't leave the call pending.
+	c.Go("Missing", 1, nil)
+	waitFor(t, "unread call to complete", func() bool { return len(c.Dump().Buckets) == 0 })
+	if err := <-c.Go("Missing", 1, nil); err != ErrFail {
+		t.Errorf("Go of an unregistered name = %v, want ErrFail", err)
+	}
+}
+
+// Handlers taking a context see it cancelled once the caller gives up, or the connection it was called over closes.
+func TestHandlerContext(t *testing.T) {
+	b, sock := newBroker(t)
+	gave_up := make(chan error, 1)
+	newClient(t, sock, map[string]interface{}{
+		"Block": func(ctx context.Context, arg int, reply *int) error {
+			<-ctx.Done()
+			gave_up <- ctx.Err()
+			return ctx.Err()
+		},
+	})
+	waitRoute(t, b, "Block")
+	given_up := func(how string) {
+		select {
+		case err := <-gave_up:
+			if err != context.Canceled {
+				t.Errorf("Handler's context after %s = %v, want context.Canceled", how, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("Handler's context not cancelled after %s.", how)
+		}
+	}
+
+	c := newClient(t, sock, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	var reply int
+	if err := c.CallContext(ctx, "Block", 1, &reply); err != context.Canceled {
+		t.Errorf("CallContext cancelled = %v, want context.Canceled", err)
+	}
+	given_up("the caller cancelled")
+
+	// Local calls pass the caller's context straight through.
+	b.RegisterName("Local", func(ctx context.Context, arg int, reply *int) error {
+		*reply, _ = ctx.Value(ctxKey{}).(int)
+		return nil
+	})
+	if err := b.CallContext(context.WithValue(context.Background(), ctxKey{}, 7), "Local", 1, &reply); err != nil || reply != 7 {
+		t.Errorf("Local handler's context value = %d, %v, want 7", reply, err)
+	}
+
+	go c.Call("Block", 1, &reply)
+	waitFor(t, "call to be relayed", func() bool { return len(b.Dump().Buckets) == 1 })
+	b.Close()
+	given_up("the broker closed")
+}
+
+type ctxKey struct{}
+
+// Calls waiting on a connection fail with ErrClosed as soon as it closes, whether made directly or relayed through a broker.
+func TestCloseFailsPending(t *testing.T) {
+	b, sock := newBroker(t)
+	release := make(chan struct{})
+	defer close(release)
+	p := newClient(t, sock, map[string]interface{}{
+		"Block": func(arg int, reply *int) error { <-release; return nil },
+	})
+	waitRoute(t, b, "Block")
+	c := newClient(t, sock, nil)
+
+	errs := make(chan error, 2)
+	for _, caller := range []*EzIPC{b, c} {
+		go func(caller *EzIPC) {
+			var reply int
+			errs <- caller.Call("Block", 1, &reply)
+		}(caller)
+	}
+	waitFor(t, "calls to be sent", func() bool { return len(b.Dump().Buckets) == 2 })
+	p.getUplink().conn.Close()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, ErrClosed) {
+				t.Errorf("Call to a closed connection = %v, want ErrClosed", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Call still waiting after its connection closed.")
+		}
+	}
+	if n := len(b.Dump().Buckets); n != 0 {
+		t.Errorf("Broker holds %d buckets after the connection closed.", n)
+	}
+}
+
+// Errors of the handler's own arrive as RemoteError, even worded as a sentinel, while sentinels it returns stay sentinels.
+func TestRemoteError(t *testing.T) {
+	b, sock := newBroker(t)
+	newClient(t, sock, map[string]interface{}{
+		"Mimic": func(arg int, reply *int) error { return errors.New(ErrFail.Error()) },
+		"Busy":  func(arg int, reply *int) error { return ErrBusy },
+	})
+	waitRoute(t, b, "Mimic")
+	waitRoute(t, b, "Busy")
+	c := newClient(t, sock, nil)
+
+	var reply int
+	err := c.Call("Mimic", 1, &reply)
+	var re *RemoteError
+	if !errors.As(err, &re) || re.Method != "Mimic" || re.Msg != ErrFail.Error() || errors.Is(err, ErrFail) {
+		t.Errorf("Call of handler worded as ErrFail = %#v, want RemoteError", err)
+	}
+	if err := c.Call("Busy", 1, &reply); err != ErrBusy {
+		t.Errorf("Call of handler returning ErrBusy = %#v, want ErrBusy", err)
+	}
+}
@@ -0,0 +1,210 @@
+package ezipc
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScatterResult is the reply of a single provider to a Scatter.
+type ScatterResult struct {
+	// ID of the connection providing the reply.
+	Source string
+	// Reply of the provider, encoded with the router's codec.
+	Reply []byte
+	// Error returned by the provider, ErrTimeout if the provider did not reply in time.
+	Err error
+}
+
+// SetScatterTimeout sets how long Scatter waits on providers before giving up on them, 0 waits indefinitely.
+func (e *EzIPC) SetScatterTimeout(d time.Duration) {
+	e.scatter_timeout = d
+}
+
+// Scatter calls name on every connection providing it, the returned channel recieves each reply as it arrives.
+// The channel is closed once all providers have replied or timed out.
+func (e *EzIPC) Scatter(name string, arg interface{}) (<-chan ScatterResult, error) {
+	results, _, err := e.ScatterWithCancel(name, arg)
+	return results, err
+}
+
+// ScatterWithCancel operates as Scatter, but also returns a cancel function to stop waiting on remaining providers.
+// Once cancelled no further results are delivered, the channel is closed and late replies are dropped.
+func (e *EzIPC) ScatterWithCancel(name string, arg interface{}) (<-chan ScatterResult, context.CancelFunc, error) {
+	var ids []string
+	if err := e.Call("ezipc.Providers", name, &ids); err != nil {
+		return nil, nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil, ErrFail
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+
+	ctx, done := cancelled, context.CancelFunc(func() {})
+	if e.scatter_timeout > 0 {
+		ctx, done = context.WithTimeout(cancelled, e.scatter_timeout)
+	}
+
+	results := make(chan ScatterResult, len(ids))
+
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			req := &msg{Dst: name}
+			req.setHdr(hdrTo, id)
+			resp, err := e.call(ctx, req, arg, nil)
+			if cancelled.Err() != nil {
+				return
+			}
+			result := ScatterResult{Source: id, Err: err}
+			if resp != nil {
+				result.Reply, _ = resp.payload()
+			}
+			results <- result
+		}(id)
+	}
+
+	go func() {
+		wg.Wait()
+		done()
+		cancel()
+		close(results)
+	}()
+
+	return results, cancel, nil
+}
+
+// ScatterError reports the providers which failed during ScatterReduce.
+type ScatterError struct {
+	// Errors by ID of the connection providing the reply.
+	Errs map[string]error
+}
+
+func (s *ScatterError) Error() string {
+	ids := make([]string, 0, len(s.Errs))
+	for id := range s.Errs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	msgs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", id, s.Errs[id]))
+	}
+	return fmt.Sprintf("Scatter failed on %d providers: %s", len(ids), strings.Join(msgs, ", "))
+}
+
+// ScatterReduce calls name on every connection providing it, combining replies with reduce as they arrive.
+// acc is nil for the first reply. Providers which fail or time out are left out of the result and reported in a *ScatterError,
+// returned alongside the result of the providers which succeeded.
+func (e *EzIPC) ScatterReduce(name string, arg interface{}, reduce func(acc, item []byte) []byte) ([]byte, error) {
+	results, err := e.Scatter(name, arg)
+	if err != nil {
+		return nil, err
+	}
+
+	var acc []byte
+	var failed *ScatterError
+	for r := range results {
+		if r.Err != nil {
+			if failed == nil {
+				failed = &ScatterError{Errs: make(map[string]error)}
+			}
+			failed.Errs[r.Source] = r.Err
+			continue
+		}
+		acc = reduce(acc, r.Reply)
+	}
+	if failed != nil {
+		return acc, failed
+	}
+	return acc, nil
+}
+
+// Broadcast calls name on every connection providing it, returning once all have replied or timed out.
+// Replies are discarded, providers which fail are reported in a *ScatterError. Call still routes to a single provider.
+func (e *EzIPC) Broadcast(name string, arg interface{}) error {
+	results, err := e.Scatter(name, arg)
+	if err != nil {
+		return err
+	}
+
+	var failed *ScatterError
+	for r := range results {
+		if r.Err == nil {
+			continue
+		}
+		if failed == nil {
+			failed = &ScatterError{Errs: make(map[string]error)}
+		}
+		failed.Errs[r.Source] = r.Err
+	}
+	if failed != nil {
+		return failed
+	}
+	return nil
+}
+
+// CanRoute reports if name is registered with us, by a local function or a connection, without calling it.
+// Clients only know of their own functions, use CanRouteRemote to ask the broker.
+func (e *EzIPC) CanRoute(name string) bool {
+	return e.lookup(name) != nil
+}
+
+// CanRouteRemote asks our uplink if any connection has registered name with it, without calling it.
+// Without an uplink it operates as CanRoute.
+func (e *EzIPC) CanRouteRemote(name string) (bool, error) {
+	if e.getUplink() == nil {
+		return e.CanRoute(name), nil
+	}
+	var ids []string
+	if err := e.Call("ezipc.Providers", name, &ids); err != nil {
+		return false, err
+	}
+	return len(ids) > 0, nil
+}
+
+// ListMethods returns the names registered by this router's own functions, sorted.
+func (e *EzIPC) ListMethods() (names []string) {
+	e.connMapLock.RLock()
+	defer e.connMapLock.RUnlock()
+
+	for name, conns := range e.connMap {
+		for _, c := range conns {
+			if c.exec != nil {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// ListRoutes returns every name registered with us, by our own functions or by connections, sorted.
+func (e *EzIPC) ListRoutes() (names []string) {
+	e.connMapLock.RLock()
+	defer e.connMapLock.RUnlock()
+
+	for name := range e.connMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// Lists IDs of connections providing name.
+func (e *EzIPC) providers(name string, ids *[]string) error {
+	e.connMapLock.RLock()
+	defer e.connMapLock.RUnlock()
+
+	for _, c := range e.connMap[name] {
+		*ids = append(*ids, c.id)
+	}
+	return nil
+}
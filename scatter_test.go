@@ -0,0 +1,239 @@
+package ezipc
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Scatter collects a reply from every provider of a name, giving up on those that don't reply in time.
+func TestScatter(t *testing.T) {
+	b, sock := newBroker(t)
+	for _, who := range []string{"a", "b"} {
+		who := who
+		newClient(t, sock, map[string]interface{}{
+			"Who": func(arg int, reply *string) error { *reply = who; return nil },
+		})
+	}
+	hang := make(chan struct{})
+	defer close(hang)
+	newClient(t, sock, map[string]interface{}{
+		"Who": func(arg int, reply *string) error { <-hang; return nil },
+	})
+	waitFor(t, "providers", func() bool {
+		b.connMapLock.RLock()
+		defer b.connMapLock.RUnlock()
+		return len(b.connMap["Who"]) == 3
+	})
+
+	c := newClient(t, sock, nil)
+	c.SetScatterTimeout(500 * time.Millisecond)
+	results, err := c.Scatter("Who", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	var timeouts int
+	sources := make(map[string]bool)
+	for r := range results {
+		sources[r.Source] = true
+		if r.Err == ErrTimeout {
+			timeouts++
+			continue
+		}
+		if r.Err != nil {
+			t.Errorf("Provider %s: %s", r.Source, r.Err)
+			continue
+		}
+		var who string
+		if err := json.Unmarshal(r.Reply, &who); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, who)
+	}
+	sort.Strings(got)
+	if len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("Scatter replies = %v, want [a b]", got)
+	}
+	if timeouts != 1 {
+		t.Errorf("%d providers timed out, want 1", timeouts)
+	}
+	if len(sources) != 3 {
+		t.Errorf("Replies from %d distinct sources, want 3", len(sources))
+	}
+
+	if _, err := c.Scatter("Nobody", 0); err != ErrFail {
+		t.Errorf("Scatter of an unprovided name = %v, want ErrFail", err)
+	}
+}
+
+// Cancelling a scatter closes its channel without waiting on the remaining providers.
+func TestScatterWithCancel(t *testing.T) {
+	b, sock := newBroker(t)
+	newClient(t, sock, map[string]interface{}{
+		"Who": func(arg int, reply *string) error { *reply = "fast"; return nil },
+	})
+	hang := make(chan struct{})
+	defer close(hang)
+	newClient(t, sock, map[string]interface{}{
+		"Who": func(arg int, reply *string) error { <-hang; return nil },
+	})
+	waitFor(t, "providers", func() bool {
+		b.connMapLock.RLock()
+		defer b.connMapLock.RUnlock()
+		return len(b.connMap["Who"]) == 2
+	})
+
+	c := newClient(t, sock, nil)
+	results, cancel, err := c.ScatterWithCancel("Who", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := <-results; r.Err != nil || string(r.Reply) != `"fast"` {
+		t.Errorf("First result = %s, %v, want the fast provider", r.Reply, r.Err)
+	}
+	cancel()
+	select {
+	case r, ok := <-results:
+		if ok {
+			t.Errorf("Result from %s delivered after cancel", r.Source)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Channel not closed after cancel.")
+	}
+}
+
+// ScatterReduce combines the replies of the providers which succeed, and reports those which fail by connection.
+func TestScatterReduce(t *testing.T) {
+	b, sock := newBroker(t)
+	for _, n := range []int{1, 2} {
+		n := n
+		newClient(t, sock, map[string]interface{}{
+			"Count": func(arg int, reply *int) error { *reply = n * arg; return nil },
+		})
+	}
+	newClient(t, sock, map[string]interface{}{
+		"Count": func(arg int, reply *int) error { return errors.New("Broken provider.") },
+	})
+	waitFor(t, "providers", func() bool {
+		b.connMapLock.RLock()
+		defer b.connMapLock.RUnlock()
+		return len(b.connMap["Count"]) == 3
+	})
+
+	c := newClient(t, sock, nil)
+	sum, err := c.ScatterReduce("Count", 10, func(acc, item []byte) []byte {
+		var a, i int
+		if acc != nil {
+			json.Unmarshal(acc, &a)
+		}
+		json.Unmarshal(item, &i)
+		out, _ := json.Marshal(a + i)
+		return out
+	})
+	var failed *ScatterError
+	if !errors.As(err, &failed) {
+		t.Fatalf("ScatterReduce error = %v, want a *ScatterError", err)
+	}
+	if len(failed.Errs) != 1 {
+		t.Errorf("%d providers reported failing, want 1: %s", len(failed.Errs), failed)
+	}
+	for _, err := range failed.Errs {
+		if err.Error() != "Broken provider." {
+			t.Errorf("Provider error = %q, want the handler's error", err)
+		}
+	}
+	if string(sum) != "30" {
+		t.Errorf("ScatterReduce result = %s, want 30", sum)
+	}
+
+	if _, err := c.ScatterReduce("Nobody", 0, nil); err != ErrFail {
+		t.Errorf("ScatterReduce of an unprovided name = %v, want ErrFail", err)
+	}
+}
+
+// Broadcast calls every provider of a name, reporting those that fail by source.
+func TestBroadcast(t *testing.T) {
+	b, sock := newBroker(t)
+	got := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		newClient(t, sock, map[string]interface{}{
+			"Notice": func(arg int, reply *int) error { got <- arg; return nil },
+		})
+	}
+	waitFor(t, "providers", func() bool {
+		b.connMapLock.RLock()
+		defer b.connMapLock.RUnlock()
+		return len(b.connMap["Notice"]) == 2
+	})
+	c := newClient(t, sock, nil)
+
+	if err := c.Broadcast("Notice", 7); err != nil {
+		t.Fatalf("Broadcast = %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if arg := <-got; arg != 7 {
+			t.Errorf("Provider recieved %d, want 7", arg)
+		}
+	}
+
+	newClient(t, sock, map[string]interface{}{
+		"Notice": func(arg int, reply *int) error { return errors.New("Refused.") },
+	})
+	waitFor(t, "failing provider", func() bool {
+		b.connMapLock.RLock()
+		defer b.connMapLock.RUnlock()
+		return len(b.connMap["Notice"]) == 3
+	})
+	err := c.Broadcast("Notice", 8)
+	var se *ScatterError
+	if !errors.As(err, &se) || len(se.Errs) != 1 {
+		t.Errorf("Broadcast with a failing provider = %v, want ScatterError of one", err)
+	}
+	if err := c.Broadcast("Nobody", 0); err != ErrFail {
+		t.Errorf("Broadcast of an unprovided name = %v, want ErrFail", err)
+	}
+}
+
+// CanRoute answers from what a router knows itself, CanRouteRemote asks its broker.
+func TestCanRoute(t *testing.T) {
+	b, sock := newBroker(t)
+	newClient(t, sock, map[string]interface{}{"Remote": func(arg int, reply *int) error { return nil }})
+	waitRoute(t, b, "Remote")
+	c := newClient(t, sock, map[string]interface{}{"Local": func(arg int, reply *int) error { return nil }})
+
+	if !c.CanRoute("Local") || c.CanRoute("Remote") {
+		t.Errorf("CanRoute on the client = Local %v, Remote %v, want only Local.", c.CanRoute("Local"), c.CanRoute("Remote"))
+	}
+	if ok, err := c.CanRouteRemote("Remote"); err != nil || !ok {
+		t.Errorf("CanRouteRemote(Remote) = %v, %v", ok, err)
+	}
+	if ok, err := c.CanRouteRemote("Missing"); err != nil || ok {
+		t.Errorf("CanRouteRemote(Missing) = %v, %v", ok, err)
+	}
+	if ok, err := b.CanRouteRemote("Remote"); err != nil || !ok {
+		t.Errorf("CanRouteRemote on the broker = %v, %v", ok, err)
+	}
+}
+
+// ListMethods names a router's own functions, ListRoutes everything it can route.
+func TestListMethods(t *testing.T) {
+	b, sock := newBroker(t)
+	b.RegisterName("Local", func(arg int, reply *int) error { return nil })
+	newClient(t, sock, map[string]interface{}{
+		"B": func(arg int, reply *int) error { return nil },
+		"A": func(arg int, reply *int) error { return nil },
+	})
+	waitRoute(t, b, "A")
+	waitRoute(t, b, "B")
+
+	if names := b.ListMethods(); !reflect.DeepEqual(names, []string{"Local"}) {
+		t.Errorf("ListMethods = %v, want [Local]", names)
+	}
+	if names := b.ListRoutes(); !reflect.DeepEqual(names, []string{"A", "B", "Local"}) {
+		t.Errorf("ListRoutes = %v, want [A B Local]", names)
+	}
+}
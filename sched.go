@@ -0,0 +1,12 @@
+//go:build !ezipc_testing
+// +build !ezipc_testing
+
+package ezipc
+
+// Scheduler state, only used by builds tagged ezipc_testing.
+type scheduler struct{}
+
+// Runs f in the background.
+func (e *EzIPC) spawn(f func()) {
+	go f()
+}
@@ -0,0 +1,113 @@
+//go:build ezipc_testing
+// +build ezipc_testing
+
+package ezipc
+
+import (
+	"testing"
+	"time"
+)
+
+// Runs work spawned by e on goroutines of its own as it is queued, until the test ends,
+// for tests which need handlers running freely rather than stepped.
+func freeRun(t testing.TB, e *EzIPC) {
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	wake := e.sched.wake()
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-wake:
+				for f := e.sched.next(); f != nil; f = e.sched.next() {
+					go f()
+				}
+			}
+		}
+	}()
+}
+
+// Returns the number of pieces of work queued on e.
+func queued(e *EzIPC) int {
+	e.sched.lock.Lock()
+	defer e.sched.lock.Unlock()
+	return len(e.sched.queue)
+}
+
+// A handler runs only when its router is stepped, and the call completes once it has.
+func TestStep(t *testing.T) {
+	b, sock := newBroker(t)
+	p := New()
+	var ran int
+	p.RegisterName("Echo", func(arg int, reply *int) error { ran++; *reply = arg; return nil })
+	if err := p.Dial(sock); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	waitRoute(t, b, "Echo")
+	c := newClient(t, sock, nil)
+
+	var reply int
+	done := make(chan error, 1)
+	go func() { done <- c.Call("Echo", 7, &reply) }()
+	waitFor(t, "call to be queued", func() bool { return queued(p) == 1 })
+
+	select {
+	case err := <-done:
+		t.Fatalf("Call completed before the handler was stepped: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if ran != 0 {
+		t.Fatalf("Handler ran %d times before being stepped.", ran)
+	}
+
+	if !p.Step() {
+		t.Fatal("Step found nothing queued.")
+	}
+	if ran != 1 {
+		t.Errorf("Handler ran %d times after one step, want 1.", ran)
+	}
+	if err := <-done; err != nil || reply != 7 {
+		t.Errorf("Call after step = %d, %v", reply, err)
+	}
+	if p.Step() {
+		t.Error("Step ran work with nothing queued.")
+	}
+}
+
+// RunPending runs every handler queued on the calling goroutine.
+func TestRunPending(t *testing.T) {
+	b, sock := newBroker(t)
+	p := New()
+	var order []int
+	p.RegisterName("Record", func(arg int, reply *int) error { order = append(order, arg); return nil })
+	if err := p.Dial(sock); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	waitRoute(t, b, "Record")
+	c := newClient(t, sock, nil)
+
+	for i := 0; i < 5; i++ {
+		if err := c.Notify("Record", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "notifications to be queued", func() bool { return queued(p) == 5 })
+
+	if n := p.RunPending(); n != 5 {
+		t.Errorf("RunPending ran %d, want 5.", n)
+	}
+	for i, v := range order {
+		if v != i {
+			t.Fatalf("Handlers ran in order %v, want ascending.", order)
+		}
+	}
+	if len(order) != 5 {
+		t.Errorf("Handlers ran %d times, want 5.", len(order))
+	}
+	if n := p.RunPending(); n != 0 {
+		t.Errorf("RunPending with nothing queued ran %d.", n)
+	}
+}
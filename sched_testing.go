@@ -0,0 +1,72 @@
+//go:build ezipc_testing
+// +build ezipc_testing
+
+package ezipc
+
+import (
+	"sync"
+)
+
+// Scheduler holding work spawned by the router until a test runs it.
+type scheduler struct {
+	lock  sync.Mutex
+	queue []func()
+	// Signalled as work is queued.
+	ready chan struct{}
+}
+
+// Returns the channel signalled as work is queued.
+func (s *scheduler) wake() <-chan struct{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.ready == nil {
+		s.ready = make(chan struct{}, 1)
+	}
+	return s.ready
+}
+
+// Removes and returns the next piece of work queued, nil if nothing is queued.
+func (s *scheduler) next() func() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.queue) == 0 {
+		return nil
+	}
+	f := s.queue[0]
+	s.queue[0] = nil
+	s.queue = s.queue[1:]
+	return f
+}
+
+// Queues f to be run by Step or RunPending.
+func (e *EzIPC) spawn(f func()) {
+	s := &e.sched
+	s.lock.Lock()
+	s.queue = append(s.queue, f)
+	if s.ready != nil {
+		select {
+		case s.ready <- struct{}{}:
+		default:
+		}
+	}
+	s.lock.Unlock()
+}
+
+// Step runs the next piece of work spawned by the router on the calling goroutine, returns false if nothing is queued.
+// Only available in builds tagged ezipc_testing, where handler execution is deferred until stepped.
+func (e *EzIPC) Step() bool {
+	f := e.sched.next()
+	if f == nil {
+		return false
+	}
+	f()
+	return true
+}
+
+// RunPending steps until nothing is queued, returning how many pieces of work were run.
+func (e *EzIPC) RunPending() (n int) {
+	for e.Step() {
+		n++
+	}
+	return
+}
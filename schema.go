@@ -0,0 +1,141 @@
+package ezipc
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// Schema returns a JSON schema describing the argument and reply of name, as registered by its provider.
+// Unless set explicitly by SetSchema, the schema is derived from the Go types of the registered function.
+func (e *EzIPC) Schema(name string) ([]byte, error) {
+	var ids []string
+	if err := e.Call("ezipc.Providers", name, &ids); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, ErrFail
+	}
+
+	var schema string
+	req := &msg{Dst: "ezipc.Schema"}
+	req.setHdr(hdrTo, ids[len(ids)-1])
+	if _, err := e.call(context.Background(), req, name, &schema); err != nil {
+		return nil, err
+	}
+	return []byte(schema), nil
+}
+
+// SetSchema replaces the schema reported for the locally registered name.
+func (e *EzIPC) SetSchema(name string, schema []byte) error {
+	e.connMapLock.Lock()
+	defer e.connMapLock.Unlock()
+
+	for _, c := range e.connMap[name] {
+		if c.exec != nil {
+			c.schema = schema
+			return nil
+		}
+	}
+	return ErrFail
+}
+
+// Returns schema of locally registered name.
+func (e *EzIPC) schema(name string, schema *string) error {
+	e.connMapLock.RLock()
+	defer e.connMapLock.RUnlock()
+
+	for _, c := range e.connMap[name] {
+		if c.exec != nil {
+			*schema = string(c.schema)
+			return nil
+		}
+	}
+	return ErrFail
+}
+
+// Derives schema of registered function.
+func deriveSchema(fn reflect.Type) []byte {
+	if isStreamFunc(fn) {
+		return schemaOf(nil, nil, map[string]interface{}{"stream": true})
+	}
+	if isBlobFunc(fn) {
+		return schemaOf(fn.In(0), nil, map[string]interface{}{"blob": true})
+	}
+	if isLogFunc(fn) {
+		return schemaOf(fn.In(0), fn.In(1).Elem(), map[string]interface{}{"log": true})
+	}
+	arg, reply := argTypes(fn)
+	return schemaOf(arg, reply.Elem(), nil)
+}
+
+// Generates schema document describing arg and reply types.
+func schemaOf(arg, reply reflect.Type, extra map[string]interface{}) []byte {
+	doc := make(map[string]interface{})
+	if arg != nil {
+		doc["arg"] = typeSchema(arg, make(map[reflect.Type]bool))
+	}
+	if reply != nil {
+		doc["reply"] = typeSchema(reply, make(map[reflect.Type]bool))
+	}
+	for k, v := range extra {
+		doc[k] = v
+	}
+	out, _ := json.Marshal(doc)
+	return out
+}
+
+// Best effort JSON schema of t, as encoded by encoding/json.
+func typeSchema(t reflect.Type, seen map[reflect.Type]bool) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem(), seen)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem(), seen)}
+	case reflect.Struct:
+		// Recursive types are described once.
+		if seen[t] {
+			return map[string]interface{}{"type": "object"}
+		}
+		seen[t] = true
+		defer delete(seen, t)
+
+		props := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			name := f.Name
+			if tag := f.Tag.Get("json"); tag != "" {
+				if tag == "-" {
+					continue
+				}
+				if n := strings.Split(tag, ",")[0]; n != "" {
+					name = n
+				}
+			}
+			props[name] = typeSchema(f.Type, seen)
+		}
+		return map[string]interface{}{"type": "object", "title": t.Name(), "properties": props}
+	default:
+		return map[string]interface{}{}
+	}
+}
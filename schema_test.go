@@ -0,0 +1,62 @@
+package ezipc
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+type SchemaQuery struct {
+	Name  string `json:"name"`
+	Limit int
+	Skip  bool `json:"-"`
+	next  *SchemaQuery
+}
+
+type SchemaResult struct {
+	Items []string
+	Raw   []byte
+	Child *SchemaResult
+}
+
+// Schema describes a remote function from the Go types it was registered with, or as replaced by SetSchema.
+func TestSchema(t *testing.T) {
+	b, sock := newBroker(t)
+	p := newClient(t, sock, map[string]interface{}{
+		"Lookup": func(arg SchemaQuery, reply *SchemaResult) error { return nil },
+		"Other":  func(arg int, reply *bool) error { return nil },
+	})
+	waitRoute(t, b, "Other")
+	c := newClient(t, sock, nil)
+
+	out, err := c.Schema("Lookup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got, want interface{}
+	json.Unmarshal(out, &got)
+	json.Unmarshal([]byte(`{
+		"arg": {"type": "object", "title": "SchemaQuery", "properties": {
+			"name": {"type": "string"},
+			"Limit": {"type": "integer"}}},
+		"reply": {"type": "object", "title": "SchemaResult", "properties": {
+			"Items": {"type": "array", "items": {"type": "string"}},
+			"Raw": {"type": "string", "contentEncoding": "base64"},
+			"Child": {"type": "object"}}}}`), &want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Schema = %s", out)
+	}
+
+	if err := p.SetSchema("Other", []byte(`{"custom":true}`)); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := c.Schema("Other"); err != nil || string(out) != `{"custom":true}` {
+		t.Errorf("Schema after SetSchema = %s, %v", out, err)
+	}
+	if err := p.SetSchema("Nobody", nil); err != ErrFail {
+		t.Errorf("SetSchema of an unregistered name = %v, want ErrFail", err)
+	}
+	if _, err := c.Schema("Nobody"); err != ErrFail {
+		t.Errorf("Schema of an unprovided name = %v, want ErrFail", err)
+	}
+}
@@ -0,0 +1,75 @@
+package ezipc
+
+import (
+	"sync/atomic"
+)
+
+// Stats holds runtime counters of an EzIPC router.
+type Stats struct {
+	// Frames recieved which could not be decoded.
+	DecodeErrors uint64
+	// Connections closed due to read errors.
+	ConnResets uint64
+	// Frames which failed to send.
+	SendErrors uint64
+	// Accepts delayed by the connect rate.
+	ThrottledConns uint64
+	// Connections refused from peers in cooldown.
+	RefusedConns uint64
+	// Bytes of pending payloads and buffered frames, counted toward the memory limit.
+	MemoryUsed int64
+	// Calls we are waiting on replies to, limited per connection by WithMaxInflight.
+	InflightCalls int64
+	// Open connections to peers.
+	Connections int64
+	// Methods registered on this router.
+	LocalMethods int64
+	// Method names with at least one route.
+	Routes int64
+	// Tags awaiting a reply, for calls, relays and executions.
+	PendingTags int64
+	// Calls made by this router.
+	CallsSent uint64
+	// Calls executed by local handlers.
+	CallsRecieved uint64
+	// Calls, executions and relays which ended in an error.
+	Errors uint64
+}
+
+// Counters maintained atomically by the router.
+type counters struct {
+	decode_errors   uint64
+	conn_resets     uint64
+	send_errors     uint64
+	throttled_conns uint64
+	refused_conns   uint64
+	mem_used        int64
+	inflight_calls  int64
+	connections     int64
+	local_methods   int64
+	routes          int64
+	pending_tags    int64
+	calls_sent      uint64
+	calls_recieved  uint64
+	errors          uint64
+}
+
+// Stats returns a snapshot of the router's counters.
+func (e *EzIPC) Stats() Stats {
+	return Stats{
+		DecodeErrors:   atomic.LoadUint64(&e.counters.decode_errors),
+		ConnResets:     atomic.LoadUint64(&e.counters.conn_resets),
+		SendErrors:     atomic.LoadUint64(&e.counters.send_errors),
+		ThrottledConns: atomic.LoadUint64(&e.counters.throttled_conns),
+		RefusedConns:   atomic.LoadUint64(&e.counters.refused_conns),
+		MemoryUsed:     atomic.LoadInt64(&e.counters.mem_used),
+		InflightCalls:  atomic.LoadInt64(&e.counters.inflight_calls),
+		Connections:    atomic.LoadInt64(&e.counters.connections),
+		LocalMethods:   atomic.LoadInt64(&e.counters.local_methods),
+		Routes:         atomic.LoadInt64(&e.counters.routes),
+		PendingTags:    atomic.LoadInt64(&e.counters.pending_tags),
+		CallsSent:      atomic.LoadUint64(&e.counters.calls_sent),
+		CallsRecieved:  atomic.LoadUint64(&e.counters.calls_recieved),
+		Errors:         atomic.LoadUint64(&e.counters.errors),
+	}
+}
@@ -0,0 +1,62 @@
+package ezipc
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// A frame that can't be decoded is counted, and its connection dropped.
+func TestStatsDecodeErrors(t *testing.T) {
+	b, sock := newBroker(t)
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("garbage\x04")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "decode error", func() bool { return b.Stats().DecodeErrors == 1 })
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Connection left open after a corrupt frame.")
+	}
+	if s := b.Stats(); s.ConnResets != 0 || s.SendErrors != 0 {
+		t.Errorf("Stats = %+v, want only the decode error", s)
+	}
+}
+
+// Stats counts connections, methods, routes and calls as they come and go.
+func TestStatsCounters(t *testing.T) {
+	b, sock := newBroker(t)
+	p := newClient(t, sock, map[string]interface{}{
+		"Echo": func(arg int, reply *int) error { *reply = arg; return nil },
+		"Fail": func(arg int, reply *int) error { return errors.New("Failed.") },
+	})
+	waitRoute(t, b, "Echo")
+	waitRoute(t, b, "Fail")
+	c := newClient(t, sock, nil)
+
+	var reply int
+	for i := 0; i < 3; i++ {
+		if err := c.Call("Echo", i, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Call("Fail", 1, &reply); err == nil {
+		t.Fatal("Call of Fail succeeded.")
+	}
+
+	if s := b.Stats(); s.Connections != 2 || s.Routes != 2 || s.LocalMethods != 0 || s.PendingTags != 0 {
+		t.Errorf("Broker Stats = %+v, want 2 connections and routes, no local methods or pending tags", s)
+	}
+	if s := p.Stats(); s.LocalMethods != 2 || s.CallsRecieved != 4 || s.Errors != 1 {
+		t.Errorf("Provider Stats = %+v, want 2 local methods, 4 calls recieved and 1 error", s)
+	}
+	if s := c.Stats(); s.CallsSent != 4 || s.Errors != 1 || s.Connections != 1 {
+		t.Errorf("Client Stats = %+v, want 4 calls sent, 1 error and 1 connection", s)
+	}
+
+	p.Close()
+	waitFor(t, "provider's routes to go", func() bool { s := b.Stats(); return s.Routes == 0 && s.Connections == 1 })
+}
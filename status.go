@@ -0,0 +1,66 @@
+package ezipc
+
+import (
+	"errors"
+	"strconv"
+)
+
+// StatusError is an error carrying an HTTP style status code, returned by handlers and recieved by callers.
+type StatusError struct {
+	Code int
+	Msg  string
+}
+
+// NewStatusError creates a StatusError with code and message.
+func NewStatusError(code int, msg string) *StatusError {
+	return &StatusError{Code: code, Msg: msg}
+}
+
+func (e *StatusError) Error() string { return e.Msg }
+
+// Status returns the status code of the error.
+func (e *StatusError) Status() int { return e.Code }
+
+// StatusCode maps the result of a call to an HTTP style status code.
+// Errors without an explicit status map to a generic code for their kind, nil maps to 200.
+func StatusCode(err error) int {
+	var se *StatusError
+	switch {
+	case err == nil:
+		return 200
+	case errors.As(err, &se):
+		return se.Code
+	case errors.Is(err, ErrValidation):
+		return 400
+	case errors.Is(err, ErrFail):
+		return 404
+	case errors.Is(err, ErrTooLarge):
+		return 413
+	case errors.Is(err, ErrTryAgain), errors.Is(err, ErrClosed), errors.Is(err, ErrNotConnected):
+		return 503
+	case errors.Is(err, ErrTimeout):
+		return 504
+	default:
+		return 500
+	}
+}
+
+// Sets error returned by handler on req, carrying its status code if it has one.
+// Errors other than sentinels the handler returned as is are marked as the handler's own.
+func setErr(req *msg, err error) {
+	req.Err = err.Error()
+	var se *StatusError
+	var ve *ValidationError
+	var re *RemoteError
+	switch {
+	case errors.As(err, &se):
+		req.setHdr(hdrStatus, strconv.Itoa(se.Code))
+	case errors.As(err, &ve):
+		req.setHdr(hdrInvalid, "1")
+	case errors.As(err, &re) && re.Method != "":
+		req.setHdr(hdrRemote, "1")
+		req.setHdr(hdrMethod, re.Method)
+	case !isSentinel(err):
+		req.setHdr(hdrRemote, "1")
+	}
+}
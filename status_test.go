@@ -0,0 +1,53 @@
+package ezipc
+
+import (
+	"errors"
+	"testing"
+)
+
+// StatusErrors returned by handlers reach the caller with their code, other errors map to a code for their kind.
+func TestStatusError(t *testing.T) {
+	b, sock := newBroker(t)
+	newClient(t, sock, map[string]interface{}{
+		"Forbidden": func(arg int, reply *int) error { return NewStatusError(403, "Not yours.") },
+		"Partial":   func(arg int, reply *int) error { *reply = arg; return Partial(NewStatusError(206, "Some.")) },
+		"Plain":     func(arg int, reply *int) error { return errors.New("Broken.") },
+	})
+	waitRoute(t, b, "Plain")
+	c := newClient(t, sock, nil)
+
+	var reply int
+	err := c.Call("Forbidden", 1, &reply)
+	var se *StatusError
+	if !errors.As(err, &se) || se.Status() != 403 || se.Error() != "Not yours." {
+		t.Errorf("Call returning a StatusError = %#v", err)
+	}
+	if err := c.Call("Partial", 1, &reply); StatusCode(err) != 206 || reply != 1 {
+		t.Errorf("Call returning a partial StatusError = %d, %v", reply, err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		code int
+	}{
+		{"Plain", 500},
+		{"Nobody", 404},
+	} {
+		if code := StatusCode(c.Call(tc.name, 1, &reply)); code != tc.code {
+			t.Errorf("StatusCode of Call %s = %d, want %d", tc.name, code, tc.code)
+		}
+	}
+
+	for err, code := range map[error]int{
+		nil:             200,
+		ErrTooLarge:     413,
+		ErrTryAgain:     503,
+		ErrClosed:       503,
+		ErrNotConnected: 503,
+		ErrTimeout:      504,
+	} {
+		if got := StatusCode(err); got != code {
+			t.Errorf("StatusCode(%v) = %d, want %d", err, got, code)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package ezipc
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// Chunks a stream is written in, and chunks either end may have sent before the other has read them.
+const (
+	streamChunk  = 32 << 10
+	streamWindow = 16
+)
+
+// Kinds of stream frames, carried in hdrStream.
+const (
+	streamOpen = "open"
+	streamData = "data"
+	streamAck  = "ack"
+	streamEOF  = "eof"
+)
+
+// ErrStreamOverflow ends a stream whose other end sent more chunks than it was granted credit for.
+var ErrStreamOverflow = errors.New("Stream exceeded its window of unread chunks.")
+
+var readWriteCloserType = reflect.TypeOf((*io.ReadWriteCloser)(nil)).Elem()
+
+// Determines if fn is a stream handler: func(stream io.ReadWriteCloser) error.
+func isStreamFunc(fn reflect.Type) bool {
+	return fn.Kind() == reflect.Func && fn.NumIn() == 1 && fn.In(0) == readWriteCloserType &&
+		fn.NumOut() == 1 && fn.Out(0) == errorType
+}
+
+// One end of a stream between a caller and a stream handler.
+//
+// Either end may have at most streamWindow chunks unread by the other, further writes block until
+// the other end reads, so a slow reader holds back the writer rather than buffering without bound.
+// Close on the handler's end, or the handler returning, ends what the caller reads with io.EOF.
+// Close on the caller's end ends what the handler reads with io.EOF, then waits on the handler to return,
+// returning its error. Data written by the handler after the caller closed is discarded.
+type stream struct {
+	lock sync.Mutex
+	cond *sync.Cond
+	// Chunks recieved and not yet read, and whether the other end has closed.
+	in     [][]byte
+	in_eof bool
+	// Chunks we may send before the other end reads more.
+	credits int
+	// Set once we have closed, or the call has completed with err.
+	closed bool
+	done   bool
+	err    error
+	// Closed once the call has completed, on the caller's end.
+	finished chan struct{}
+	// Sends a frame of kind to the other end.
+	send func(kind string, data []byte) error
+}
+
+// Creates end of a stream, sending frames to the other end with send.
+func newStream(send func(kind string, data []byte) error) *stream {
+	s := &stream{
+		credits:  streamWindow,
+		finished: make(chan struct{}),
+		send:     send,
+	}
+	s.cond = sync.NewCond(&s.lock)
+	return s
+}
+
+// Handles a frame from the other end, must not block as it is called with router locks held.
+func (s *stream) recv(kind string, data []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch kind {
+	case streamData:
+		switch {
+		case s.closed:
+			if !s.done {
+				// Discarded, so credit the other end right away, off the router's locks.
+				go s.send(streamAck, nil)
+			}
+		case len(s.in) >= streamWindow:
+			// The other end ignored our window, end the stream rather than buffer without bound.
+			s.in = nil
+			if !s.done {
+				s.done, s.err = true, ErrStreamOverflow
+				close(s.finished)
+				go s.send(streamEOF, nil)
+			}
+		default:
+			s.in = append(s.in, data)
+		}
+	case streamAck:
+		s.credits++
+	case streamEOF:
+		s.in_eof = true
+	}
+	s.cond.Broadcast()
+}
+
+// Marks the call complete with err, waking readers and writers.
+func (s *stream) finish(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.done {
+		return
+	}
+	s.done, s.err = true, err
+	close(s.finished)
+	s.cond.Broadcast()
+}
+
+func (s *stream) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	s.lock.Lock()
+	for len(s.in) == 0 && !s.in_eof && !s.done && !s.closed {
+		s.cond.Wait()
+	}
+	if len(s.in) == 0 {
+		defer s.lock.Unlock()
+		switch {
+		case s.closed:
+			return 0, io.ErrClosedPipe
+		case s.done && s.err != nil:
+			return 0, s.err
+		}
+		return 0, io.EOF
+	}
+	n = copy(p, s.in[0])
+	s.in[0] = s.in[0][n:]
+	read := len(s.in[0]) == 0
+	if read {
+		s.in = s.in[1:]
+	}
+	done := s.done
+	s.lock.Unlock()
+
+	// Grant the other end credit for the chunk we have read.
+	if read && !done {
+		s.send(streamAck, nil)
+	}
+	return n, nil
+}
+
+func (s *stream) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > streamChunk {
+			chunk = chunk[:streamChunk]
+		}
+
+		s.lock.Lock()
+		for s.credits == 0 && !s.closed && !s.done {
+			s.cond.Wait()
+		}
+		if s.closed || s.done {
+			s.lock.Unlock()
+			return n, io.ErrClosedPipe
+		}
+		s.credits--
+		s.lock.Unlock()
+
+		if err = s.send(streamData, append([]byte(nil), chunk...)); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// Close closes our end, telling the other end we are done writing.
+func (s *stream) Close() error {
+	s.lock.Lock()
+	if s.closed || s.done {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.in = nil
+	s.cond.Broadcast()
+	s.lock.Unlock()
+	return s.send(streamEOF, nil)
+}
+
+// Caller's end of a stream, Close waits on the handler to return.
+type callerStream struct {
+	*stream
+}
+
+func (c callerStream) Close() error {
+	c.stream.Close()
+	<-c.finished
+	return c.err
+}
+
+// OpenStream calls the stream handler registered as name, returning a full duplex stream to it.
+// Stream handlers should look like:
+// func name(stream io.ReadWriteCloser) error
+// Reads return io.EOF once the handler closes its end or returns, or the handler's error if it failed.
+// Close tells the handler we are done writing, then waits on it to return and returns its error.
+func (e *EzIPC) OpenStream(name string) (io.ReadWriteCloser, error) {
+	dest := e.getUplink()
+	if dest == nil {
+		if dest = e.lookup(name); dest == nil {
+			dest = e.provide(name)
+		}
+	}
+	if dest == nil {
+		if atomic.LoadUint32(&e.connected) == 0 {
+			return nil, ErrNotConnected
+		}
+		return nil, ErrClosed
+	}
+	if err := dest.recvErr(); err != nil {
+		return nil, err
+	}
+
+	// Local handlers are joined directly to our end.
+	if dest.exec != nil {
+		var local, remote *stream
+		local = newStream(func(kind string, data []byte) error {
+			remote.recv(kind, data)
+			return nil
+		})
+		remote = newStream(func(kind string, data []byte) error {
+			local.recv(kind, data)
+			return nil
+		})
+		atomic.AddInt64(&dest.inflight, 1)
+		e.spawn(func() {
+			defer atomic.AddInt64(&dest.inflight, -1)
+			resp := e.execute(dest, &msg{Dst: name, stream: remote})
+			local.finish(resp.decode(e.codec, nil))
+		})
+		return callerStream{local}, nil
+	}
+
+	bucket, tag := e.getBucket(dest)
+
+	st := newStream(func(kind string, data []byte) error {
+		e.tagMapLock.Lock()
+		dst := bucket.dst
+		e.tagMapLock.Unlock()
+		if dst == nil {
+			return ErrClosed
+		}
+		m := &msg{Tag: tag, Dst: name, Blob: data}
+		m.setHdr(hdrStream, kind)
+		return dst.send(m)
+	})
+
+	e.tagMapLock.Lock()
+	bucket.stream = st
+	e.tagMapLock.Unlock()
+
+	open := &msg{Tag: tag, Dst: name}
+	open.setHdr(hdrStream, streamOpen)
+	if err := dest.send(open); err != nil {
+		e.tagMapLock.Lock()
+		e.dropTag(tag)
+		e.tagMapLock.Unlock()
+		return nil, err
+	}
+
+	// The handler's reply completes the call, unless the connection is lost first.
+	go func() {
+		select {
+		case <-bucket.done:
+			e.tagMapLock.Lock()
+			resp := bucket.data
+			e.tagMapLock.Unlock()
+			st.finish(resp.decode(e.codec, nil))
+		case <-st.finished:
+			e.tagMapLock.Lock()
+			e.dropTag(tag)
+			e.tagMapLock.Unlock()
+		}
+	}()
+
+	return callerStream{st}, nil
+}
+
+// Wraps stream handler, the stream is passed with the message that opened it.
+func (e *EzIPC) wrapStreamFunc(fptr interface{}) (newFunc func(*msg) *msg, err error) {
+	funcPtr := reflect.ValueOf(fptr)
+
+	newFunc = func(req *msg) *msg {
+		req.Va1, req.Va2, req.Blob = "", "", nil
+		delete(req.Hdr, hdrStream)
+		st := req.stream
+		if st == nil {
+			req.Err = errNotStream.Error()
+			return req
+		}
+		req.stream = nil
+
+		out := funcPtr.Call([]reflect.Value{reflect.ValueOf(io.ReadWriteCloser(st))})
+		st.Close()
+		st.finish(nil)
+		if err, _ := out[0].Interface().(error); err != nil {
+			setErr(req, err)
+		}
+		return req
+	}
+	return newFunc, nil
+}
+
+var errNotStream = errors.New("Stream handlers must be called with OpenStream.")
+
+// Creates the handler's end of a stream opened by req, sending frames back to the caller over src.
+func newHandlerStream(req *msg, src *connection) *stream {
+	tag, name := req.Tag, req.Dst
+	return newStream(func(kind string, data []byte) error {
+		m := &msg{Tag: tag, Dst: name, Blob: data}
+		m.setHdr(hdrStream, kind)
+		return src.send(m)
+	})
+}
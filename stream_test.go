@@ -0,0 +1,89 @@
+package ezipc
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// Streams carry data larger than their window both ways, through a broker.
+func TestStreamEcho(t *testing.T) {
+	b, sock := newBroker(t)
+	newClient(t, sock, map[string]interface{}{
+		"Echo": func(stream io.ReadWriteCloser) error {
+			_, err := io.Copy(stream, stream)
+			return err
+		},
+	})
+	waitRoute(t, b, "Echo")
+	c := newClient(t, sock, nil)
+
+	st, err := c.OpenStream("Echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("0123456789abcdef"), streamChunk*streamWindow/8)
+	go st.Write(data)
+	got := make([]byte, len(data))
+	n, err := io.ReadFull(st, got)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Echoed %d of %d bytes, %v", n, len(data), err)
+	}
+	if err := st.Close(); err != nil {
+		t.Errorf("Close: %s", err)
+	}
+}
+
+// A stream opened to a name nobody provides ends with the broker's error, for a reader and for Close.
+func TestStreamUnknown(t *testing.T) {
+	_, sock := newBroker(t)
+	c := newClient(t, sock, nil)
+
+	st, err := c.OpenStream("Missing")
+	if err != nil {
+		return
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := st.Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil || err == io.EOF {
+			t.Errorf("Read of stream to unknown name = %v, want the broker's error.", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stream to unknown name never ended.")
+	}
+	if err := st.Close(); err == nil {
+		t.Error("Close of stream to unknown name succeeded.")
+	}
+}
+
+// A stream ends with ErrStreamOverflow once the other end sends more chunks than our window, rather than queueing them.
+func TestStreamOverflow(t *testing.T) {
+	var sent []string
+	s := newStream(func(kind string, data []byte) error {
+		sent = append(sent, kind)
+		return nil
+	})
+	for i := 0; i <= streamWindow; i++ {
+		s.recv(streamData, []byte{byte(i)})
+	}
+	if len(s.in) != 0 {
+		t.Errorf("%d chunks still queued after overflow.", len(s.in))
+	}
+	if _, err := s.Read(make([]byte, 1)); err != ErrStreamOverflow {
+		t.Errorf("Read after overflow = %v, want ErrStreamOverflow.", err)
+	}
+	if _, err := s.Write([]byte{1}); err != io.ErrClosedPipe {
+		t.Errorf("Write after overflow = %v, want io.ErrClosedPipe.", err)
+	}
+	select {
+	case <-s.finished:
+	default:
+		t.Errorf("Stream not finished after overflow.")
+	}
+}
@@ -0,0 +1,79 @@
+package ezipc
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"time"
+)
+
+// Prefix of addresses reached over TCP secured with TLS.
+const tlsScheme = "tls://"
+
+// Time allowed for the TLS handshake of an accepted connection.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// DialTLS operates as DialTCP, securing the connection with TLS configured by cfg.
+// The handshake completes before DialTLS returns, so errors verifying the broker's certificate are returned by it.
+// For mutual TLS, set the client certificate in cfg.Certificates, under TLS 1.3 a broker rejecting it closes the connection after DialTLS returns.
+func (e *EzIPC) DialTLS(addr string, cfg *tls.Config) error {
+	e.tls_config = cfg
+	return e.Dial(tlsScheme + addr)
+}
+
+// ListenTLS serves requests on TCP address addr, accepting only TLS connections configured by cfg, which must carry the server certificate.
+// For mutual TLS, set cfg.ClientAuth to tls.RequireAndVerifyClientCert and cfg.ClientCAs to the pool client certificates are verified against.
+// Unlike Listen, ListenTLS never joins a broker already serving addr.
+func (e *EzIPC) ListenTLS(addr string, cfg *tls.Config) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	e.socketf = tlsScheme + addr
+	return e.ListenWith(tls.NewListener(l, cfg))
+}
+
+// Connects to addr, completing the TLS handshake of tls:// addresses.
+func (e *EzIPC) dial(addr string) (net.Conn, error) {
+	dial := e.dialer
+	if dial == nil {
+		dial = net.Dial
+	}
+	if !strings.HasPrefix(addr, tlsScheme) {
+		network, address := splitAddr(addr)
+		if network == "unix" {
+			return dialLocal(e.dialer, address)
+		}
+		return dial(network, address)
+	}
+
+	addr = strings.TrimPrefix(addr, tlsScheme)
+	conn, err := dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	cfg := e.tls_config
+	if cfg == nil {
+		cfg = new(tls.Config)
+	}
+	// Verify the certificate against the host dialed unless told otherwise.
+	if cfg.ServerName == "" && !cfg.InsecureSkipVerify {
+		cfg = cfg.Clone()
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tc := tls.Client(conn, cfg)
+	if err = handshake(tc); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// Completes the TLS handshake of tc, giving up after tlsHandshakeTimeout.
+func handshake(tc *tls.Conn) error {
+	tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	return tc.SetDeadline(time.Time{})
+}
@@ -0,0 +1,84 @@
+package ezipc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// Returns a self-signed certificate for 127.0.0.1 and a pool trusting it.
+func selfSigned(t testing.TB) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ezipc test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// Peers trusting the broker's certificate call over TLS, others fail to dial.
+func TestTLS(t *testing.T) {
+	cert, pool := selfSigned(t)
+	addr := freeAddr(t)
+
+	b := newRouter(t)
+	errs := make(chan error, 1)
+	go func() { errs <- b.ListenTLS(addr, &tls.Config{Certificates: []tls.Certificate{cert}}) }()
+	select {
+	case <-b.Started():
+	case err := <-errs:
+		t.Fatalf("ListenTLS: %s", err)
+	}
+	t.Cleanup(func() { b.Close() })
+
+	p := newRouter(t)
+	p.RegisterName("Echo", func(arg int, reply *int) error { *reply = arg; return nil })
+	if err := p.DialTLS(addr, &tls.Config{RootCAs: pool}); err != nil {
+		t.Fatalf("DialTLS: %s", err)
+	}
+	t.Cleanup(func() { p.Close() })
+	waitRoute(t, b, "Echo")
+
+	c := newRouter(t)
+	if err := c.DialTLS(addr, &tls.Config{RootCAs: pool}); err != nil {
+		t.Fatalf("DialTLS: %s", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	var reply int
+	if err := c.Call("Echo", 5, &reply); err != nil || reply != 5 {
+		t.Errorf("Call over TLS = %d, %v", reply, err)
+	}
+
+	u := newRouter(t)
+	if err := u.DialTLS(addr, nil); err == nil {
+		u.Close()
+		t.Errorf("DialTLS without trusting the broker's certificate succeeded.")
+	}
+}
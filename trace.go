@@ -0,0 +1,84 @@
+package ezipc
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Calls kept by RecentCalls unless changed with SetCallTraceSize.
+const defaultTraceSize = 128
+
+// CallTrace records a completed call.
+type CallTrace struct {
+	// "call" for calls we made, "exec" for calls we executed and "relay" for calls we relayed.
+	Kind string
+	Name string
+	Tag  int32
+	// When the call completed, and how long it took.
+	When     time.Time
+	Duration time.Duration
+	// Error text, empty on success.
+	Err string
+	// ID of the connection the call came from, empty for calls we made.
+	Source string
+}
+
+// Ring buffer of recent call traces, written without locks.
+type traceRing struct {
+	pos   uint64
+	slots []atomic.Value
+}
+
+// SetCallTraceSize sets how many recent calls RecentCalls keeps, 0 disables tracing.
+func (e *EzIPC) SetCallTraceSize(n int) {
+	if n <= 0 {
+		e.traces.Store((*traceRing)(nil))
+		return
+	}
+	e.traces.Store(&traceRing{slots: make([]atomic.Value, n)})
+}
+
+// RecentCalls returns the most recently completed calls, oldest first.
+func (e *EzIPC) RecentCalls() (calls []CallTrace) {
+	r, _ := e.traces.Load().(*traceRing)
+	if r == nil {
+		return nil
+	}
+	end := atomic.LoadUint64(&r.pos)
+	start := uint64(0)
+	if end > uint64(len(r.slots)) {
+		start = end - uint64(len(r.slots))
+	}
+	for i := start; i < end; i++ {
+		if t, ok := r.slots[i%uint64(len(r.slots))].Load().(CallTrace); ok {
+			calls = append(calls, t)
+		}
+	}
+	return
+}
+
+// Records a completed call.
+func (e *EzIPC) trace(kind string, name string, tag int32, start time.Time, err string, src *connection) {
+	e.methods.record(kind, name, time.Since(start), err != "")
+	if err != "" {
+		atomic.AddUint64(&e.counters.errors, 1)
+	}
+
+	r, _ := e.traces.Load().(*traceRing)
+	if r == nil {
+		return
+	}
+	t := CallTrace{
+		Kind:     kind,
+		Name:     name,
+		Tag:      tag,
+		When:     time.Now(),
+		Err:      err,
+		Duration: time.Since(start),
+	}
+	if src != nil {
+		t.Source = src.id
+	}
+	n := atomic.AddUint64(&r.pos, 1) - 1
+	r.slots[n%uint64(len(r.slots))].Store(t)
+}
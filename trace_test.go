@@ -0,0 +1,51 @@
+package ezipc
+
+import (
+	"errors"
+	"testing"
+)
+
+// Calls are traced by the caller, the broker relaying them and the provider executing them.
+func TestRecentCalls(t *testing.T) {
+	b, sock := newBroker(t)
+	p := newClient(t, sock, map[string]interface{}{
+		"Echo": func(arg int, reply *int) error { *reply = arg; return nil },
+		"Fail": func(arg int, reply *int) error { return errors.New("failed") },
+	})
+	waitRoute(t, b, "Echo")
+	waitRoute(t, b, "Fail")
+	c := newClient(t, sock, nil)
+
+	var reply int
+	c.Call("Echo", 1, &reply)
+	c.Call("Fail", 1, &reply)
+
+	calls := c.RecentCalls()
+	if len(calls) != 2 || calls[0].Kind != "call" || calls[0].Name != "Echo" || calls[0].Err != "" || calls[1].Name != "Fail" || calls[1].Err != "failed" {
+		t.Errorf("Caller traced %+v", calls)
+	}
+	waitFor(t, "traces", func() bool { return len(b.RecentCalls()) == 2 && len(p.RecentCalls()) == 2 })
+	for _, call := range b.RecentCalls() {
+		if call.Kind != "relay" || call.Source == "" {
+			t.Errorf("Broker traced %+v", call)
+		}
+	}
+	for _, call := range p.RecentCalls() {
+		if call.Kind != "exec" || call.Source == "" {
+			t.Errorf("Provider traced %+v", call)
+		}
+	}
+
+	c.SetCallTraceSize(2)
+	for i := 1; i <= 3; i++ {
+		c.Call("Echo", i, &reply)
+	}
+	if calls := c.RecentCalls(); len(calls) != 2 || calls[0].When.After(calls[1].When) {
+		t.Errorf("Kept %+v, want the last 2 calls.", calls)
+	}
+	c.SetCallTraceSize(0)
+	c.Call("Echo", 1, &reply)
+	if calls := c.RecentCalls(); calls != nil {
+		t.Errorf("Traced %+v with tracing disabled.", calls)
+	}
+}
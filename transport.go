@@ -0,0 +1,46 @@
+//go:build !windows
+// +build !windows
+
+package ezipc
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+// Local transport, addresses which are not tcp:// or tls:// name Unix domain socket files.
+// Addresses starting with @ name Linux abstract sockets, the net package maps the @ to the leading null byte.
+
+// Determines if socketf names an abstract socket.
+func isAbstract(socketf string) bool {
+	return strings.HasPrefix(socketf, "@")
+}
+
+// Connects to socket file socketf with dial, net.Dial if nil.
+func dialLocal(dial Dialer, socketf string) (net.Conn, error) {
+	if dial == nil {
+		dial = net.Dial
+	}
+	return dial("unix", socketf)
+}
+
+// Listens on socket file socketf.
+func listenLocal(socketf string) (net.Listener, error) {
+	return net.Listen("unix", socketf)
+}
+
+// Removes a stale socket file left behind by a previous broker.
+func cleanupLocal(socketf string) {
+	if isAbstract(socketf) {
+		return
+	}
+	if fi, err := os.Lstat(socketf); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(socketf)
+	}
+}
+
+// Determines if err dialing socketf means no broker is serving it.
+func unservedLocal(err error) bool {
+	return strings.Contains(err.Error(), "no such file or directory")
+}
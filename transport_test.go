@@ -0,0 +1,72 @@
+//go:build !windows
+// +build !windows
+
+package ezipc
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// Listen takes over a socket file left behind by a dead broker, but never removes other files.
+func TestListenStaleSocket(t *testing.T) {
+	sock := tempSocket(t)
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetUnlinkOnClose(false)
+	l.Close()
+	if _, err := os.Lstat(sock); err != nil {
+		t.Fatalf("Stale socket file missing: %s", err)
+	}
+
+	b := newRouter(t)
+	listen(t, b, sock)
+	b.RegisterName("Echo", func(arg int, reply *int) error { *reply = arg; return nil })
+	c := newClient(t, sock, nil)
+	var reply int
+	if err := c.Call("Echo", 3, &reply); err != nil || reply != 3 {
+		t.Errorf("Call through broker on a stale socket = %d, %v", reply, err)
+	}
+
+	file := tempSocket(t)
+	if err := os.WriteFile(file, []byte("keep"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := newRouter(t).Listen(file); err == nil {
+		t.Errorf("Listen over a regular file succeeded.")
+	}
+	if data, err := os.ReadFile(file); err != nil || string(data) != "keep" {
+		t.Errorf("Listen disturbed a regular file at its address: %q, %v", data, err)
+	}
+}
+
+// Brokers serve Linux abstract sockets, which leave nothing behind once the broker closes.
+func TestAbstractSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Abstract sockets are Linux only.")
+	}
+	name := fmt.Sprintf("@ezipc-test-%d-%d", os.Getpid(), time.Now().UnixNano())
+
+	for i := 0; i < 2; i++ {
+		b := newRouter(t)
+		listen(t, b, name)
+		b.RegisterName("Echo", func(arg int, reply *int) error { *reply = arg; return nil })
+		c := newClient(t, name, nil)
+		var reply int
+		if err := c.Call("Echo", i, &reply); err != nil || reply != i {
+			t.Errorf("Call through broker %d on %s = %d, %v", i, name, reply, err)
+		}
+		if _, err := os.Lstat(name); err == nil {
+			t.Errorf("Listen on %s created a file.", name)
+		}
+		// The next broker takes the name over once this one and its client are gone.
+		c.Close()
+		b.Close()
+	}
+}
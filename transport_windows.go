@@ -0,0 +1,54 @@
+//go:build windows
+// +build windows
+
+package ezipc
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// Local transport, addresses which are not tcp:// or tls:// name Windows named pipes.
+// Full pipe names such as \\.\pipe\ezipc are used as is, anything else, such as a socket file path,
+// is mapped to a pipe of the same name so the same address works on every platform.
+
+// Prefix of named pipe names.
+const pipePrefix = `\\.\pipe\`
+
+// Time allowed for a busy pipe to accept our connection.
+const pipeDialTimeout = 5 * time.Second
+
+// Returns the named pipe for addr.
+func pipeName(addr string) string {
+	if strings.HasPrefix(addr, pipePrefix) {
+		return addr
+	}
+	return pipePrefix + strings.NewReplacer(`/`, `_`, `\`, `_`, `:`, `_`).Replace(addr)
+}
+
+// Connects to the named pipe for addr, or with dial if set by SetDialer.
+func dialLocal(dial Dialer, addr string) (net.Conn, error) {
+	if dial != nil {
+		return dial("unix", addr)
+	}
+	timeout := pipeDialTimeout
+	return winio.DialPipe(pipeName(addr), &timeout)
+}
+
+// Listens on the named pipe for addr.
+func listenLocal(addr string) (net.Listener, error) {
+	return winio.ListenPipe(pipeName(addr), nil)
+}
+
+// Named pipes are removed by the system once closed, there is nothing to clean up.
+func cleanupLocal(addr string) {}
+
+// Determines if err dialing addr means no broker is serving it.
+func unservedLocal(err error) bool {
+	return errors.Is(err, os.ErrNotExist)
+}
@@ -0,0 +1,73 @@
+package ezipc
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// ErrValidation is matched with errors.Is by errors from validators, set with WithValidator.
+var ErrValidation = errors.New("Validation failed.")
+
+// ValidationError is returned to the caller when a validator rejects the argument of a call, the handler is not invoked.
+type ValidationError struct {
+	Msg string
+}
+
+func (v *ValidationError) Error() string { return v.Msg }
+
+func (v *ValidationError) Is(target error) bool { return target == ErrValidation }
+
+// RegisterOption configures a function registered with RegisterWith.
+type RegisterOption func(*registration) error
+
+// Options of a registered function.
+type registration struct {
+	validator reflect.Value
+}
+
+// WithValidator runs validator, a func(argType T1) error, on each argument before the handler is invoked.
+// Arguments the validator rejects are returned to the caller as a *ValidationError.
+func WithValidator(validator interface{}) RegisterOption {
+	return func(r *registration) error {
+		fn := reflect.TypeOf(validator)
+		if fn == nil || fn.Kind() != reflect.Func || fn.NumIn() != 1 || fn.NumOut() != 1 || fn.Out(0) != errorType {
+			return fmt.Errorf("Validator must be a func(argType T1) error, got %s.", fn)
+		}
+		r.validator = reflect.ValueOf(validator)
+		return nil
+	}
+}
+
+// RegisterWith operates as RegisterName for a function, applying opts to the registration.
+func (e *EzIPC) RegisterWith(name string, fptr interface{}, opts ...RegisterOption) error {
+	if fptr == nil || reflect.TypeOf(fptr).Kind() != reflect.Func {
+		return errors.New("RegisterWith requires a function or method value.")
+	}
+	return e.registerFunc(name, fptr, opts...)
+}
+
+// Runs the validator, if any, on arg, returning the rejection.
+func (r *registration) validate(arg reflect.Value) error {
+	if !r.validator.IsValid() {
+		return nil
+	}
+	if err := r.validator.Call([]reflect.Value{arg})[0].Interface(); err != nil {
+		return &ValidationError{Msg: err.(error).Error()}
+	}
+	return nil
+}
+
+// Applies opts to a registration of fn.
+func newRegistration(fn reflect.Type, opts []RegisterOption) (*registration, error) {
+	r := new(registration)
+	for _, opt := range opts {
+		if err := opt(r); err != nil {
+			return nil, err
+		}
+	}
+	if arg, _ := argTypes(fn); r.validator.IsValid() && r.validator.Type().In(0) != arg {
+		return nil, fmt.Errorf("Validator takes %s, but function takes %s.", r.validator.Type().In(0), arg)
+	}
+	return r, nil
+}
@@ -0,0 +1,54 @@
+package ezipc
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+// Arguments a validator rejects reach the caller as a *ValidationError without the handler being invoked.
+func TestValidator(t *testing.T) {
+	var calls int32
+	p := newRouter(t)
+	err := p.RegisterWith("Sqrt", func(arg int, reply *int) error {
+		atomic.AddInt32(&calls, 1)
+		*reply = arg
+		return nil
+	}, WithValidator(func(arg int) error {
+		if arg < 0 {
+			return errors.New("Argument must not be negative.")
+		}
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, sock := newBroker(t)
+	if err := p.Dial(sock); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	waitRoute(t, b, "Sqrt")
+	c := newClient(t, sock, nil)
+
+	var reply int
+	if err := c.Call("Sqrt", 4, &reply); err != nil || reply != 4 {
+		t.Errorf("Valid call = %d, %v", reply, err)
+	}
+	err = c.Call("Sqrt", -1, &reply)
+	var ve *ValidationError
+	if !errors.As(err, &ve) || !errors.Is(err, ErrValidation) || ve.Msg != "Argument must not be negative." {
+		t.Errorf("Invalid call = %v, want the validator's *ValidationError", err)
+	}
+	if code := StatusCode(err); code != 400 {
+		t.Errorf("StatusCode of a validation error = %d, want 400", code)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("Handler invoked %d times, want only for the valid call", n)
+	}
+
+	// Validators must take the function's argument type.
+	if err := p.RegisterWith("Bad", func(arg int, reply *int) error { return nil }, WithValidator(func(arg string) error { return nil })); err == nil {
+		t.Error("Validator of the wrong argument type accepted.")
+	}
+}
@@ -0,0 +1,89 @@
+package ezipc
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Version aware routing among multiple providers of a name.
+type versioning struct {
+	lock sync.Mutex
+	// Connection label holding the version, empty disables.
+	label string
+}
+
+// SetVersionRouting prefers, among multiple providers of a name, those declaring the highest version under label.
+// Providers of equal version are used round-robin, shifting traffic to new versions as they register during rolling upgrades.
+// Versions are compared by dotted numeric parts, such as "v1.10.2", and providers without the label are least preferred.
+// An empty label restores preferring the most recent registration.
+func (e *EzIPC) SetVersionRouting(label string) {
+	e.versions.lock.Lock()
+	defer e.versions.lock.Unlock()
+	e.versions.label = label
+}
+
+// Picks a provider of name among candidates, preferring the highest version, returns nil if version routing is disabled.
+func (v *versioning) pick(name string, candidates []*connection, rr *rotation) *connection {
+	v.lock.Lock()
+	label := v.label
+	v.lock.Unlock()
+	if label == "" || len(candidates) == 0 {
+		return nil
+	}
+
+	var best []*connection
+	var best_ver string
+	for _, c := range candidates {
+		ver := c.labels[label]
+		switch n := compareVersions(ver, best_ver); {
+		case best == nil || n > 0:
+			best = []*connection{c}
+			best_ver = ver
+		case n == 0:
+			best = append(best, c)
+		}
+	}
+	return rr.next(name, best)
+}
+
+// Compares versions a and b, returning 1 if a is newer, -1 if b is newer, 0 if equal.
+func compareVersions(a, b string) int {
+	if a == b {
+		return 0
+	}
+	if a == "" {
+		return -1
+	}
+	if b == "" {
+		return 1
+	}
+	pa := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	pb := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		sa, sb := "0", "0"
+		if i < len(pa) {
+			sa = pa[i]
+		}
+		if i < len(pb) {
+			sb = pb[i]
+		}
+		na, erra := strconv.Atoi(sa)
+		nb, errb := strconv.Atoi(sb)
+		switch {
+		case erra == nil && errb == nil:
+			if na != nb {
+				if na > nb {
+					return 1
+				}
+				return -1
+			}
+		case sa != sb:
+			if sa > sb {
+				return 1
+			}
+			return -1
+		}
+	}
+	return 0
+}
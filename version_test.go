@@ -0,0 +1,56 @@
+package ezipc
+
+import (
+	"testing"
+)
+
+// Versions compare by dotted numeric parts, unlabelled providers being the oldest.
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"v1.10.2", "v1.9", 1},
+		{"1.2", "v1.2.0", 0},
+		{"1.2", "1.2.1", -1},
+		{"", "0.1", -1},
+		{"2.beta", "2.alpha", 1},
+	}
+	for _, tt := range tests {
+		if n := compareVersions(tt.a, tt.b); n != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, n, tt.want)
+		}
+	}
+}
+
+// Calls go round-robin to the providers declaring the highest version, skipping older ones.
+func TestVersionRouting(t *testing.T) {
+	b, sock := newBroker(t)
+	b.SetVersionRouting("version")
+	for id, version := range map[string]string{"old": "v1.9", "new1": "v1.10", "new2": "v1.10"} {
+		id := id
+		p := newRouter(t)
+		p.RegisterName("Who", func(arg int, reply *string) error { *reply = id; return nil })
+		if err := p.DialWithLabels(map[string]string{"version": version}, sock); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "providers", func() bool {
+		b.connMapLock.RLock()
+		defer b.connMapLock.RUnlock()
+		return len(b.connMap["Who"]) == 3
+	})
+
+	c := newClient(t, sock, nil)
+	seen := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		var reply string
+		if err := c.Call("Who", 0, &reply); err != nil {
+			t.Fatal(err)
+		}
+		seen[reply]++
+	}
+	if seen["new1"] != 2 || seen["new2"] != 2 {
+		t.Errorf("Calls went to %v, want two each to new1 and new2.", seen)
+	}
+}